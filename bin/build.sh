@@ -1,8 +1,41 @@
 #!/bin/bash -eu
 
-source /build-common.sh
+# runs in the official golang image (buildkit-golang's toolchain predates Go 1.23), so this does
+# what its standardBuildProcess did: check, test and cross compile to rel/
 
 BINARY_NAME="holepunch-server"
 COMPILE_IN_DIRECTORY="cmd/holepunch-server"
 
-standardBuildProcess
+# set by Turbo Bob
+version="${FRIENDLY_REV_ID:-dev}"
+
+buildForOsArch() {
+	local os="$1"
+	local arch="$2"
+
+	local suffix=""
+	if [ "$os" == "windows" ]; then
+		suffix=".exe"
+	fi
+
+	echo "# building $os-$arch"
+
+	CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build \
+		-ldflags "-extldflags \"-static\" -X github.com/function61/gokit/app/dynversion.Version=$version" \
+		-o "rel/${BINARY_NAME}_$os-$arch$suffix" \
+		"./$COMPILE_IN_DIRECTORY"
+}
+
+test -z "$(gofmt -l .)" || (echo "gofmt needed for:"; gofmt -l .; exit 1)
+
+go vet ./...
+
+go test ./...
+
+rm -rf rel/
+mkdir rel/
+
+# keep in sync with "os_arches" in turbobob.json
+buildForOsArch linux amd64
+buildForOsArch linux arm
+buildForOsArch windows amd64
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/io/bidipipe"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/net/http/httputils"
+	"github.com/function61/holepunch-server/pkg/bandwidthlimit"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"github.com/function61/holepunch-server/pkg/usageaccounting"
+	"github.com/function61/holepunch-server/pkg/wsconnadapter"
+	"github.com/gorilla/websocket"
+)
+
+// operator-facing API. on TCP every request needs "Authorization: Bearer <token>". on a Unix
+// socket (addr "unix:/run/holepunch/admin.sock") the file permissions are the access control.
+//
+//	GET /devices                                         => list connected clients
+//	GET /devices/<identity>/connect?port=80[&host=...]   => WebSocket stream to device's port
+//	GET /bandwidth                                       => current throughput of clients
+//	GET /usage[?period=2006-01|2006-01-02]               => usage accounting (default: this month)
+//	GET /usage.csv[?period=...]                          => same as CSV
+//	GET /auth-failures                                   => auth failure counts by reason
+func adminApi(
+	token string, // "" = no token required
+	bandwidthLimiter *bandwidthlimit.Limiter,
+	usageAccountant *usageaccounting.Accountant,
+	logger *log.Logger,
+) http.Handler {
+	logl := logex.Levels(logger)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		type deviceJson struct {
+			Identity      string    `json:"identity"`
+			User          string    `json:"user"`
+			RemoteAddr    string    `json:"remote_addr"`
+			ClientVersion string    `json:"client_version"`
+			Connected     time.Time `json:"connected"`
+		}
+
+		devices := []deviceJson{}
+		for _, session := range holepunchsshserver.Sessions() {
+			devices = append(devices, deviceJson{
+				Identity:      session.Identity,
+				User:          session.Conn.User(),
+				RemoteAddr:    session.Conn.RemoteAddr().String(),
+				ClientVersion: string(session.Conn.ClientVersion()),
+				Connected:     session.Connected,
+			})
+		}
+
+		respondJson(w, devices)
+	})
+
+	mux.HandleFunc("/bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		respondJson(w, bandwidthLimiter.Throughput())
+	})
+
+	usageForRequest := func(w http.ResponseWriter, r *http.Request) []usageaccounting.Usage {
+		period := cmp.Or(r.URL.Query().Get("period"), time.Now().UTC().Format("2006-01"))
+
+		usage, err := usageAccountant.Usage(period)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+
+		return usage
+	}
+
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		if usage := usageForRequest(w, r); usage != nil {
+			respondJson(w, usage)
+		}
+	})
+
+	mux.HandleFunc("/usage.csv", func(w http.ResponseWriter, r *http.Request) {
+		if usage := usageForRequest(w, r); usage != nil {
+			w.Header().Set("Content-Type", "text/csv")
+			_ = usageaccounting.WriteCsv(w, usage)
+		}
+	})
+
+	mux.HandleFunc("/auth-failures", func(w http.ResponseWriter, r *http.Request) {
+		respondJson(w, holepunchsshserver.AuthFailures())
+	})
+
+	mux.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		// "/devices/hp/mydevice/connect" => "hp/mydevice" (identities contain a slash)
+		identity, isConnect := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/devices/"), "/connect")
+		if !isConnect || identity == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+		if err != nil {
+			http.Error(w, "bad port", http.StatusBadRequest)
+			return
+		}
+
+		host := cmp.Or(r.URL.Query().Get("host"), "localhost")
+
+		// browsers let any web page open WebSockets to 127.0.0.1, so check before dialing anything
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+
+		session := holepunchsshserver.SessionByIdentity(identity)
+		if session == nil {
+			http.Error(w, "device not connected", http.StatusNotFound)
+			return
+		}
+
+		origin, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if err != nil { // Unix socket
+			origin = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		}
+
+		// dial before upgrading, so the operator gets a proper error if the device can't connect
+		deviceStream, err := sshserverportforward.DialThroughClient(session.Conn, host, uint32(port), origin)
+		if err != nil {
+			logl.Error.Printf("DialThroughClient: %s", err.Error())
+			http.Error(w, "dialing through device: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer deviceStream.Close()
+
+		wsConn, err := adminApiUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logl.Error.Printf("failure upgrading: %s", err.Error())
+			return
+		}
+		defer wsConn.Close()
+
+		if err := bidipipe.Pipe(
+			bidipipe.WithName("Operator", wsconnadapter.New(wsConn)),
+			bidipipe.WithName("Device", deviceStream),
+		); err != nil {
+			logl.Error.Println(err.Error())
+		}
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "token required", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// unlike the sshd's upgrader (which devices use), refuses WebSockets opened by other sites' pages
+var adminApiUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     sameOrigin,
+}
+
+// non-browser clients don't send Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(originUrl.Host, r.Host)
+}
+
+// addr is "host:port" (token required) or "unix:<path>"
+func serveAdminApi(
+	ctx context.Context,
+	addr string,
+	token string,
+	bandwidthLimiter *bandwidthlimit.Limiter,
+	usageAccountant *usageaccounting.Accountant,
+	logger *log.Logger,
+) error {
+	listener, err := adminApiListener(addr, token)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler: adminApi(token, bandwidthLimiter, usageAccountant, logger),
+	}
+
+	logex.Levels(logger).Info.Printf("Listening on %s", addr)
+
+	return httputils.CancelableServer(ctx, srv, func() error { return srv.Serve(listener) })
+}
+
+func adminApiListener(addr string, token string) (net.Listener, error) {
+	socketPath := strings.TrimPrefix(addr, "unix:")
+	if socketPath == addr {
+		if token == "" {
+			return nil, errors.New("admin API on TCP requires $ADMIN_API_TOKEN (or use unix:<path>)")
+		}
+
+		return net.Listen("tcp", addr)
+	}
+
+	// left behind by an earlier run that didn't stop cleanly
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func respondJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
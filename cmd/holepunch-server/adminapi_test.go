@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/bandwidthlimit"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"github.com/function61/holepunch-server/pkg/usageaccounting"
+	"github.com/function61/holepunch-server/pkg/wsconnadapter"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAdminApi(t *testing.T) {
+	usageAccountant, err := usageaccounting.New("", 0, nil, logex.Discard)
+	assert.Ok(t, err)
+
+	api := httptest.NewServer(adminApi("s3cret", bandwidthlimit.New(nil), usageAccountant, logex.Discard))
+	defer api.Close()
+
+	connectDevice(t, "admin-api-test-device")
+
+	authorized := http.Header{"Authorization": {"Bearer s3cret"}}
+
+	get := func(path string) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, api.URL+path, nil)
+		assert.Ok(t, err)
+		req.Header = authorized
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Ok(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/devices")
+	assert.Assert(t, status == http.StatusOK)
+	devices := []struct {
+		Identity string `json:"identity"`
+		User     string `json:"user"`
+	}{}
+	assert.Ok(t, json.Unmarshal([]byte(body), &devices))
+	deviceUser := ""
+	for _, device := range devices { // other tests' sessions may linger
+		if device.Identity == "hp/admin-api-test-device" {
+			deviceUser = device.User
+		}
+	}
+	assert.EqualString(t, deviceUser, "hp")
+
+	// device echoes on port 80
+	connectUrl := "ws" + strings.TrimPrefix(api.URL, "http") + "/devices/hp/admin-api-test-device/connect?port=80"
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(connectUrl, authorized)
+	assert.Ok(t, err)
+	deviceConn := wsconnadapter.New(wsConn)
+	_, err = deviceConn.Write([]byte("hello"))
+	assert.Ok(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(deviceConn, echoed)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(echoed), "hello")
+	assert.Ok(t, deviceConn.Close())
+
+	// a web page the operator has open can't use the operator's access
+	_, resp, err := websocket.DefaultDialer.Dial(connectUrl, http.Header{
+		"Authorization": {"Bearer s3cret"},
+		"Origin":        {"https://evil.example.com"},
+	})
+	assert.EqualString(t, err.Error(), "websocket: bad handshake")
+	assert.Assert(t, resp.StatusCode == http.StatusForbidden)
+
+	// same origin is fine
+	wsConn, _, err = websocket.DefaultDialer.Dial(connectUrl, http.Header{
+		"Authorization": {"Bearer s3cret"},
+		"Origin":        {api.URL},
+	})
+	assert.Ok(t, err)
+	assert.Ok(t, wsConn.Close())
+
+	_, resp, err = websocket.DefaultDialer.Dial(connectUrl, nil)
+	assert.EqualString(t, err.Error(), "websocket: bad handshake")
+	assert.Assert(t, resp.StatusCode == http.StatusUnauthorized)
+
+	authorized.Set("Authorization", "Bearer s3cret2")
+	status, _ = get("/devices")
+	assert.Assert(t, status == http.StatusUnauthorized)
+	authorized.Set("Authorization", "Bearer s3cret")
+
+	// device refuses => error before upgrading
+	status, body = get("/devices/hp/admin-api-test-device/connect?port=81")
+	assert.Assert(t, status == http.StatusBadGateway)
+	assert.EqualString(t, body, "dialing through device: ssh: rejected: connect failed (connection refused)\n")
+
+	status, body = get("/devices/hp/admin-api-test-tablet/connect?port=80")
+	assert.Assert(t, status == http.StatusNotFound)
+	assert.EqualString(t, body, "device not connected\n")
+
+	status, _ = get("/devices/hp/admin-api-test-device/connect?port=http")
+	assert.Assert(t, status == http.StatusBadRequest)
+
+	status, _ = get("/devices/hp/admin-api-test-device/disconnect")
+	assert.Assert(t, status == http.StatusNotFound)
+
+	status, body = get("/usage")
+	assert.Assert(t, status == http.StatusOK)
+	assert.EqualString(t, body, "[]\n")
+
+	status, _ = get("/usage?period=last-month")
+	assert.Assert(t, status == http.StatusBadRequest)
+
+	status, body = get("/bandwidth")
+	assert.Assert(t, status == http.StatusOK)
+	assert.EqualString(t, body, "[]\n")
+
+	status, body = get("/auth-failures")
+	assert.Assert(t, status == http.StatusOK)
+	assert.Assert(t, strings.HasPrefix(body, "{"))
+}
+
+// connects a device (as user "hp") to our sshd. the device echoes connections to its port 80 and refuses others
+func connectDevice(t *testing.T, name string) {
+	t.Helper()
+
+	deviceKey := sshtest.NewSigner(t)
+
+	serverConfig, err := holepunchsshserver.DefaultConfig([]ssh.Signer{sshtest.NewSigner(t)}, holepunchsshserver.AuthOptions{
+		ClientPubKeys: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(deviceKey.PublicKey()))) + " " + name,
+	})
+	assert.Ok(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		holepunchsshserver.ServeConn(conn, serverConfig, holepunchsshserver.Options{}, logex.Discard)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Ok(t, err)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            "hp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(deviceKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Ok(t, err)
+
+	device := ssh.NewClient(sshConn, chans, reqs)
+	t.Cleanup(func() { device.Close() })
+
+	// server tracks the session right after its end of the handshake
+	for i := 0; holepunchsshserver.SessionByIdentity("hp/"+name) == nil; i++ {
+		assert.Assert(t, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go func() {
+		for newChannel := range device.HandleChannelOpen("direct-tcpip") {
+			msg := struct {
+				Raddr string
+				Rport uint32
+				Laddr string
+				Lport uint32
+			}{}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil || msg.Rport != 80 {
+				_ = newChannel.Reject(ssh.ConnectionFailed, "connection refused")
+				continue
+			}
+
+			channel, channelReqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(channelReqs)
+
+			go func() {
+				defer channel.Close()
+				_, _ = io.Copy(channel, channel)
+			}()
+		}
+	}()
+}
+
+func TestAdminApiListener(t *testing.T) {
+	_, err := adminApiListener("127.0.0.1:0", "")
+	assert.EqualString(t, err.Error(), "admin API on TCP requires $ADMIN_API_TOKEN (or use unix:<path>)")
+
+	tempDir, err := ioutil.TempDir("", "adminapi")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	socketPath := filepath.Join(tempDir, "admin.sock")
+
+	// stale socket from an earlier run is replaced
+	stale, err := net.Listen("unix", socketPath)
+	assert.Ok(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.Ok(t, stale.Close())
+
+	listener, err := adminApiListener("unix:"+socketPath, "")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	assert.Ok(t, err)
+	assert.Assert(t, info.Mode().Perm() == 0600)
+
+	usageAccountant, err := usageaccounting.New("", 0, nil, logex.Discard)
+	assert.Ok(t, err)
+
+	go func() {
+		_ = http.Serve(listener, adminApi("", bandwidthlimit.New(nil), usageAccountant, logex.Discard))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+
+	resp, err := client.Get("http://admin/usage")
+	assert.Ok(t, err)
+	defer resp.Body.Close()
+	assert.Assert(t, resp.StatusCode == http.StatusOK)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/function61/holepunch-server/pkg/sshkeygen"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// manages the file given to "server --authorized-keys". server re-reads it on changes, so
+// there's no need to restart.
+func clientEntry() *cobra.Command {
+	authorizedKeys := "authorized_keys"
+
+	cmd := &cobra.Command{
+		Use:   "client",
+		Short: "Manage clients in the authorized keys file",
+	}
+
+	cmd.PersistentFlags().StringVarP(&authorizedKeys, "authorized-keys", "", authorizedKeys, "Client pubkeys file (authorized_keys format)")
+
+	cmd.AddCommand(clientAddEntry(&authorizedKeys))
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List clients",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(clientList(authorizedKeys))
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke [name]",
+		Short: "Remove client's key(s)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(clientRevoke(authorizedKeys, args[0]))
+		},
+	})
+
+	return cmd
+}
+
+func clientAddEntry(authorizedKeys *string) *cobra.Command {
+	permitListen := []string{}
+	noPortForwarding := false
+	server := "holepunch.example.com"
+	user := cmp.Or(os.Getenv("HP_SSH_USERNAME"), "hp")
+	hostKeys := hostKeyOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "add [name]",
+		Short: "Generate keypair for a new client and authorize it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(clientAdd(
+				*authorizedKeys,
+				args[0],
+				permitListen,
+				noPortForwarding,
+				server,
+				user,
+				hostKeys))
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&permitListen, "permit-listen", "", permitListen, "Only allow reverse forwards to this [host:]port (repeatable). Default: any")
+	cmd.Flags().BoolVarP(&noPortForwarding, "no-port-forwarding", "", noPortForwarding, "Deny all port forwarding")
+	cmd.Flags().StringVarP(&server, "server", "", server, "Server address (host[:port]) for the printed client config")
+	cmd.Flags().StringVarP(&user, "user", "", user, "SSH username for the printed client config (if the keys file is for a user from config file)")
+	hostKeyFlags(cmd, &hostKeys) // optional, for known_hosts lines
+
+	return cmd
+}
+
+func clientAdd(
+	authorizedKeysPath string,
+	name string,
+	permitListen []string,
+	noPortForwarding bool,
+	server string,
+	user string,
+	hostKeyOpts hostKeyOptions,
+) error {
+	// name is the key's comment, which is used as the client's identity
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid client name: %q", name)
+	}
+
+	lines, err := readAuthorizedKeys(authorizedKeysPath)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if line.name == name {
+			return fmt.Errorf("client %s already exists", name)
+		}
+	}
+
+	privateKeyPem, publicKey, err := sshkeygen.Ed25519(name)
+	if err != nil {
+		return err
+	}
+
+	options := []string{}
+	if noPortForwarding {
+		options = append(options, "no-port-forwarding")
+	}
+	for _, permitted := range permitListen {
+		options = append(options, fmt.Sprintf(`permitlisten="%s"`, permitted))
+	}
+
+	newLine := fmt.Sprintf("%s %s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), name)
+	if len(options) > 0 {
+		newLine = strings.Join(options, ",") + " " + newLine
+	}
+
+	if err := appendAuthorizedKey(authorizedKeysPath, newLine); err != nil {
+		return err
+	}
+
+	host, port := server, "22"
+	if hostWithoutPort, serverPort, err := net.SplitHostPort(server); err == nil {
+		host, port = hostWithoutPort, serverPort
+	}
+
+	fmt.Printf("# client %s added to %s\n", name, authorizedKeysPath)
+	fmt.Printf("# %s %s\n\n", publicKey.Type(), ssh.FingerprintSHA256(publicKey))
+	fmt.Printf("# private key, save as id_ed25519 (chmod 600):\n%s\n", privateKeyPem)
+
+	// known_hosts lines only if we know the host keys
+	if len(hostKeyOpts.paths) > 0 || hostKeyOpts.stateDir != "" || os.Getenv("SSH_HOSTKEY") != "" {
+		hostKeys, err := loadHostKeys(hostKeyOpts, false, logex.Levels(logex.StandardLogger()))
+		if err != nil {
+			return err
+		}
+
+		if err := writeHostKeyInfo(os.Stdout, hostKeys, []string{server}); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("# connect with OpenSSH:\n# $ ssh -i id_ed25519 -p %s -N -R %s:localhost:80 %s@%s\n",
+		port,
+		exampleRemoteForward(permitListen),
+		user,
+		host)
+
+	return nil
+}
+
+// the "[bind_address:]port" part of the -R example, for the first permitlisten="[host:]port"
+func exampleRemoteForward(permitListen []string) string {
+	if len(permitListen) == 0 {
+		return "8080"
+	}
+
+	host, port := "", permitListen[0]
+	if idx := strings.LastIndex(port, ":"); idx != -1 {
+		host, port = strings.Trim(port[:idx], "[]"), port[idx+1:]
+	}
+
+	if port == "*" { // any port is fine, but the example needs one
+		port = "<port>"
+	}
+
+	switch {
+	case host == "" || host == "*":
+		return port
+	case strings.Contains(host, ":"): // IPv6
+		return "[" + host + "]:" + port
+	default:
+		return host + ":" + port
+	}
+}
+
+func clientList(authorizedKeysPath string) error {
+	lines, err := readAuthorizedKeys(authorizedKeysPath)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tTYPE\tFINGERPRINT\tOPTIONS")
+
+	for _, line := range lines {
+		if line.key == nil {
+			continue
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n",
+			line.name,
+			line.key.Type(),
+			ssh.FingerprintSHA256(line.key),
+			strings.Join(line.options, ","))
+	}
+
+	return table.Flush()
+}
+
+func clientRevoke(authorizedKeysPath string, name string) error {
+	lines, err := readAuthorizedKeys(authorizedKeysPath)
+	if err != nil {
+		return err
+	}
+
+	kept := []string{}
+	revoked := 0
+	for _, line := range lines {
+		if line.key != nil && line.name == name {
+			revoked++
+			continue
+		}
+
+		kept = append(kept, line.raw+"\n")
+	}
+
+	if revoked == 0 {
+		return fmt.Errorf("client %s not found", name)
+	}
+
+	// write to temp file & rename, so the server never sees a half-written file
+	tempFile, err := ioutil.TempFile(filepath.Dir(authorizedKeysPath), ".authorized_keys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // no-op after successful rename
+
+	if _, err := tempFile.WriteString(strings.Join(kept, "")); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFile.Name(), authorizedKeysPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("revoked %d key(s) of %s\n", revoked, name)
+
+	return nil
+}
+
+type authorizedKeysLine struct {
+	raw     string
+	key     ssh.PublicKey // nil for comments & empty lines
+	name    string
+	options []string
+}
+
+// non-existing file has no lines
+func readAuthorizedKeys(path string) ([]authorizedKeysLine, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	lines := []authorizedKeysLine{}
+	for i, raw := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, authorizedKeysLine{raw: raw})
+			continue
+		}
+
+		key, name, options, _, err := ssh.ParseAuthorizedKey([]byte(trimmed))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+
+		lines = append(lines, authorizedKeysLine{raw, key, name, options})
+	}
+
+	return lines, nil
+}
+
+func appendAuthorizedKey(path string, line string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// previous last line might be missing its newline
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasSuffix(string(content), "\n") {
+			line = "\n" + line
+		}
+	}
+
+	if _, err := file.WriteString(line); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestExampleRemoteForward(t *testing.T) {
+	assert.EqualString(t, exampleRemoteForward(nil), "8080")
+	assert.EqualString(t, exampleRemoteForward([]string{"9000", "9001"}), "9000")
+	assert.EqualString(t, exampleRemoteForward([]string{"*"}), "<port>")
+	assert.EqualString(t, exampleRemoteForward([]string{"*:9000"}), "9000")
+	assert.EqualString(t, exampleRemoteForward([]string{"localhost:9000"}), "localhost:9000")
+	assert.EqualString(t, exampleRemoteForward([]string{"127.0.0.1:*"}), "127.0.0.1:<port>")
+	assert.EqualString(t, exampleRemoteForward([]string{"[::1]:9000"}), "[::1]:9000")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/function61/gokit/encoding/jsonfile"
+	"github.com/function61/holepunch-server/pkg/authzwebhook"
+	"github.com/function61/holepunch-server/pkg/bandwidthlimit"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/passwordauth"
+	"github.com/function61/holepunch-server/pkg/reverseproxy"
+	"github.com/function61/holepunch-server/pkg/sniproxy"
+	"github.com/function61/holepunch-server/pkg/tenancy"
+	"github.com/function61/holepunch-server/pkg/usageaccounting"
+)
+
+// optional config file for settings that don't fit in CLI flags / ENV vars
+type config struct {
+	BandwidthLimits []bandwidthlimit.Rule `json:"bandwidth_limits"`
+	UsageStore      string                `json:"usage_store"` // file to persist usage accounting to
+	// days of usage kept before the current month (default 400)
+	UsageRetentionDays int                     `json:"usage_retention_days"`
+	Quotas             []usageaccounting.Quota `json:"quotas"`
+	PasswordAuth       passwordauth.Config     `json:"password_auth"`
+	// more SSH usernames besides HP_SSH_USERNAME, each with own keys & policy
+	Users []holepunchsshserver.User `json:"users"`
+	// teams sharing the server, isolated from each other
+	Tenants []tenancy.Tenant `json:"tenants"`
+	// which ports the HTTP reverse proxy may route to
+	ReverseProxy reverseproxy.Options `json:"reverse_proxy"`
+	// which ports the TLS passthrough may route to
+	SniProxy sniproxy.Options `json:"sni_proxy"`
+	// ask an external service whether to let clients in and grant their forwards
+	AuthorizationWebhook *authzwebhook.Config `json:"authorization_webhook"`
+}
+
+func readConfig(path string) (*config, error) {
+	if path == "" {
+		return &config{}, nil
+	}
+
+	conf := &config{}
+	return conf, jsonfile.ReadDisallowUnknownFields(path, conf)
+}
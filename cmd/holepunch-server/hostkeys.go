@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/os/osutil"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type hostKeyOptions struct {
+	paths          []string // files or directories
+	passphraseFile string
+	stateDir       string // for generated host key
+}
+
+// host keys come from (in order of preference):
+// - --host-key files/directories
+// - SSH_HOSTKEY ENV var (base64-encoded, for backwards compatibility)
+// - --state-dir, where we generate a key on first start
+//
+// host certs for keys from ENV var or state dir come from SSH_HOSTCERT.
+// only the server generates: commands that just display keys must not create a different key
+// than the server's (e.g. when run with a wrong --state-dir)
+func loadHostKeys(opts hostKeyOptions, generate bool, logl *logex.Leveled) ([]ssh.Signer, error) {
+	passphrase, err := hostKeyPassphrase(opts.passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(opts.paths) > 0:
+		return holepunchsshserver.LoadHostKeys(opts.paths, passphrase)
+	case os.Getenv("SSH_HOSTKEY") != "":
+		hostKeysPem, err := osutil.GetenvRequiredFromBase64("SSH_HOSTKEY")
+		if err != nil {
+			return nil, err
+		}
+
+		hostKeys, err := holepunchsshserver.ParseHostKeys(hostKeysPem, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		return holepunchsshserver.AddHostCerts(hostKeys, os.Getenv("SSH_HOSTCERT"))
+	case opts.stateDir != "" && !generate:
+		hostKeys, err := holepunchsshserver.LoadHostKeys([]string{holepunchsshserver.StateDirHostKeyPath(opts.stateDir)}, nil)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("no host key in %s (the server generates it on first start)", opts.stateDir)
+			}
+
+			return nil, err
+		}
+
+		return holepunchsshserver.AddHostCerts(hostKeys, os.Getenv("SSH_HOSTCERT"))
+	case opts.stateDir != "":
+		hostKey, generated, err := holepunchsshserver.LoadOrGenerateHostKey(opts.stateDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if generated {
+			logl.Info.Printf("Generated new host key in %s", opts.stateDir)
+		}
+
+		return holepunchsshserver.AddHostCerts([]ssh.Signer{hostKey}, os.Getenv("SSH_HOSTCERT"))
+	default:
+		return nil, errors.New("no host keys: use --host-key, SSH_HOSTKEY or --state-dir")
+	}
+}
+
+// nil if no passphrase given
+func hostKeyPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// files usually end with a newline that's not part of the passphrase
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+
+	if passphrase, isSet := os.LookupEnv("SSH_HOSTKEY_PASSPHRASE"); isSet {
+		return []byte(passphrase), nil
+	}
+
+	return nil, nil
+}
+
+func hostKeyFlags(cmd *cobra.Command, opts *hostKeyOptions) {
+	cmd.Flags().StringArrayVarP(&opts.paths, "host-key", "", opts.paths, "SSH host key file or directory (repeatable). Default: SSH_HOSTKEY ENV var")
+	cmd.Flags().StringVarP(&opts.passphraseFile, "host-key-passphrase-file", "", opts.passphraseFile, "File containing passphrase for encrypted host keys (or use SSH_HOSTKEY_PASSPHRASE)")
+	cmd.Flags().StringVarP(&opts.stateDir, "state-dir", "", opts.stateDir, "If no host keys given, use the one in this directory (server generates it on first start)")
+}
+
+func hostKeyEntry() *cobra.Command {
+	hostKeys := hostKeyOptions{}
+	hosts := []string{}
+
+	cmd := &cobra.Command{
+		Use:   "hostkey",
+		Short: "Print host key fingerprints and known_hosts lines",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(func() error {
+				hostKeySigners, err := loadHostKeys(hostKeys, false, logex.Levels(logex.StandardLogger()))
+				if err != nil {
+					return err
+				}
+
+				if len(hosts) == 0 {
+					hostname, err := os.Hostname()
+					if err != nil {
+						return err
+					}
+
+					hosts = []string{hostname}
+				}
+
+				return writeHostKeyInfo(os.Stdout, hostKeySigners, hosts)
+			}())
+		},
+	}
+
+	hostKeyFlags(cmd, &hostKeys)
+	cmd.Flags().StringArrayVarP(&hosts, "host", "", hosts, "Hostname (or host:port) that clients connect to (repeatable). Default: this machine's hostname")
+
+	return cmd
+}
+
+// GET /_hostkeys[?host=example.com:2222] => same as "hostkey" command, so clients can bootstrap
+// trust over HTTPS. hostname defaults to the one the request was made to.
+func hostKeysHandler(hostKeys []ssh.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		if host == "" {
+			// r.Host port (if any) is the HTTP port, which is not what SSH clients connect to
+			host = r.Host
+			if hostWithoutPort, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = hostWithoutPort
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = writeHostKeyInfo(w, hostKeys, []string{host})
+	}
+}
+
+// fingerprints, known_hosts lines and "@cert-authority" lines for the CAs of our host certs
+func writeHostKeyInfo(output io.Writer, hostKeys []ssh.Signer, hosts []string) error {
+	fingerprints := []string{}
+	knownHosts := []string{}
+	certAuthorities := []string{}
+
+	for _, hostKey := range hostKeys {
+		if cert, isCert := hostKey.PublicKey().(*ssh.Certificate); isCert {
+			line := "@cert-authority " + knownhosts.Line(hosts, cert.SignatureKey)
+			if !containsString(certAuthorities, line) { // many certs can be from same CA
+				certAuthorities = append(certAuthorities, line)
+			}
+			continue
+		}
+
+		fingerprints = append(fingerprints, fmt.Sprintf("%s %s", hostKey.PublicKey().Type(), ssh.FingerprintSHA256(hostKey.PublicKey())))
+		knownHosts = append(knownHosts, knownhosts.Line(hosts, hostKey.PublicKey()))
+	}
+
+	sections := []string{
+		"# fingerprints\n" + strings.Join(fingerprints, "\n"),
+		"# known_hosts\n" + strings.Join(knownHosts, "\n"),
+	}
+
+	if len(certAuthorities) > 0 {
+		sections = append(sections, "# known_hosts (trust host CA instead of pinning keys)\n"+strings.Join(certAuthorities, "\n"))
+	}
+
+	_, err := fmt.Fprintln(output, strings.Join(sections, "\n\n"))
+	return err
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestLoadHostKeysOnlyServerGenerates(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "hostkeys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(stateDir)
+
+	opts := hostKeyOptions{stateDir: stateDir}
+	logl := logex.Levels(logex.Discard)
+
+	_, err = loadHostKeys(opts, false, logl)
+	assert.EqualString(t, err.Error(), "no host key in "+stateDir+" (the server generates it on first start)")
+
+	files, err := ioutil.ReadDir(stateDir)
+	assert.Ok(t, err)
+	assert.Assert(t, len(files) == 0)
+
+	generated, err := loadHostKeys(opts, true, logl)
+	assert.Ok(t, err)
+
+	loaded, err := loadHostKeys(opts, false, logl)
+	assert.Ok(t, err)
+	assert.EqualString(t, ssh.FingerprintSHA256(loaded[0].PublicKey()), ssh.FingerprintSHA256(generated[0].PublicKey()))
+}
+
+func TestWriteHostKeyInfo(t *testing.T) {
+	hostKey, hostCA := sshtest.NewSigner(t), sshtest.NewSigner(t)
+	certSigner := hostCertSigner(t, hostKey, hostCA)
+
+	output := &bytes.Buffer{}
+	assert.Ok(t, writeHostKeyInfo(output, []ssh.Signer{hostKey, certSigner, certSigner}, []string{"hp.example.com:2222"}))
+
+	assert.EqualString(t, output.String(), `# fingerprints
+ssh-ed25519 `+ssh.FingerprintSHA256(hostKey.PublicKey())+`
+
+# known_hosts
+`+knownhosts.Line([]string{"hp.example.com:2222"}, hostKey.PublicKey())+`
+
+# known_hosts (trust host CA instead of pinning keys)
+@cert-authority `+knownhosts.Line([]string{"hp.example.com:2222"}, hostCA.PublicKey())+`
+`)
+}
+
+func TestHostKeysHandler(t *testing.T) {
+	hostKey := sshtest.NewSigner(t)
+	handler := hostKeysHandler([]ssh.Signer{hostKey})
+
+	knownHostsLineFor := func(url string) string {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Assert(t, rec.Code == http.StatusOK)
+		assert.EqualString(t, rec.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+
+		lines := strings.Split(rec.Body.String(), "\n")
+		return lines[4] // after fingerprints section
+	}
+
+	// HTTP port is not the SSH port
+	assert.EqualString(t, knownHostsLineFor("http://hp.example.com:8080/_hostkeys"), knownhosts.Line([]string{"hp.example.com"}, hostKey.PublicKey()))
+	assert.EqualString(t, knownHostsLineFor("http://hp.example.com/_hostkeys?host=ssh.example.com:2222"), knownhosts.Line([]string{"ssh.example.com:2222"}, hostKey.PublicKey()))
+}
+
+func hostCertSigner(t *testing.T, hostKey ssh.Signer, hostCA ssh.Signer) ssh.Signer {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "holepunch",
+		ValidPrincipals: []string{"hp.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.Ok(t, cert.SignCert(rand.Reader, hostCA))
+
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	assert.Ok(t, err)
+
+	return certSigner
+}
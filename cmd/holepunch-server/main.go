@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/function61/gokit/app/dynversion"
 	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/net/http/httputils"
 	"github.com/function61/gokit/os/osutil"
 	"github.com/function61/gokit/sync/taskrunner"
+	"github.com/function61/holepunch-server/pkg/auditlog"
+	"github.com/function61/holepunch-server/pkg/authzwebhook"
+	"github.com/function61/holepunch-server/pkg/bandwidthlimit"
 	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/passwordauth"
 	"github.com/function61/holepunch-server/pkg/reverseproxy"
+	"github.com/function61/holepunch-server/pkg/sniproxy"
+	"github.com/function61/holepunch-server/pkg/socks5server"
 	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"github.com/function61/holepunch-server/pkg/tenancy"
+	"github.com/function61/holepunch-server/pkg/usageaccounting"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 )
@@ -26,6 +39,8 @@ func main() {
 	}
 
 	app.AddCommand(serverEntry())
+	app.AddCommand(hostKeyEntry())
+	app.AddCommand(clientEntry())
 
 	osutil.ExitIfError(app.Execute())
 }
@@ -33,7 +48,19 @@ func main() {
 func serverEntry() *cobra.Command {
 	sshdOverWebsocket := false
 	sshdOverTcp := ""
+	sshdOverConnect := ""
+	sshdOverLongPoll := false
+	sshdOverQuic := ""
 	reverseProxy := false
+	socks5 := ""
+	sniProxy := ""
+	directTcpipDns := ""
+	adminApiAddr := ""
+	sshOptions := holepunchsshserver.Options{}
+	configPath := ""
+	auditLog := ""
+	hostKeys := hostKeyOptions{}
+	authorizedKeys := ""
 
 	cmd := &cobra.Command{
 		Use:   "server",
@@ -46,7 +73,19 @@ func serverEntry() *cobra.Command {
 				osutil.CancelOnInterruptOrTerminate(rootLogger),
 				sshdOverWebsocket,
 				sshdOverTcp,
+				sshdOverConnect,
+				sshdOverLongPoll,
+				sshdOverQuic,
 				reverseProxy,
+				socks5,
+				sniProxy,
+				directTcpipDns,
+				adminApiAddr,
+				sshOptions,
+				configPath,
+				auditLog,
+				hostKeys,
+				authorizedKeys,
 				rootLogger,
 			))
 		},
@@ -54,7 +93,19 @@ func serverEntry() *cobra.Command {
 
 	cmd.Flags().BoolVarP(&sshdOverWebsocket, "sshd-websocket", "", sshdOverWebsocket, "Serve holepunch-SSHD over WS")
 	cmd.Flags().StringVarP(&sshdOverTcp, "sshd-tcp", "", sshdOverTcp, "Serve holepunch-SSHD over TCP, specify e.g. 0.0.0.0:22")
+	cmd.Flags().StringVarP(&sshdOverConnect, "sshd-connect", "", sshdOverConnect, "Serve holepunch-SSHD over HTTP CONNECT to this authority, e.g. ssh.example.com:443")
+	cmd.Flags().BoolVarP(&sshdOverLongPoll, "sshd-longpoll", "", sshdOverLongPoll, "Serve holepunch-SSHD over long-polling HTTP (at /_ssh-poll/), for networks that strip WS & CONNECT")
+	cmd.Flags().StringVarP(&sshdOverQuic, "sshd-quic", "", sshdOverQuic, "Serve holepunch-SSHD over QUIC (survives client's IP changes), specify e.g. 0.0.0.0:443")
 	cmd.Flags().BoolVarP(&reverseProxy, "http-reverse-proxy", "", reverseProxy, "Enable holepunch HTTP reverse proxy")
+	hostKeyFlags(cmd, &hostKeys)
+	cmd.Flags().StringVarP(&authorizedKeys, "authorized-keys", "", authorizedKeys, "Client pubkeys file (authorized_keys format, managed with 'client' command), re-read on changes")
+	cmd.Flags().StringVarP(&configPath, "config", "", configPath, "Path to JSON config file (optional)")
+	cmd.Flags().StringVarP(&auditLog, "audit-log", "", auditLog, "Write security audit log to file (rotated at 10 MB) or 'syslog'")
+	cmd.Flags().BoolVarP(&sshOptions.SessionCommands, "ssh-session-commands", "", sshOptions.SessionCommands, "Answer SSH exec requests for built-in commands (list-forwards, whoami, status, ping)")
+	cmd.Flags().StringVarP(&socks5, "socks5", "", socks5, "Serve SOCKS5 proxy into clients' reverse forwards, specify e.g. 127.0.0.1:1080")
+	cmd.Flags().StringVarP(&sniProxy, "sni-proxy", "", sniProxy, "Serve TLS passthrough into clients' reverse forwards by SNI, specify e.g. 0.0.0.0:8883")
+	cmd.Flags().StringVarP(&adminApiAddr, "admin-api", "", adminApiAddr, "Serve operator API on e.g. 127.0.0.1:8081 (needs $ADMIN_API_TOKEN) or unix:/run/holepunch/admin.sock")
+	cmd.Flags().StringVarP(&directTcpipDns, "direct-tcpip-dns", "", directTcpipDns, "DNS server for resolving forward (direct-tcpip) destinations, e.g. 192.168.1.1:53")
 
 	return cmd
 }
@@ -63,11 +114,78 @@ func server(
 	ctx context.Context,
 	sshdOverWebsocket bool,
 	sshdOverTcp string,
+	sshdOverConnect string,
+	sshdOverLongPoll bool,
+	sshdOverQuic string,
 	reverseProxy bool,
+	socks5 string,
+	sniProxy string,
+	directTcpipDns string,
+	adminApiAddr string,
+	sshOptions holepunchsshserver.Options,
+	configPath string,
+	auditLog string,
+	hostKeys hostKeyOptions,
+	authorizedKeys string,
 	logger *log.Logger,
 ) error {
+	conf, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if auditLog != "" {
+		auditSink, err := openAuditLog(auditLog)
+		if err != nil {
+			return err
+		}
+
+		auditlog.SetSink(auditSink, logex.Prefix("auditlog", logger))
+	}
+
 	sshserverportforward.SetLogger(logex.Prefix("sshd-portforward", logger))
 
+	tenants, err := tenancy.New(conf.Tenants)
+	if err != nil {
+		return err
+	}
+
+	// tenant isolation first, so other forward authorizers don't see cross-tenant requests
+	sshserverportforward.AddForwardAuthorizer(tenants.AuthorizeForward)
+	sshserverportforward.SetForwardLimiter(tenants.LimitForwards)
+
+	usageAccountant, err := usageaccounting.New(conf.UsageStore, conf.UsageRetentionDays, conf.Quotas, logex.Prefix("usageaccounting", logger))
+	if err != nil {
+		return err
+	}
+
+	// tenant limits first, then accounting, so connections refused by quota don't get
+	// throttled needlessly
+	sshserverportforward.AddStreamInterceptor(tenants.Intercept)
+	sshserverportforward.AddStreamInterceptor(usageAccountant.Intercept)
+
+	bandwidthLimiter := bandwidthlimit.New(conf.BandwidthLimits)
+	sshserverportforward.AddStreamInterceptor(bandwidthLimiter.Intercept)
+
+	if directTcpipDns != "" {
+		resolver, err := sshserverportforward.ResolverForDnsServer(directTcpipDns)
+		if err != nil {
+			return err
+		}
+
+		sshserverportforward.SetResolver(resolver)
+	}
+
+	var authzWebhook *authzwebhook.Webhook
+	if conf.AuthorizationWebhook != nil {
+		authzWebhook, err = authzwebhook.New(*conf.AuthorizationWebhook, logex.Prefix("authzwebhook", logger))
+		if err != nil {
+			return err
+		}
+
+		sshserverportforward.AddForwardAuthorizer(authzWebhook.AuthorizeForward)
+	}
+
 	logl := logex.Levels(logger)
 
 	defer logl.Info.Println("Stopped")
@@ -76,66 +194,211 @@ func server(
 
 	logl.Info.Printf("holepunch-server %s starting", dynversion.Version)
 
-	if sshdOverTcp != "" {
-		sshConf, err := sshConfig()
+	tasks.Start("usageaccounting", usageAccountant.Run)
+
+	var sshConf *ssh.ServerConfig
+	var hostKeySigners []ssh.Signer
+	if sshdOverTcp != "" || sshdOverWebsocket || sshdOverConnect != "" || sshdOverLongPoll || sshdOverQuic != "" {
+		sshConf, hostKeySigners, err = sshConfig(hostKeys, authorizedKeys, conf.Users, conf.PasswordAuth, authzWebhook, logl)
 		if err != nil {
 			return err
 		}
+	}
 
+	if sshdOverTcp != "" {
 		tasks.Start("tcp-sshd", func(ctx context.Context) error {
 			return serveSshdOnTCP(
 				ctx,
 				sshdOverTcp,
 				sshConf,
+				sshOptions,
 				logex.Prefix("tcp-sshd", logger))
 		})
 	}
 
+	if sshdOverQuic != "" {
+		tasks.Start("quic-sshd", func(ctx context.Context) error {
+			return serveSshdOnQuic(
+				ctx,
+				sshdOverQuic,
+				sshConf,
+				sshOptions,
+				logex.Prefix("quic-sshd", logger))
+		})
+	}
+
+	if socks5 != "" {
+		tasks.Start("socks5", func(ctx context.Context) error {
+			return socks5server.Serve(
+				ctx,
+				socks5,
+				socks5IntoDevices,
+				logex.Prefix("socks5", logger))
+		})
+	}
+
+	if sniProxy != "" {
+		sniProxyOptions := conf.SniProxy
+		sniProxyOptions.VirtualHostAllowed = tenants.VirtualHostAllowed
+
+		tasks.Start("sniproxy", func(ctx context.Context) error {
+			return sniproxy.Serve(
+				ctx,
+				sniProxy,
+				sniProxyOptions,
+				logex.Prefix("sniproxy", logger))
+		})
+	}
+
+	if adminApiAddr != "" {
+		tasks.Start("adminapi", func(ctx context.Context) error {
+			return serveAdminApi(
+				ctx,
+				adminApiAddr,
+				os.Getenv("ADMIN_API_TOKEN"),
+				bandwidthLimiter,
+				usageAccountant,
+				logex.Prefix("adminapi", logger))
+		})
+	}
+
 	mux := http.NewServeMux()
 
 	if sshdOverWebsocket {
-		sshConf, err := sshConfig()
+		RegisterSshdOverWebsocket(
+			mux,
+			sshConf,
+			sshOptions,
+			logex.Prefix("ws", logger))
+	}
+
+	if sshdOverLongPoll {
+		// same proxies are in front of us as for the reverse proxy
+		clientIp, err := reverseproxy.VisitorIpResolver(conf.ReverseProxy.TrustedProxies)
 		if err != nil {
 			return err
 		}
 
-		RegisterSshdOverWebsocket(
+		RegisterSshdOverLongPoll(
 			mux,
 			sshConf,
-			logex.Prefix("ws", logger))
+			sshOptions,
+			clientIp,
+			logex.Prefix("longpoll", logger))
+	}
+
+	// only reachable if the HTTP server runs (see below)
+	if sshConf != nil {
+		mux.HandleFunc("/_hostkeys", hostKeysHandler(hostKeySigners))
 	}
 
 	if reverseProxy {
-		reverseproxy.Register(mux, logex.Prefix("reverseproxy", logger))
+		reverseProxyOptions := conf.ReverseProxy
+		reverseProxyOptions.VirtualHostAllowed = tenants.VirtualHostAllowed
+
+		if err := reverseproxy.Register(mux, reverseProxyOptions, logex.Prefix("reverseproxy", logger)); err != nil {
+			return err
+		}
+	}
+
+	var httpHandler http.Handler = mux
+	if sshdOverConnect != "" {
+		httpHandler = wrapSshdOverConnect(mux, sshdOverConnect, sshConf, sshOptions, logex.Prefix("connect", logger))
 	}
 
 	// only need HTTP if these services are enabled
-	if sshdOverWebsocket || reverseProxy {
+	if sshdOverWebsocket || reverseProxy || sshdOverConnect != "" || sshdOverLongPoll {
 		tasks.Start("httpserver", func(ctx context.Context) error {
-			return serveHttp(ctx, mux, logex.Prefix("httpserver", logger))
+			return serveHttp(ctx, httpHandler, logex.Prefix("httpserver", logger))
 		})
 	}
 
 	return tasks.Wait()
 }
 
-func sshConfig() (*ssh.ServerConfig, error) {
-	hostPrivateKey, err := osutil.GetenvRequiredFromBase64("SSH_HOSTKEY")
+func openAuditLog(destination string) (auditlog.Sink, error) {
+	if destination == "syslog" {
+		return auditlog.NewSyslogSink("holepunch-server")
+	}
+
+	return auditlog.NewFileSink(destination, 10*1024*1024, 10)
+}
+
+// also returns the host keys, so we can tell clients about them
+func sshConfig(
+	hostKeyOpts hostKeyOptions,
+	authorizedKeys string,
+	users []holepunchsshserver.User,
+	passwordAuthConf passwordauth.Config,
+	authzWebhook *authzwebhook.Webhook, // nil if not configured
+	logl *logex.Leveled,
+) (*ssh.ServerConfig, []ssh.Signer, error) {
+	hostKeys, err := loadHostKeys(hostKeyOpts, true, logl)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	clientPubKey, err := osutil.GetenvRequired("CLIENT_PUBKEY")
+	for _, hostKey := range hostKeys {
+		if cert, isCert := hostKey.PublicKey().(*ssh.Certificate); isCert {
+			logl.Info.Printf("Host certificate %q for %s", cert.KeyId, ssh.FingerprintSHA256(cert.Key))
+		} else {
+			logl.Info.Printf("Host key %s %s", hostKey.PublicKey().Type(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+		}
+	}
+
+	passwordAuth, err := passwordauth.New(passwordAuthConf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	authOptions := holepunchsshserver.AuthOptions{
+		ClientPubKeys:      os.Getenv("CLIENT_PUBKEY"),
+		AuthorizedKeysPath: authorizedKeys,
+		TrustedUserCAs:     os.Getenv("CLIENT_USER_CA"),
+		Users:              users,
+		Password:           passwordAuth,
+	}
+
+	if authzWebhook != nil {
+		authOptions.KeyAuthorization = authzWebhook.AuthorizeKey
 	}
 
-	conf, err := holepunchsshserver.DefaultConfig(hostPrivateKey, clientPubKey)
+	conf, err := holepunchsshserver.DefaultConfig(hostKeys, authOptions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	return conf, hostKeys, nil
+}
+
+// SOCKS destination "<name>.<user>:<port>" connects to the reverse forward that the client with
+// identity "<user>/<name>" has for the port (hostnames can't have a slash, and URLs would take
+// it as the start of the path). if there's no such reverse forward, we ask the client to
+// connect to localhost:<port> on its side.
+func socks5IntoDevices(host string, port int, origin net.Addr) (io.ReadWriteCloser, error) {
+	identity := identityFromHostname(host)
+
+	stream, err := sshserverportforward.DialReverseForward(identity, uint32(port), origin)
+	if err == nil || !errors.Is(err, sshserverportforward.ErrNoReverseForward) {
+		return stream, err
+	}
+
+	session := holepunchsshserver.SessionByIdentity(identity)
+	if session == nil {
+		return nil, fmt.Errorf("device not connected: %s", identity)
+	}
+
+	return sshserverportforward.DialThroughClient(session.Conn, "localhost", uint32(port), origin)
+}
+
+// "mydevice.hp" => "hp/mydevice", "camera.office.hp" => "hp/camera.office", "hp" => "hp"
+func identityFromHostname(host string) string {
+	idx := strings.LastIndex(host, ".")
+	if idx == -1 {
+		return host
 	}
 
-	return conf, nil
+	return host[idx+1:] + "/" + host[:idx]
 }
 
 func serveHttp(ctx context.Context, handler http.Handler, logger *log.Logger) error {
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestIdentityFromHostname(t *testing.T) {
+	assert.EqualString(t, identityFromHostname("mydevice.hp"), "hp/mydevice")
+	assert.EqualString(t, identityFromHostname("camera.office.team-a"), "team-a/camera.office")
+	assert.EqualString(t, identityFromHostname("hp"), "hp")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/connecttunnel"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"golang.org/x/crypto/ssh"
+)
+
+// CONNECT requests can't be routed by http.ServeMux, so this wraps the whole mux
+func wrapSshdOverConnect(next http.Handler, authority string, conf *ssh.ServerConfig, options holepunchsshserver.Options, logger *log.Logger) http.Handler {
+	logl := logex.Levels(logger)
+
+	sshdLogger := logex.Prefix("sshd", logger)
+
+	return connecttunnel.Handler(next, authority, func(conn net.Conn) {
+		logl.Info.Printf("handoff to holepunchsshserver from %s", conn.RemoteAddr())
+
+		holepunchsshserver.ServeConn(conn, conf, options, sshdLogger)
+	})
+}
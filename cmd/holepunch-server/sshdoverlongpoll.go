@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/longpollconnadapter"
+	"golang.org/x/crypto/ssh"
+)
+
+// fallback for networks that strip both WebSocket upgrades and CONNECT. clientIp is for
+// capping sessions per client behind trusted proxies
+func RegisterSshdOverLongPoll(
+	mux *http.ServeMux,
+	conf *ssh.ServerConfig,
+	options holepunchsshserver.Options,
+	clientIp func(*http.Request) string,
+	logger *log.Logger,
+) {
+	logl := logex.Levels(logger)
+
+	sshdLogger := logex.Prefix("sshd", logger)
+
+	server := longpollconnadapter.NewServer(func(conn net.Conn) {
+		logl.Info.Printf("handoff to holepunchsshserver from %s", conn.RemoteAddr())
+
+		holepunchsshserver.ServeConn(conn, conf, options, sshdLogger)
+	})
+	server.SetClientIp(clientIp)
+
+	mux.Handle("/_ssh-poll/", http.StripPrefix("/_ssh-poll", server))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/sync/taskrunner"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/quicconnadapter"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/ssh"
+)
+
+// each bidirectional stream of a QUIC connection is its own SSH connection, so a client can
+// e.g. keep its control connection and bulk transfers in separate streams that don't block
+// each other
+func serveSshdOnQuic(
+	ctx context.Context,
+	addr string,
+	conf *ssh.ServerConfig,
+	options holepunchsshserver.Options,
+	logger *log.Logger,
+) error {
+	tlsConfig, err := quicconnadapter.SelfSignedTlsConfig()
+	if err != nil {
+		return err
+	}
+
+	quicListener, err := quic.ListenAddr(addr, tlsConfig, &quic.Config{
+		KeepAlivePeriod: 15 * time.Second,
+		MaxIdleTimeout:  60 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	logex.Levels(logger).Info.Printf("Listening on %s", addr)
+
+	return serveSshdOnQuicListener(ctx, quicListener, conf, options, logger)
+}
+
+func serveSshdOnQuicListener(
+	ctx context.Context,
+	quicListener *quic.Listener,
+	conf *ssh.ServerConfig,
+	options holepunchsshserver.Options,
+	logger *log.Logger,
+) error {
+	logl := logex.Levels(logger)
+	sshdLogger := logex.Prefix("sshd", logger)
+
+	tasks := taskrunner.New(ctx, logger)
+
+	tasks.Start("listener "+quicListener.Addr().String(), func(ctx context.Context) error {
+		for {
+			quicConn, err := quicListener.Accept(ctx)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return nil // expected error
+				default:
+					return err // unexpected error
+				}
+			}
+
+			go func() {
+				for {
+					stream, err := quicConn.AcceptStream(ctx)
+					if err != nil {
+						logl.Debug.Printf("%s: %v", quicConn.RemoteAddr(), err)
+						return
+					}
+
+					go holepunchsshserver.ServeConn(quicconnadapter.New(quicConn, stream), conf, options, sshdLogger)
+				}
+			}()
+		}
+	})
+
+	tasks.Start("listenercloser", func(ctx context.Context) error {
+		<-ctx.Done()
+		return quicListener.Close()
+	})
+
+	return tasks.Wait()
+}
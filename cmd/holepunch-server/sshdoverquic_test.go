@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/holepunchsshserver"
+	"github.com/function61/holepunch-server/pkg/quicconnadapter"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSshdOnQuic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tlsConfig, err := quicconnadapter.SelfSignedTlsConfig()
+	assert.Ok(t, err)
+
+	quicListener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	assert.Ok(t, err)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	hostKey := sshtest.NewSigner(t)
+	serverConfig.AddHostKey(hostKey)
+
+	serverStopped := make(chan error, 1)
+	go func() {
+		serverStopped <- serveSshdOnQuicListener(ctx, quicListener, serverConfig, holepunchsshserver.Options{}, logex.Discard)
+	}()
+
+	quicConn, err := quic.DialAddr(ctx, quicListener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true, // SSH host key authenticates the server
+		NextProtos:         []string{quicconnadapter.NextProto},
+	}, nil)
+	assert.Ok(t, err)
+	defer quicConn.CloseWithError(0, "")
+
+	clientKey := sshtest.NewSigner(t)
+
+	// each stream is its own SSH connection
+	for i := 0; i < 2; i++ {
+		stream, err := quicConn.OpenStreamSync(ctx)
+		assert.Ok(t, err)
+
+		sshConn, _, _, err := ssh.NewClientConn(quicconnadapter.New(quicConn, stream), "quic", &ssh.ClientConfig{
+			User:            "hp",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		})
+		assert.Ok(t, err)
+		assert.EqualString(t, string(sshConn.ServerVersion()[:8]), "SSH-2.0-")
+		sshConn.Close()
+	}
+
+	cancel()
+	assert.Ok(t, <-serverStopped)
+}
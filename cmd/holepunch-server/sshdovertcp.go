@@ -15,6 +15,7 @@ func serveSshdOnTCP(
 	ctx context.Context,
 	addr string,
 	conf *ssh.ServerConfig,
+	options holepunchsshserver.Options,
 	logger *log.Logger,
 ) error {
 	tcpListener, err := net.Listen("tcp", addr)
@@ -38,7 +39,7 @@ func serveSshdOnTCP(
 				}
 			}
 
-			go holepunchsshserver.ServeConn(tcpConn, conf, logger)
+			go holepunchsshserver.ServeConn(tcpConn, conf, options, logger)
 		}
 	})
 
@@ -17,7 +17,7 @@ var websocketUpgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func RegisterSshdOverWebsocket(mux *http.ServeMux, conf *ssh.ServerConfig, logger *log.Logger) {
+func RegisterSshdOverWebsocket(mux *http.ServeMux, conf *ssh.ServerConfig, options holepunchsshserver.Options, logger *log.Logger) {
 	logl := logex.Levels(logger)
 
 	sshdLogger := logex.Prefix("sshd", logger)
@@ -32,6 +32,6 @@ func RegisterSshdOverWebsocket(mux *http.ServeMux, conf *ssh.ServerConfig, logge
 
 		logl.Info.Println("handoff to holepunchsshserver")
 
-		holepunchsshserver.ServeConn(wsconnadapter.New(wsConn), conf, sshdLogger)
+		holepunchsshserver.ServeConn(wsconnadapter.New(wsConn), conf, options, sshdLogger)
 	})
 }
@@ -1,12 +1,23 @@
 module github.com/function61/holepunch-server
 
-go 1.13
+go 1.23.0
 
 require (
 	github.com/function61/gokit v0.0.0-20210207144405-1f1e50ad6dcc
 	github.com/gorilla/websocket v1.4.0
-	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/quic-go/quic-go v0.54.0
 	github.com/spf13/cobra v0.0.3
+	golang.org/x/crypto v0.35.0
+	golang.org/x/time v0.3.0
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.3 // indirect
-	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
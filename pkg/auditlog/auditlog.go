@@ -0,0 +1,84 @@
+// append-only log of security-relevant events (authentications, forward grants & refusals etc.)
+// with a stable schema: one JSON object per line. field names and event types are an API -
+// only add, don't change.
+package auditlog
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+// event types
+const (
+	AuthSuccess             = "auth_success"
+	AuthFailure             = "auth_failure"
+	HandshakeFailure        = "handshake_failure"
+	Disconnect              = "disconnect"
+	ReverseForwardGranted   = "reverse_forward_granted"
+	ReverseForwardRefused   = "reverse_forward_refused"
+	ReverseForwardCancelled = "reverse_forward_cancelled"
+	DirectForwardDial       = "direct_forward_dial"
+	DirectForwardRefused    = "direct_forward_refused"
+)
+
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	User       string    `json:"user,omitempty"`     // SSH username
+	Identity   string    `json:"identity,omitempty"` // see sshidentity
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Method     string    `json:"method,omitempty"`   // auth method ("publickey" | "password" | "keyboard-interactive")
+	Key        string    `json:"key,omitempty"`      // SHA256 fingerprint of client's key
+	Protocol   string    `json:"protocol,omitempty"` // "tcp" | "udp" for forwards
+	Target     string    `json:"target,omitempty"`   // forward's listen address or dial destination
+	Reason     string    `json:"reason,omitempty"`   // for failures & refusals
+}
+
+// where events get written
+type Sink interface {
+	Write(line []byte) error
+}
+
+var (
+	sink        Sink // nil = audit log disabled
+	sinkLogl    = logex.Levels(logex.Discard)
+	sinkMu      sync.Mutex
+	currentTime = time.Now
+)
+
+// logger is used for reporting problems writing to sink
+func SetSink(s Sink, logger *log.Logger) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	sink = s
+	sinkLogl = logex.Levels(logger)
+}
+
+// Time is filled if not set
+func Record(event Event) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	if sink == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = currentTime().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil { // should not happen
+		sinkLogl.Error.Printf("Record: %s", err.Error())
+		return
+	}
+
+	if err := sink.Write(append(line, '\n')); err != nil {
+		sinkLogl.Error.Printf("Record: %s", err.Error())
+	}
+}
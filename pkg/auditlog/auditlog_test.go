@@ -0,0 +1,58 @@
+package auditlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestRecordToRotatedFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "auditlog")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "audit.log")
+
+	fileSink, err := NewFileSink(path, 200, 2)
+	assert.Ok(t, err)
+	defer fileSink.Close()
+
+	SetSink(fileSink, logex.Discard)
+	defer SetSink(nil, logex.Discard)
+
+	currentTime = func() time.Time { return time.Date(2021, 2, 8, 12, 0, 0, 0, time.UTC) }
+	defer func() { currentTime = time.Now }()
+
+	for _, reason := range []string{"first", "second", "third", "fourth"} {
+		Record(Event{
+			Type:       AuthFailure,
+			User:       "hp",
+			RemoteAddr: "192.168.1.2:4321",
+			Reason:     reason,
+		})
+	}
+
+	// each line is ~110 bytes so only one fits in a file
+	assertFileContent := func(path string, expected string) {
+		t.Helper()
+
+		content, err := ioutil.ReadFile(path)
+		assert.Ok(t, err)
+		assert.EqualString(t, string(content), expected)
+	}
+
+	assertFileContent(path, `{"time":"2021-02-08T12:00:00Z","type":"auth_failure","user":"hp","remote_addr":"192.168.1.2:4321","reason":"fourth"}
+`)
+	assertFileContent(path+".1", `{"time":"2021-02-08T12:00:00Z","type":"auth_failure","user":"hp","remote_addr":"192.168.1.2:4321","reason":"third"}
+`)
+	assertFileContent(path+".2", `{"time":"2021-02-08T12:00:00Z","type":"auth_failure","user":"hp","remote_addr":"192.168.1.2:4321","reason":"second"}
+`)
+
+	_, err = os.Stat(path + ".3")
+	assert.Assert(t, os.IsNotExist(err))
+}
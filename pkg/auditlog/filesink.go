@@ -0,0 +1,92 @@
+package auditlog
+
+import (
+	"fmt"
+	"os"
+)
+
+// appends to a file, rotating it when it grows past maxBytes:
+// audit.log => audit.log.1 => audit.log.2 ... (keeping at most keep rotated files)
+type FileSink struct {
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(path string, maxBytes int64, keep int) (*FileSink, error) {
+	f := &FileSink{
+		path:     path,
+		maxBytes: maxBytes,
+		keep:     keep,
+	}
+
+	return f, f.open()
+}
+
+// not concurrency safe, but Record() serializes the writes
+func (f *FileSink) Write(line []byte) error {
+	if f.size+int64(len(line)) > f.maxBytes && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *FileSink) Close() error {
+	return f.file.Close()
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = stat.Size()
+
+	return nil
+}
+
+func (f *FileSink) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	// drop oldest, shift the rest by one
+	if err := os.Remove(rotatedName(f.path, f.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := f.keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedName(f.path, i), rotatedName(f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if f.keep > 0 {
+		if err := os.Rename(f.path, rotatedName(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
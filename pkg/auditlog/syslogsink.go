@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package auditlog
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// writes to local syslog with "auth" facility
+func NewSyslogSink(tag string) (Sink, error) {
+	writer, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	_, err := s.writer.Write(line)
+	return err
+}
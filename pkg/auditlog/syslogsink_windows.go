@@ -0,0 +1,9 @@
+package auditlog
+
+import (
+	"errors"
+)
+
+func NewSyslogSink(tag string) (Sink, error) {
+	return nil, errors.New("syslog not supported on Windows")
+}
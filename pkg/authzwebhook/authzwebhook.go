@@ -0,0 +1,274 @@
+// asks an external HTTP service (e.g. device inventory) whether to let clients in and whether
+// to grant their forwards, so authorization can live outside of holepunch-server
+package authzwebhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"golang.org/x/crypto/ssh"
+)
+
+// the webhook is called like:
+//
+//	POST <url>
+//	{"action": "publickey", "user": "hp", "identity": "camera", "key": "SHA256:...", ...}
+//
+// and answers 200 with {"allow": true, "reason": "...", "identity": "...", "options": [...]}.
+// any other status (or not answering) is an error, which is handled as per FailOpen.
+type Config struct {
+	Url             string `json:"url"`
+	BearerToken     string `json:"bearer_token"`      // optional, so the endpoint can trust us
+	CacheTtlSeconds int    `json:"cache_ttl_seconds"` // 0 = 60 s, negative = don't cache
+	// if the webhook errors, fall back to our own decision instead of refusing
+	FailOpen bool `json:"fail_open"`
+}
+
+const (
+	ActionPublicKey    = "publickey"
+	ActionTcpipForward = "tcpip-forward"
+	ActionUdpForward   = "udp-forward"
+	ActionDirectTcpip  = "direct-tcpip"
+)
+
+type Request struct {
+	Action     string `json:"action"`
+	User       string `json:"user"`
+	Identity   string `json:"identity,omitempty"` // our idea of the identity. empty if we don't know the key
+	RemoteAddr string `json:"remote_addr"`
+	// for ActionPublicKey
+	Key               string `json:"key,omitempty"`         // SHA256 fingerprint (of the signing key, for certs)
+	CertKeyId         string `json:"cert_key_id,omitempty"` // if client used a certificate
+	LocallyAuthorized bool   `json:"locally_authorized"`    // whether our own checks accepted the key
+	// for forwards. listen address for reverse forwards, destination for "direct-tcpip"
+	Host string `json:"host,omitempty"`
+	Port uint32 `json:"port,omitempty"`
+}
+
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"` // optional, shows up in logs & audit log
+	// for ActionPublicKey (both optional): overrides identity. options are authorized_keys
+	// -style, e.g. "permitlisten=\"8080\"", and are applied on top of the key's own options
+	Identity string   `json:"identity"`
+	Options  []string `json:"options"`
+}
+
+type cachedDecision struct {
+	decision Decision
+	expires  time.Time
+}
+
+type Webhook struct {
+	conf       Config
+	cacheTtl   time.Duration
+	cache      map[string]cachedDecision
+	cacheMu    sync.Mutex
+	httpClient *http.Client
+	logl       *logex.Leveled
+}
+
+func New(conf Config, logger *log.Logger) (*Webhook, error) {
+	if conf.Url == "" {
+		return nil, errors.New("authorization webhook: url required")
+	}
+
+	cacheTtl := 60 * time.Second
+	if conf.CacheTtlSeconds != 0 {
+		cacheTtl = time.Duration(conf.CacheTtlSeconds) * time.Second
+	}
+
+	return &Webhook{
+		conf:       conf,
+		cacheTtl:   cacheTtl,
+		cache:      map[string]cachedDecision{},
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		logl:       logex.Levels(logger),
+	}, nil
+}
+
+// for holepunchsshserver.AuthOptions. permissions & err are from our own checks.
+func (w *Webhook) AuthorizeKey(
+	metadata ssh.ConnMetadata,
+	key ssh.PublicKey,
+	permissions *ssh.Permissions,
+	err error,
+) (*ssh.Permissions, error) {
+	req := Request{
+		Action:            ActionPublicKey,
+		User:              metadata.User(),
+		Identity:          sshidentity.FromPermissions(permissions),
+		RemoteAddr:        metadata.RemoteAddr().String(),
+		Key:               ssh.FingerprintSHA256(key),
+		LocallyAuthorized: err == nil,
+	}
+
+	if cert, isCert := key.(*ssh.Certificate); isCert {
+		req.Key = ssh.FingerprintSHA256(cert.Key)
+		req.CertKeyId = cert.KeyId
+	}
+
+	decision, webhookErr := w.Decide(context.Background(), req)
+	if webhookErr != nil {
+		if w.conf.FailOpen {
+			w.logl.Error.Printf("%v (failing open)", webhookErr)
+			return permissions, err
+		}
+
+		return nil, webhookErr
+	}
+
+	if !decision.Allow {
+		return nil, refusal(decision)
+	}
+
+	if permissions == nil { // key unknown to us, but webhook vouches for it
+		permissions = sshidentity.Permissions(metadata.User())
+	}
+
+	if decision.Identity != "" {
+		sshidentity.SetIdentity(permissions, decision.Identity)
+	}
+
+	sshidentity.ApplyKeyOptions(permissions, decision.Options)
+
+	return permissions, nil
+}
+
+// for sshserverportforward.AddForwardAuthorizer()
+func (w *Webhook) AuthorizeForward(fwd sshserverportforward.ForwardRequest) error {
+	decision, err := w.Decide(context.Background(), Request{
+		Action:     fwd.Kind,
+		User:       fwd.Conn.User(),
+		Identity:   sshidentity.Name(fwd.Conn), // like in "publickey" requests, user is separate
+		RemoteAddr: fwd.Conn.RemoteAddr().String(),
+		Host:       fwd.Addr,
+		Port:       fwd.Port,
+	})
+	if err != nil {
+		if w.conf.FailOpen {
+			w.logl.Error.Printf("%v (failing open)", err)
+			return nil
+		}
+
+		return err
+	}
+
+	if !decision.Allow {
+		return refusal(decision)
+	}
+
+	return nil
+}
+
+// asks the webhook, or answers from cache. errors aren't cached.
+func (w *Webhook) Decide(ctx context.Context, req Request) (*Decision, error) {
+	cacheKey := req.cacheKey()
+
+	now := time.Now()
+
+	w.cacheMu.Lock()
+	cached, found := w.cache[cacheKey]
+	w.cacheMu.Unlock()
+
+	if found && now.Before(cached.expires) {
+		return &cached.decision, nil
+	}
+
+	decision, err := w.call(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("authorization webhook: %w", err)
+	}
+
+	if w.cacheTtl > 0 {
+		w.cacheMu.Lock()
+		defer w.cacheMu.Unlock()
+
+		if len(w.cache) >= 10000 { // don't let it grow unbounded
+			for key, entry := range w.cache {
+				if !now.Before(entry.expires) {
+					delete(w.cache, key)
+				}
+			}
+		}
+
+		w.cache[cacheKey] = cachedDecision{*decision, now.Add(w.cacheTtl)}
+	}
+
+	return decision, nil
+}
+
+func (w *Webhook) call(ctx context.Context, req Request) (*Decision, error) {
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.conf.Url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	if w.conf.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+w.conf.BearerToken)
+	}
+
+	resp, err := w.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	decision := &Decision{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, fmt.Errorf("bad response: %w", err)
+	}
+
+	return decision, nil
+}
+
+// the remote port changes on each connection, so leave it out to make the cache useful
+func (r Request) cacheKey() string {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+
+	return strings.Join([]string{
+		r.Action,
+		r.User,
+		r.Identity,
+		remoteHost,
+		r.Key,
+		r.CertKeyId,
+		strconv.FormatBool(r.LocallyAuthorized),
+		r.Host,
+		strconv.Itoa(int(r.Port)),
+	}, "\x00")
+}
+
+func refusal(decision *Decision) error {
+	if decision.Reason != "" {
+		return fmt.Errorf("denied by authorization webhook: %s", decision.Reason)
+	}
+
+	return errors.New("denied by authorization webhook")
+}
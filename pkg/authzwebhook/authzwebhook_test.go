@@ -0,0 +1,173 @@
+package authzwebhook
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizeKey(t *testing.T) {
+	knownKey := newPublicKey(t)
+	inventoryKey := newPublicKey(t)
+	revokedKey := newPublicKey(t)
+
+	calls := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		assert.EqualString(t, r.Header.Get("Authorization"), "Bearer sekrit")
+
+		req := Request{}
+		assert.Ok(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.EqualString(t, req.Action, ActionPublicKey)
+		assert.EqualString(t, req.User, "hp")
+
+		switch req.Key {
+		case ssh.FingerprintSHA256(knownKey):
+			assert.Assert(t, req.LocallyAuthorized)
+			assert.EqualString(t, req.Identity, "camera")
+			_ = json.NewEncoder(w).Encode(Decision{Allow: true})
+		case ssh.FingerprintSHA256(inventoryKey):
+			assert.Assert(t, !req.LocallyAuthorized)
+			_ = json.NewEncoder(w).Encode(Decision{
+				Allow:    true,
+				Identity: "doorbell",
+				Options:  []string{`permitlisten="8080"`},
+			})
+		case ssh.FingerprintSHA256(revokedKey):
+			_ = json.NewEncoder(w).Encode(Decision{Allow: false, Reason: "device stolen"})
+		default:
+			http.Error(w, "database down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := New(Config{Url: server.URL, BearerToken: "sekrit"}, discardLogger)
+	assert.Ok(t, err)
+
+	notAuthorized := errors.New("client pubkey not authorized")
+
+	permissions, err := webhook.AuthorizeKey(metadata, knownKey, sshidentity.Permissions("camera"), nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "camera")
+
+	permissions, err = webhook.AuthorizeKey(metadata, inventoryKey, nil, notAuthorized)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "doorbell")
+	assert.Assert(t, permissions.Extensions["holepunch-permit-listen"] == "8080")
+
+	_, err = webhook.AuthorizeKey(metadata, revokedKey, sshidentity.Permissions("laptop"), nil)
+	assert.EqualString(t, err.Error(), "denied by authorization webhook: device stolen")
+
+	// answered from cache
+	_, err = webhook.AuthorizeKey(metadata, knownKey, sshidentity.Permissions("camera"), nil)
+	assert.Ok(t, err)
+	assert.Assert(t, atomic.LoadInt32(&calls) == 3)
+
+	// webhook broken => fail closed by default
+	_, err = webhook.AuthorizeKey(metadata, newPublicKey(t), sshidentity.Permissions("laptop"), nil)
+	assert.EqualString(t, err.Error(), "authorization webhook: unexpected status 503 Service Unavailable")
+
+	// errors aren't cached
+	_, err = webhook.AuthorizeKey(metadata, newPublicKey(t), sshidentity.Permissions("laptop"), nil)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, atomic.LoadInt32(&calls) == 5)
+
+	failOpen, err := New(Config{Url: server.URL, BearerToken: "sekrit", FailOpen: true}, discardLogger)
+	assert.Ok(t, err)
+
+	// webhook broken => our own decision stands, both ways
+	permissions, err = failOpen.AuthorizeKey(metadata, newPublicKey(t), sshidentity.Permissions("laptop"), nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "laptop")
+
+	_, err = failOpen.AuthorizeKey(metadata, newPublicKey(t), nil, notAuthorized)
+	assert.Assert(t, err == notAuthorized)
+
+	// explicit deny isn't overridden by fail-open
+	_, err = failOpen.AuthorizeKey(metadata, revokedKey, sshidentity.Permissions("laptop"), nil)
+	assert.EqualString(t, err.Error(), "denied by authorization webhook: device stolen")
+}
+
+func TestDecideCacheTtl(t *testing.T) {
+	calls := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		req := Request{}
+		assert.Ok(t, json.NewDecoder(r.Body).Decode(&req))
+
+		_ = json.NewEncoder(w).Encode(Decision{Allow: req.Port == 8080})
+	}))
+	defer server.Close()
+
+	decide := func(webhook *Webhook, port uint32, remoteAddr string) bool {
+		decision, err := webhook.Decide(context.Background(), Request{
+			Action:     ActionTcpipForward,
+			User:       "hp",
+			Identity:   "camera",
+			RemoteAddr: remoteAddr,
+			Host:       "localhost",
+			Port:       port,
+		})
+		assert.Ok(t, err)
+		return decision.Allow
+	}
+
+	cached, err := New(Config{Url: server.URL}, discardLogger)
+	assert.Ok(t, err)
+
+	assert.Assert(t, decide(cached, 8080, "192.168.1.2:1000"))
+	assert.Assert(t, decide(cached, 8080, "192.168.1.2:1001")) // different source port => same entry
+	assert.Assert(t, !decide(cached, 8081, "192.168.1.2:1000"))
+	assert.Assert(t, atomic.LoadInt32(&calls) == 2)
+
+	uncached, err := New(Config{Url: server.URL, CacheTtlSeconds: -1}, discardLogger)
+	assert.Ok(t, err)
+
+	assert.Assert(t, decide(uncached, 8080, "192.168.1.2:1000"))
+	assert.Assert(t, decide(uncached, 8080, "192.168.1.2:1000"))
+	assert.Assert(t, atomic.LoadInt32(&calls) == 4)
+}
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+var metadata = &fakeConnMetadata{}
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+
+	key, err := ssh.NewPublicKey(public)
+	assert.Ok(t, err)
+
+	return key
+}
+
+type fakeConnMetadata struct{}
+
+func (f *fakeConnMetadata) User() string          { return "hp" }
+func (f *fakeConnMetadata) SessionID() []byte     { return nil }
+func (f *fakeConnMetadata) ClientVersion() []byte { return nil }
+func (f *fakeConnMetadata) ServerVersion() []byte { return nil }
+func (f *fakeConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4321}
+}
+func (f *fakeConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
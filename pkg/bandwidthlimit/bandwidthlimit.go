@@ -0,0 +1,366 @@
+// per-client (and per-forward) upload/download rate limits for forwarded connections, using
+// token buckets. plugs into sshserverportforward as a stream interceptor.
+//
+// directions are from the client's (= device's) point of view: upload is data the client sends
+// to us, download is data we send to the client.
+package bandwidthlimit
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"golang.org/x/time/rate"
+)
+
+type Limit struct {
+	UploadBytesPerSecond   int `json:"upload_bytes_per_second"`   // 0 = unlimited
+	DownloadBytesPerSecond int `json:"download_bytes_per_second"` // 0 = unlimited
+	BurstBytes             int `json:"burst_bytes"`               // 0 = one second's worth
+}
+
+type Rule struct {
+	Identity string `json:"identity"` // "*" matches all clients (each still gets their own bucket)
+	Port     uint32 `json:"port"`     // 0 = limit applies to all of client's forwards combined
+	Limit
+}
+
+// clients that have had no open streams for this long are forgotten, so we don't keep state for
+// every identity ever seen. by then their buckets have (usually) refilled & meters read zero anyway
+const evictIdleAfter = 5 * time.Minute
+
+type Limiter struct {
+	rules        []Rule
+	bucketsMu    sync.Mutex
+	buckets      map[bucketKey]*bucketPair
+	clients      map[string]*clientStreams // guarded by bucketsMu
+	lastEviction time.Time
+	throughputs  *throughputs
+	now          func() time.Time
+}
+
+func New(rules []Rule) *Limiter {
+	return &Limiter{
+		rules:       rules,
+		buckets:     map[bucketKey]*bucketPair{},
+		clients:     map[string]*clientStreams{},
+		throughputs: newThroughputs(),
+		now:         time.Now,
+	}
+}
+
+// sshserverportforward.StreamInterceptor
+func (l *Limiter) Intercept(stream sshserverportforward.StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+	// before taking buckets, so they can't be evicted while the stream is open
+	l.streamOpened(stream.Identity)
+
+	buckets := []*bucketPair{}
+	for ruleIdx, rule := range l.rules {
+		if rule.Identity != "*" && rule.Identity != stream.Identity {
+			continue
+		}
+
+		if rule.Port != 0 && rule.Port != stream.Port {
+			continue
+		}
+
+		buckets = append(buckets, l.bucketFor(bucketKey{ruleIdx, stream.Identity}, rule.Limit))
+	}
+
+	meter := l.throughputs.meterFor(stream.Identity)
+
+	return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+		return &shapedStream{
+			ReadWriteCloser: clientSide,
+			buckets:         buckets,
+			meter:           meter,
+			closed:          func() { l.streamClosed(stream.Identity) },
+		}
+	}, nil
+}
+
+// current throughput of all clients that have transferred data recently, sorted by identity
+func (l *Limiter) Throughput() []Throughput {
+	return l.throughputs.snapshot()
+}
+
+// each rule has its own buckets for each client (that all of the client's matching streams share).
+// e.g. a "*" rule and the client's own rule both apply, instead of one shadowing the other
+type bucketKey struct {
+	rule     int // index in rules
+	identity string
+}
+
+type bucketPair struct {
+	upload   *rate.Limiter // nil = unlimited
+	download *rate.Limiter
+}
+
+func (l *Limiter) bucketFor(key bucketKey, limit Limit) *bucketPair {
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	if buckets, found := l.buckets[key]; found {
+		return buckets
+	}
+
+	buckets := &bucketPair{
+		upload:   tokenBucket(limit.UploadBytesPerSecond, limit.BurstBytes),
+		download: tokenBucket(limit.DownloadBytesPerSecond, limit.BurstBytes),
+	}
+
+	l.buckets[key] = buckets
+
+	return buckets
+}
+
+type clientStreams struct {
+	open      int
+	idleSince time.Time // when open last dropped to 0
+}
+
+func (l *Limiter) streamOpened(identity string) {
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	now := l.now()
+
+	if now.Sub(l.lastEviction) >= time.Minute {
+		l.evictIdleClients(now)
+		l.lastEviction = now
+	}
+
+	client, found := l.clients[identity]
+	if !found {
+		client = &clientStreams{}
+		l.clients[identity] = client
+	}
+
+	client.open++
+}
+
+func (l *Limiter) streamClosed(identity string) {
+	l.bucketsMu.Lock()
+	defer l.bucketsMu.Unlock()
+
+	if client, found := l.clients[identity]; found {
+		client.open--
+		if client.open == 0 {
+			client.idleSince = l.now()
+		}
+	}
+}
+
+// call with bucketsMu held
+func (l *Limiter) evictIdleClients(now time.Time) {
+	evicted := map[string]bool{}
+	for identity, client := range l.clients {
+		if client.open == 0 && now.Sub(client.idleSince) >= evictIdleAfter {
+			evicted[identity] = true
+			delete(l.clients, identity)
+		}
+	}
+
+	if len(evicted) == 0 {
+		return
+	}
+
+	for key := range l.buckets {
+		if evicted[key.identity] {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.throughputs.forget(evicted)
+}
+
+func tokenBucket(bytesPerSecond int, burst int) *rate.Limiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+
+	if burst == 0 {
+		burst = bytesPerSecond
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+type shapedStream struct {
+	io.ReadWriteCloser
+	buckets   []*bucketPair
+	meter     *throughputMeter
+	closed    func()
+	closeOnce sync.Once
+}
+
+func (s *shapedStream) Close() error {
+	s.closeOnce.Do(s.closed)
+
+	return s.ReadWriteCloser.Close()
+}
+
+func (s *shapedStream) Read(p []byte) (int, error) {
+	// don't read more than we can take from the smallest bucket at once
+	for _, buckets := range s.buckets {
+		if buckets.upload != nil && len(p) > buckets.upload.Burst() {
+			p = p[:buckets.upload.Burst()]
+		}
+	}
+
+	n, err := s.ReadWriteCloser.Read(p)
+	if n > 0 {
+		for _, buckets := range s.buckets {
+			if buckets.upload != nil {
+				_ = buckets.upload.WaitN(context.Background(), n)
+			}
+		}
+
+		s.meter.upload.add(n)
+	}
+
+	return n, err
+}
+
+func (s *shapedStream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		for _, buckets := range s.buckets {
+			if buckets.download != nil && len(chunk) > buckets.download.Burst() {
+				chunk = chunk[:buckets.download.Burst()]
+			}
+		}
+
+		for _, buckets := range s.buckets {
+			if buckets.download != nil {
+				_ = buckets.download.WaitN(context.Background(), len(chunk))
+			}
+		}
+
+		n, err := s.ReadWriteCloser.Write(chunk)
+		written += n
+		s.meter.download.add(n)
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+type Throughput struct {
+	Identity               string `json:"identity"`
+	UploadBytesPerSecond   int    `json:"upload_bytes_per_second"`
+	DownloadBytesPerSecond int    `json:"download_bytes_per_second"`
+}
+
+type throughputs struct {
+	mu     sync.Mutex
+	meters map[string]*throughputMeter
+}
+
+func newThroughputs() *throughputs {
+	return &throughputs{meters: map[string]*throughputMeter{}}
+}
+
+type throughputMeter struct {
+	upload   *rateMeter
+	download *rateMeter
+}
+
+func (t *throughputs) meterFor(identity string) *throughputMeter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if meter, found := t.meters[identity]; found {
+		return meter
+	}
+
+	meter := &throughputMeter{newRateMeter(), newRateMeter()}
+	t.meters[identity] = meter
+
+	return meter
+}
+
+func (t *throughputs) forget(identities map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for identity := range identities {
+		delete(t.meters, identity)
+	}
+}
+
+func (t *throughputs) snapshot() []Throughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	snapshot := []Throughput{}
+	for identity, meter := range t.meters {
+		upload, download := meter.upload.perSecond(now), meter.download.perSecond(now)
+		if upload == 0 && download == 0 {
+			continue
+		}
+
+		snapshot = append(snapshot, Throughput{identity, upload, download})
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Identity < snapshot[j].Identity })
+
+	return snapshot
+}
+
+// bytes per second averaged over the last rateMeterWindow seconds
+const rateMeterWindow = 10
+
+type rateMeter struct {
+	mu      sync.Mutex
+	slots   [rateMeterWindow]int
+	slotSec [rateMeterWindow]int64 // which second each slot is counting
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{}
+}
+
+func (r *rateMeter) add(n int) {
+	r.addAt(time.Now(), n)
+}
+
+func (r *rateMeter) addAt(now time.Time, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sec := now.Unix()
+	slot := sec % rateMeterWindow
+
+	if r.slotSec[slot] != sec { // slot was counting an older second
+		r.slots[slot] = 0
+		r.slotSec[slot] = sec
+	}
+
+	r.slots[slot] += n
+}
+
+func (r *rateMeter) perSecond(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sum := 0
+	for i := range r.slots {
+		if now.Unix()-r.slotSec[i] < rateMeterWindow {
+			sum += r.slots[i]
+		}
+	}
+
+	return sum / rateMeterWindow
+}
@@ -0,0 +1,185 @@
+package bandwidthlimit
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+)
+
+func TestRuleMatching(t *testing.T) {
+	limiter := New([]Rule{
+		{Identity: "*", Limit: Limit{UploadBytesPerSecond: 1000}},
+		{Identity: "camera", Limit: Limit{DownloadBytesPerSecond: 2000}},
+		{Identity: "camera", Port: 8080, Limit: Limit{UploadBytesPerSecond: 500}},
+		{Identity: "doorbell", Port: 22, Limit: Limit{UploadBytesPerSecond: 100}},
+	})
+
+	bucketsOf := func(identity string, port uint32) []*bucketPair {
+		wrap, err := limiter.Intercept(sshserverportforward.StreamInfo{Identity: identity, Kind: "forwarded-tcpip", Port: port})
+		assert.Ok(t, err)
+		return wrap(&fakeStream{}).(*shapedStream).buckets
+	}
+
+	camera8080 := bucketsOf("camera", 8080)
+	assert.Assert(t, len(camera8080) == 3)
+	assert.Assert(t, camera8080[0].upload.Limit() == 1000 && camera8080[0].download == nil)
+	assert.Assert(t, camera8080[1].upload == nil && camera8080[1].download.Limit() == 2000)
+	assert.Assert(t, camera8080[2].upload.Limit() == 500)
+
+	// port rule doesn't apply, but port 0 rules are shared by all of camera's forwards
+	camera80 := bucketsOf("camera", 80)
+	assert.Assert(t, len(camera80) == 2)
+	assert.Assert(t, camera80[0] == camera8080[0] && camera80[1] == camera8080[1])
+
+	// "*" matches, but doorbell gets its own bucket
+	doorbell80 := bucketsOf("doorbell", 80)
+	assert.Assert(t, len(doorbell80) == 1)
+	assert.Assert(t, doorbell80[0] != camera8080[0])
+	assert.Assert(t, doorbell80[0].upload.Limit() == 1000)
+
+	assert.Assert(t, len(bucketsOf("doorbell", 22)) == 2)
+}
+
+func TestShaping(t *testing.T) {
+	limiter := New([]Rule{
+		{Identity: "camera", Limit: Limit{UploadBytesPerSecond: 10000, DownloadBytesPerSecond: 10000, BurstBytes: 1000}},
+	})
+
+	wrap, err := limiter.Intercept(sshserverportforward.StreamInfo{Identity: "camera", Port: 8080})
+	assert.Ok(t, err)
+
+	device := &fakeStream{toRead: bytes.NewBuffer(make([]byte, 3000))}
+	stream := wrap(device)
+
+	// burst goes right away, the rest at 10 kB/s
+	started := time.Now()
+	uploaded, err := ioutil.ReadAll(stream)
+	assert.Ok(t, err)
+	assert.Assert(t, len(uploaded) == 3000)
+	assertTookAbout(t, time.Since(started), 200*time.Millisecond)
+	assert.Assert(t, device.maxRead <= 1000) // reads no more than one burst at a time
+
+	started = time.Now()
+	n, err := stream.Write(make([]byte, 3000))
+	assert.Ok(t, err)
+	assert.Assert(t, n == 3000 && device.written.Len() == 3000)
+	assertTookAbout(t, time.Since(started), 200*time.Millisecond)
+
+	// other forwards of the same client share the bucket, so this one has to wait for it to refill
+	wrap, err = limiter.Intercept(sshserverportforward.StreamInfo{Identity: "camera", Port: 8081})
+	assert.Ok(t, err)
+
+	started = time.Now()
+	_, err = wrap(&fakeStream{}).Write(make([]byte, 1000))
+	assert.Ok(t, err)
+	assertTookAbout(t, time.Since(started), 100*time.Millisecond)
+
+	assert.EqualJson(t, limiter.Throughput(), `[
+  {
+    "identity": "camera",
+    "upload_bytes_per_second": 300,
+    "download_bytes_per_second": 400
+  }
+]`)
+}
+
+func TestIdleClientsAreEvicted(t *testing.T) {
+	limiter := New([]Rule{
+		{Identity: "*", Limit: Limit{UploadBytesPerSecond: 1000}},
+	})
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	open := func(identity string) io.ReadWriteCloser {
+		wrap, err := limiter.Intercept(sshserverportforward.StreamInfo{Identity: identity, Port: 8080})
+		assert.Ok(t, err)
+		return wrap(&fakeStream{})
+	}
+
+	tracked := func() int {
+		limiter.bucketsMu.Lock()
+		defer limiter.bucketsMu.Unlock()
+
+		assert.Assert(t, len(limiter.clients) == len(limiter.buckets))
+		assert.Assert(t, len(limiter.throughputs.meters) == len(limiter.buckets))
+		return len(limiter.buckets)
+	}
+
+	camera := open("camera")
+	doorbell := open("doorbell")
+	assert.Ok(t, doorbell.Close())
+	assert.Ok(t, doorbell.Close()) // closing twice doesn't count twice
+
+	assert.Assert(t, tracked() == 2)
+
+	// camera's stream is still open, so only doorbell goes
+	now = now.Add(evictIdleAfter)
+	_ = open("phone")
+
+	assert.Assert(t, tracked() == 2)
+	_, found := limiter.clients["doorbell"]
+	assert.Assert(t, !found)
+
+	assert.Ok(t, camera.Close())
+
+	now = now.Add(evictIdleAfter)
+	_ = open("phone")
+
+	assert.Assert(t, tracked() == 1)
+}
+
+func TestRateMeter(t *testing.T) {
+	meter := newRateMeter()
+
+	t0 := time.Unix(1000, 0)
+
+	meter.addAt(t0, 5000)
+	meter.addAt(t0.Add(1*time.Second), 3000)
+	meter.addAt(t0.Add(1500*time.Millisecond), 2000)
+
+	assert.Assert(t, meter.perSecond(t0.Add(2*time.Second)) == 1000)
+
+	// first second has fallen out of the window
+	assert.Assert(t, meter.perSecond(t0.Add(10*time.Second)) == 500)
+
+	// slot for the first second gets reused
+	meter.addAt(t0.Add(10*time.Second), 100)
+	assert.Assert(t, meter.perSecond(t0.Add(10*time.Second)) == 510)
+
+	assert.Assert(t, meter.perSecond(t0.Add(time.Minute)) == 0)
+}
+
+func assertTookAbout(t *testing.T, took time.Duration, expected time.Duration) {
+	t.Helper()
+
+	if took < expected*8/10 || took > expected*5 {
+		t.Fatalf("took %s; expected about %s", took, expected)
+	}
+}
+
+type fakeStream struct {
+	toRead  *bytes.Buffer
+	written bytes.Buffer
+	maxRead int
+}
+
+func (f *fakeStream) Read(p []byte) (int, error) {
+	if len(p) > f.maxRead {
+		f.maxRead = len(p)
+	}
+
+	if f.toRead == nil {
+		return 0, io.EOF
+	}
+
+	return f.toRead.Read(p)
+}
+
+func (f *fakeStream) Write(p []byte) (int, error) { return f.written.Write(p) }
+func (f *fakeStream) Close() error                { return nil }
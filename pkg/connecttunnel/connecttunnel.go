@@ -0,0 +1,158 @@
+// turns HTTP CONNECT requests into net.Conns, for networks whose proxies block WebSocket
+// upgrades but allow CONNECT. HTTP/1.1 CONNECT hijacks the connection. if the handler is served
+// over HTTP/2 (holepunch-server's own HTTP server doesn't do that), HTTP/2 CONNECT uses the
+// request & response bodies as the stream.
+package connecttunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotHijackable         = errors.New("connection can't be hijacked")
+	errDeadlinesNotSupported = errors.New("deadlines not supported for HTTP/2 streams")
+)
+
+// CONNECT requests for authority ("ssh.example.com:443", like in "CONNECT ssh.example.com:443
+// HTTP/1.1") are handed to serve(), everything else goes to next. serve() owns the conn and must
+// close it.
+func Handler(next http.Handler, authority string, serve func(net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || !strings.EqualFold(r.Host, authority) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ProtoMajor == 1 {
+			conn, err := hijack(w)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			serve(conn)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		conn := newStreamConn(r, w, flusher)
+		serve(conn)
+
+		// returning from the handler ends the stream, so wait until serve's done with it
+		<-conn.closed
+	})
+}
+
+func hijack(w http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errNotHijackable
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// client may have sent data right after its request, which is now in bufrw's buffer
+	if bufrw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: bufrw.Reader}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// HTTP/2 stream as a net.Conn. deadlines aren't supported
+type streamConn struct {
+	body       io.ReadCloser
+	w          io.Writer
+	flusher    http.Flusher
+	remoteAddr net.Addr
+	writeMu    sync.Mutex
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func newStreamConn(r *http.Request, w http.ResponseWriter, flusher http.Flusher) *streamConn {
+	return &streamConn{
+		body:       r.Body,
+		w:          w,
+		flusher:    flusher,
+		remoteAddr: stringAddr(r.RemoteAddr),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (s *streamConn) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *streamConn) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	select {
+	case <-s.closed: // ResponseWriter must not be used after the handler returns
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	s.flusher.Flush()
+
+	return n, nil
+}
+
+func (s *streamConn) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeMu.Lock()
+		close(s.closed)
+		s.writeMu.Unlock()
+	})
+
+	return s.body.Close()
+}
+
+func (s *streamConn) LocalAddr() net.Addr                { return stringAddr("") }
+func (s *streamConn) RemoteAddr() net.Addr               { return s.remoteAddr }
+func (s *streamConn) SetDeadline(t time.Time) error      { return errDeadlinesNotSupported }
+func (s *streamConn) SetReadDeadline(t time.Time) error  { return errDeadlinesNotSupported }
+func (s *streamConn) SetWriteDeadline(t time.Time) error { return errDeadlinesNotSupported }
+
+type stringAddr string
+
+func (s stringAddr) Network() string { return "tcp" }
+func (s stringAddr) String() string  { return string(s) }
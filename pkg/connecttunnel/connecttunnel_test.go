@@ -0,0 +1,82 @@
+package connecttunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+// answers one line, upper-cased
+func upperEcho(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	_, _ = conn.Write([]byte(strings.ToUpper(line)))
+}
+
+func TestHttp1(t *testing.T) {
+	server := httptest.NewServer(Handler(http.NotFoundHandler(), "ssh.example.com:443", upperEcho))
+	defer server.Close()
+
+	connect := func(authority string) string {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		assert.Ok(t, err)
+		defer conn.Close()
+
+		// data right after the request, before the response
+		_, err = conn.Write([]byte("CONNECT " + authority + " HTTP/1.1\r\nHost: " + authority + "\r\n\r\nhello\n"))
+		assert.Ok(t, err)
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		assert.Ok(t, err)
+		if resp.StatusCode != http.StatusOK {
+			return resp.Status
+		}
+
+		line, err := reader.ReadString('\n')
+		assert.Ok(t, err)
+		return line
+	}
+
+	assert.EqualString(t, connect("ssh.example.com:443"), "HELLO\n")
+	assert.EqualString(t, connect("intranet.example.com:443"), "404 Not Found")
+}
+
+func TestHttp2(t *testing.T) {
+	server := httptest.NewUnstartedServer(Handler(http.NotFoundHandler(), "ssh.example.com:443", upperEcho))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	bodyReader, bodyWriter := io.Pipe()
+	resp, err := server.Client().Do(&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: "ssh.example.com:443"},
+		Host:   "ssh.example.com:443",
+		Header: http.Header{},
+		Body:   bodyReader,
+	})
+	assert.Ok(t, err)
+	defer resp.Body.Close()
+	assert.Assert(t, resp.ProtoMajor == 2)
+	assert.Assert(t, resp.StatusCode == http.StatusOK)
+
+	_, err = bodyWriter.Write([]byte("hello\n"))
+	assert.Ok(t, err)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.Ok(t, err)
+	assert.EqualString(t, line, "HELLO\n")
+}
@@ -0,0 +1,57 @@
+package holepunchsshserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// authorized_keys file that we re-read when it changes (checked on each auth attempt)
+type authorizedKeysFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	cached  []authorizedKey
+}
+
+func newAuthorizedKeysFile(path string) *authorizedKeysFile {
+	return &authorizedKeysFile{path: path}
+}
+
+// non-existing file has no keys, so the server can be started before adding any clients
+func (a *authorizedKeysFile) keys() ([]authorizedKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	info, err := os.Stat(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return a.cached, nil
+	}
+
+	content, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseAuthorizedKeys(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.path, err)
+	}
+
+	a.cached = keys
+	a.modTime = info.ModTime()
+	a.size = info.Size()
+
+	return keys, nil
+}
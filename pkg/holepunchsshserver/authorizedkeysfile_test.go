@@ -0,0 +1,55 @@
+package holepunchsshserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "authorizedkeys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "authorized_keys")
+
+	deviceKey := newSigner(t)
+	deviceKeyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(deviceKey.PublicKey())))
+
+	authorize := keyAuthorizer(map[string]*userKeys{"hp": {keysFile: newAuthorizedKeysFile(path)}}, nil, nil)
+
+	_, err = authorize(&fakeConnMetadata{"hp"}, deviceKey.PublicKey())
+	assert.EqualString(t, err.Error(), "client pubkey not authorized")
+
+	assert.Ok(t, ioutil.WriteFile(path, []byte(`permitlisten="8080",permitlisten="localhost:9000" `+deviceKeyLine+" camera\n"), 0600))
+
+	permissions, err := authorize(&fakeConnMetadata{"hp"}, deviceKey.PublicKey())
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "camera")
+	conn := &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "0.0.0.0", 8080))
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "localhost", 9000))
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "localhost", 9001))
+	assert.Assert(t, sshidentity.DirectForwardsPermitted(conn))
+
+	// size changes, so this is noticed even if mtime resolution is coarse
+	assert.Ok(t, ioutil.WriteFile(path, []byte("restrict "+deviceKeyLine+" doorbell\n"), 0600))
+
+	permissions, err = authorize(&fakeConnMetadata{"hp"}, deviceKey.PublicKey())
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "doorbell")
+	conn = &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "0.0.0.0", 8080))
+	assert.Assert(t, !sshidentity.DirectForwardsPermitted(conn))
+
+	assert.Ok(t, ioutil.WriteFile(path, []byte("# all revoked\n"), 0600))
+
+	_, err = authorize(&fakeConnMetadata{"hp"}, deviceKey.PublicKey())
+	assert.EqualString(t, err.Error(), "client pubkey not authorized")
+}
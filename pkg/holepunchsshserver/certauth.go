@@ -0,0 +1,98 @@
+package holepunchsshserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH user certificates signed by a trusted user CA, so you don't have to list each
+// device's pubkey. sign one with:
+//
+//	$ ssh-keygen -s user_ca -I mydevice -n hp -O extension:permit-listen@function61.com=8080 device_key.pub
+//
+// principals must include the SSH username (like with OpenSSH, a cert without principals is not
+// accepted) and the validity window is checked. "source-address" critical option is enforced,
+// other critical options are not supported and thus such certs are refused.
+//
+// without the (standard) "permit-port-forwarding" extension the client can't forward at all.
+// "permit-listen@function61.com" extension restricts reverse forwards like OpenSSH's
+// permitlisten (comma separated "port" or "host:port").
+//
+// identity of the client is the cert's key ID, or if that's empty the first principal that's
+// not the username.
+const (
+	certExtensionPermitPortForwarding = "permit-port-forwarding"
+	certExtensionPermitListen         = "permit-listen@function61.com"
+)
+
+func userCertChecker(userCAs []authorizedKey) *ssh.CertChecker {
+	return &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, userCA := range userCAs {
+				if publicKeysEqual(auth, userCA.key) {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+}
+
+func authorizeCert(metadata ssh.ConnMetadata, cert *ssh.Certificate, checker *ssh.CertChecker) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+
+	if err := checker.CheckCert(metadata.User(), cert); err != nil {
+		return nil, err
+	}
+
+	permissions := sshidentity.Permissions(certIdentity(cert, metadata.User()))
+	// x/crypto/ssh enforces "source-address" after we return
+	permissions.CriticalOptions = cert.CriticalOptions
+
+	if _, permitted := cert.Extensions[certExtensionPermitPortForwarding]; !permitted {
+		sshidentity.RestrictListen(permissions, nil)
+		sshidentity.DenyDirectForwards(permissions)
+	} else if permitListen, restricted := cert.Extensions[certExtensionPermitListen]; restricted {
+		sshidentity.RestrictListen(permissions, strings.Split(permitListen, ","))
+	}
+
+	return permissions, nil
+}
+
+func certIdentity(cert *ssh.Certificate, user string) string {
+	if cert.KeyId != "" {
+		return cert.KeyId
+	}
+
+	for _, principal := range cert.ValidPrincipals {
+		if principal != user {
+			return principal
+		}
+	}
+
+	return user
+}
+
+// for certs we're more interested in the key ID & serial than the cert blob's hash
+func keyFingerprint(key ssh.PublicKey) string {
+	if cert, isCert := key.(*ssh.Certificate); isCert {
+		return fmt.Sprintf("%s (cert %q serial %d)", ssh.FingerprintSHA256(cert.Key), cert.KeyId, cert.Serial)
+	}
+
+	return ssh.FingerprintSHA256(key)
+}
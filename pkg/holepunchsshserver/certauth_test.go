@@ -0,0 +1,130 @@
+package holepunchsshserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertAuth(t *testing.T) {
+	userCA := newSigner(t)
+	untrustedCA := newSigner(t)
+	deviceKey := newSigner(t)
+
+	authorize := keyAuthorizer(map[string]*userKeys{"hp": {}}, []authorizedKey{{key: userCA.PublicKey()}}, nil)
+
+	now := uint64(time.Now().Unix())
+
+	signCert := func(ca ssh.Signer, modify func(cert *ssh.Certificate)) *ssh.Certificate {
+		t.Helper()
+
+		cert := &ssh.Certificate{
+			Key:             deviceKey.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           "mydevice",
+			ValidPrincipals: []string{"hp"},
+			ValidAfter:      now - 60,
+			ValidBefore:     now + 60,
+			Permissions: ssh.Permissions{
+				Extensions: map[string]string{"permit-port-forwarding": ""},
+			},
+		}
+		modify(cert)
+
+		assert.Ok(t, cert.SignCert(rand.Reader, ca))
+
+		return cert
+	}
+
+	authError := func(user string, cert *ssh.Certificate) string {
+		_, err := authorize(&fakeConnMetadata{user}, cert)
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+
+	// happy path
+	permissions, err := authorize(&fakeConnMetadata{"hp"}, signCert(userCA, func(*ssh.Certificate) {}))
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "mydevice")
+	conn := &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "localhost", 8080))
+	assert.Assert(t, sshidentity.DirectForwardsPermitted(conn))
+
+	// identity from principal if no key ID
+	permissions, err = authorize(&fakeConnMetadata{"hp"}, signCert(userCA, func(cert *ssh.Certificate) {
+		cert.KeyId = ""
+		cert.ValidPrincipals = []string{"hp", "otherdevice"}
+	}))
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "otherdevice")
+
+	// restricted listen
+	permissions, err = authorize(&fakeConnMetadata{"hp"}, signCert(userCA, func(cert *ssh.Certificate) {
+		cert.Extensions["permit-listen@function61.com"] = "8080,localhost:9000"
+	}))
+	assert.Ok(t, err)
+	conn = &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "0.0.0.0", 8080))
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "localhost", 9000))
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "0.0.0.0", 9000))
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "localhost", 8081))
+
+	// no port forwarding at all
+	permissions, err = authorize(&fakeConnMetadata{"hp"}, signCert(userCA, func(cert *ssh.Certificate) {
+		cert.Extensions = map[string]string{}
+	}))
+	assert.Ok(t, err)
+	conn = &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "localhost", 8080))
+	assert.Assert(t, !sshidentity.DirectForwardsPermitted(conn))
+
+	assert.EqualString(t, authError("hp", signCert(untrustedCA, func(*ssh.Certificate) {})), "certificate signed by unrecognized authority")
+	assert.EqualString(t, authError("root", signCert(userCA, func(*ssh.Certificate) {})), "unknown username")
+	assert.EqualString(t, authError("hp", signCert(userCA, func(cert *ssh.Certificate) {
+		cert.ValidPrincipals = nil
+	})), "certificate has no principals")
+	assert.EqualString(t, authError("hp", signCert(userCA, func(cert *ssh.Certificate) {
+		cert.ValidPrincipals = []string{"admin"}
+	})), `ssh: principal "hp" not in the set of valid principals for given certificate: ["admin"]`)
+	assert.EqualString(t, authError("hp", signCert(userCA, func(cert *ssh.Certificate) {
+		cert.ValidBefore = now - 1
+	})), "ssh: cert has expired")
+	assert.EqualString(t, authError("hp", signCert(userCA, func(cert *ssh.Certificate) {
+		cert.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+	})), `ssh: unsupported critical option "force-command" in certificate`)
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Ok(t, err)
+
+	return signer
+}
+
+type fakeConnMetadata struct {
+	user string
+}
+
+func (f *fakeConnMetadata) User() string          { return f.user }
+func (f *fakeConnMetadata) SessionID() []byte     { return nil }
+func (f *fakeConnMetadata) ClientVersion() []byte { return nil }
+func (f *fakeConnMetadata) ServerVersion() []byte { return nil }
+func (f *fakeConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4321}
+}
+func (f *fakeConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
@@ -0,0 +1,261 @@
+package holepunchsshserver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeysPem can contain several PEM-encoded private keys (e.g. ed25519, ECDSA and RSA) so
+// both old and new clients find an algorithm they support. RSA keys are used with
+// rsa-sha2-256/512 signatures (and ssh-rsa for ancient clients).
+//
+// there can be only one key per type, because SSH only lets the server present one per
+// algorithm. to rotate a key without a flag day, either add a key of another type first or
+// have clients trust a host CA (see AddHostCerts).
+//
+// passphrase is used for encrypted keys (can be nil if there are none).
+func ParseHostKeys(hostKeysPem []byte, passphrase []byte) ([]ssh.Signer, error) {
+	hostKeys, err := parseHostKeysPem(hostKeysPem, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return hostKeys, validateHostKeys(hostKeys)
+}
+
+// paths are files (which can contain several keys, like in ParseHostKeys()) or directories.
+// in directories all files are keys, except "*.pub" which are ignored and "*-cert.pub" which
+// are host certificates (see AddHostCerts).
+func LoadHostKeys(paths []string, passphrase []byte) ([]ssh.Signer, error) {
+	hostKeys := []ssh.Signer{}
+	hostCerts := ""
+
+	loadFile := func(path string) error {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(path, "-cert.pub") {
+			hostCerts += string(content) + "\n"
+			return nil
+		}
+
+		keysInFile, err := parseHostKeysPem(content, passphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		hostKeys = append(hostKeys, keysInFile...)
+		return nil
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			if err := loadFile(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path) // sorted by name
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			isPubKey := strings.HasSuffix(entry.Name(), ".pub") && !strings.HasSuffix(entry.Name(), "-cert.pub")
+			if entry.IsDir() || isPubKey {
+				continue
+			}
+
+			if err := loadFile(filepath.Join(path, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := validateHostKeys(hostKeys); err != nil {
+		return nil, err
+	}
+
+	return AddHostCerts(hostKeys, hostCerts)
+}
+
+// where LoadOrGenerateHostKey() keeps the key
+func StateDirHostKeyPath(stateDir string) string {
+	return filepath.Join(stateDir, "ssh_host_ed25519_key")
+}
+
+// loads ed25519 host key from stateDir, or generates (and persists) one if this is the first
+// start. generated tells whether the key is new, so you can tell the user its fingerprint.
+func LoadOrGenerateHostKey(stateDir string) (hostKey ssh.Signer, generated bool, err error) {
+	path := StateDirHostKeyPath(stateDir)
+
+	hostKeys, err := LoadHostKeys([]string{path}, nil)
+	if err == nil {
+		return hostKeys[0], false, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// x/crypto/ssh can't write OpenSSH's own format, but reads PKCS #8 fine (as does OpenSSH)
+	privateKeyPkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, false, err
+	}
+
+	privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyPkcs8})
+
+	// O_EXCL so we never overwrite a key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(privateKeyPem); err != nil {
+		return nil, false, err
+	}
+
+	hostKey, err = ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return hostKey, true, file.Close()
+}
+
+func parseHostKeysPem(hostKeysPem []byte, passphrase []byte) ([]ssh.Signer, error) {
+	hostKeys := []ssh.Signer{}
+
+	rest := hostKeysPem
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		hostKey, err := parsePrivateKey(pem.EncodeToMemory(block), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("host key #%d: %w", len(hostKeys)+1, err)
+		}
+
+		hostKeys = append(hostKeys, hostKey)
+	}
+
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("host keys: trailing garbage after PEM blocks")
+	}
+
+	return hostKeys, nil
+}
+
+func parsePrivateKey(privateKeyPem []byte, passphrase []byte) (ssh.Signer, error) {
+	hostKey, err := ssh.ParsePrivateKey(privateKeyPem)
+	if _, isEncrypted := err.(*ssh.PassphraseMissingError); isEncrypted {
+		if passphrase == nil {
+			return nil, errors.New("key is encrypted but no passphrase given")
+		}
+
+		return ssh.ParsePrivateKeyWithPassphrase(privateKeyPem, passphrase)
+	}
+
+	return hostKey, err
+}
+
+func validateHostKeys(hostKeys []ssh.Signer) error {
+	if len(hostKeys) == 0 {
+		return errors.New("no host keys")
+	}
+
+	for i, hostKey := range hostKeys {
+		for _, other := range hostKeys[:i] {
+			if other.PublicKey().Type() == hostKey.PublicKey().Type() {
+				return fmt.Errorf("multiple host keys of type %s", hostKey.PublicKey().Type())
+			}
+		}
+	}
+
+	return nil
+}
+
+// hostCerts are OpenSSH host certificates, one per line (like "*-cert.pub" files from
+// "$ ssh-keygen -s host_ca -h ..."). each must be for one of the host keys. the certificate is
+// presented in addition to the plain key, so clients that pin the key keep working while
+// clients that trust the host CA ("@cert-authority" in known_hosts) can skip pinning.
+func AddHostCerts(hostKeys []ssh.Signer, hostCerts string) ([]ssh.Signer, error) {
+	withCerts := append([]ssh.Signer{}, hostKeys...)
+
+	rest := []byte(hostCerts)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		pubKey, _, _, restAfter, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("host certs: %w", err)
+		}
+
+		rest = restAfter
+
+		cert, isCert := pubKey.(*ssh.Certificate)
+		if !isCert || cert.CertType != ssh.HostCert {
+			return nil, fmt.Errorf("host certs: not a host certificate: %s", pubKey.Type())
+		}
+
+		if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+			return nil, fmt.Errorf("host certs: certificate %q has expired", cert.KeyId)
+		}
+
+		hostKey := hostKeyFor(hostKeys, cert.Key)
+		if hostKey == nil {
+			return nil, fmt.Errorf("host certs: no host key for certificate %q", cert.KeyId)
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, hostKey)
+		if err != nil {
+			return nil, err
+		}
+
+		withCerts = append(withCerts, certSigner)
+	}
+
+	return withCerts, nil
+}
+
+func hostKeyFor(hostKeys []ssh.Signer, pubKey ssh.PublicKey) ssh.Signer {
+	for _, hostKey := range hostKeys {
+		if publicKeysEqual(hostKey.PublicKey(), pubKey) {
+			return hostKey
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package holepunchsshserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMultipleHostKeysAndHostCert(t *testing.T) {
+	hostKeysPem := &bytes.Buffer{}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+	ed25519Pkcs8, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	assert.Ok(t, err)
+	assert.Ok(t, pem.Encode(hostKeysPem, &pem.Block{Type: "PRIVATE KEY", Bytes: ed25519Pkcs8}))
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+	ecdsaDer, err := x509.MarshalECPrivateKey(ecdsaKey)
+	assert.Ok(t, err)
+	assert.Ok(t, pem.Encode(hostKeysPem, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaDer}))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+	assert.Ok(t, pem.Encode(hostKeysPem, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	hostKeys, err := ParseHostKeys(hostKeysPem.Bytes(), nil)
+	assert.Ok(t, err)
+	assert.Assert(t, len(hostKeys) == 3)
+
+	_, err = ParseHostKeys(append(hostKeysPem.Bytes(), hostKeysPem.Bytes()...), nil)
+	assert.EqualString(t, err.Error(), "multiple host keys of type ssh-ed25519")
+
+	hostCA := newSigner(t)
+
+	hostCert := &ssh.Certificate{
+		Key:             hostKeys[0].PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "holepunch",
+		ValidPrincipals: []string{"holepunch.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.Ok(t, hostCert.SignCert(rand.Reader, hostCA))
+
+	hostKeys, err = AddHostCerts(hostKeys, string(ssh.MarshalAuthorizedKey(hostCert)))
+	assert.Ok(t, err)
+
+	_, err = AddHostCerts(hostKeys[1:2], string(ssh.MarshalAuthorizedKey(hostCert)))
+	assert.EqualString(t, err.Error(), `host certs: no host key for certificate "holepunch"`)
+
+	clientKey := newSigner(t)
+
+	serverConfig, err := DefaultConfig(hostKeys, AuthOptions{
+		ClientPubKeys: string(ssh.MarshalAuthorizedKey(clientKey.PublicKey())),
+	})
+	assert.Ok(t, err)
+
+	// which host key did the client see when only accepting the given algorithm?
+	handshake := func(hostKeyAlgorithm string) string {
+		t.Helper()
+
+		// not net.Pipe(), because both ends write their version banner before reading
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Ok(t, err)
+		defer listener.Close()
+
+		go func() {
+			serverSide, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer serverSide.Close()
+
+			if conn, _, _, err := ssh.NewServerConn(serverSide, serverConfig); err == nil {
+				_ = conn.Wait()
+			}
+		}()
+
+		clientSide, err := net.Dial("tcp", listener.Addr().String())
+		assert.Ok(t, err)
+		defer clientSide.Close()
+
+		seenHostKey := ""
+		hostCertChecker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+				return publicKeysEqual(auth, hostCA.PublicKey())
+			},
+			HostKeyFallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				seenHostKey = key.Type()
+				return nil
+			},
+		}
+
+		conn, _, _, err := ssh.NewClientConn(clientSide, "holepunch.example.com:22", &ssh.ClientConfig{
+			User:              "hp",
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyAlgorithms: []string{hostKeyAlgorithm},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if cert, isCert := key.(*ssh.Certificate); isCert {
+					seenHostKey = "cert " + cert.KeyId
+				}
+				return hostCertChecker.CheckHostKey(hostname, remote, key)
+			},
+			Timeout: 5 * time.Second,
+		})
+		assert.Ok(t, err)
+		conn.Close()
+
+		return seenHostKey
+	}
+
+	assert.EqualString(t, handshake(ssh.KeyAlgoED25519), "ssh-ed25519")
+	assert.EqualString(t, handshake(ssh.KeyAlgoECDSA256), "ecdsa-sha2-nistp256")
+	assert.EqualString(t, handshake(ssh.KeyAlgoRSASHA256), "ssh-rsa")
+	assert.EqualString(t, handshake(ssh.CertAlgoED25519v01), "cert holepunch")
+}
+
+func TestLoadOrGenerateHostKey(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "hostkeys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(stateDir)
+
+	generatedKey, generated, err := LoadOrGenerateHostKey(stateDir)
+	assert.Ok(t, err)
+	assert.Assert(t, generated)
+
+	loadedKey, generated, err := LoadOrGenerateHostKey(stateDir)
+	assert.Ok(t, err)
+	assert.Assert(t, !generated)
+	assert.Assert(t, publicKeysEqual(generatedKey.PublicKey(), loadedKey.PublicKey()))
+
+	// pubkeys in directory are ignored
+	assert.Ok(t, ioutil.WriteFile(
+		filepath.Join(stateDir, "ssh_host_ed25519_key.pub"),
+		ssh.MarshalAuthorizedKey(generatedKey.PublicKey()),
+		0600))
+
+	hostKeys, err := LoadHostKeys([]string{stateDir}, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, len(hostKeys) == 1)
+	assert.Assert(t, publicKeysEqual(generatedKey.PublicKey(), hostKeys[0].PublicKey()))
+}
+
+func TestEncryptedHostKey(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "hostkeys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(keyDir)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+	encryptedPem, err := ssh.MarshalPrivateKeyWithPassphrase(ed25519Key, "", []byte("hunter2"))
+	assert.Ok(t, err)
+
+	// unencrypted keys can be mixed in
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+	ecdsaDer, err := x509.MarshalECPrivateKey(ecdsaKey)
+	assert.Ok(t, err)
+
+	path := filepath.Join(keyDir, "ssh_host_keys")
+	assert.Ok(t, ioutil.WriteFile(path, append(
+		pem.EncodeToMemory(encryptedPem),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaDer})...), 0600))
+
+	_, err = LoadHostKeys([]string{path}, nil)
+	assert.EqualString(t, err.Error(), path+": host key #1: key is encrypted but no passphrase given")
+
+	_, err = LoadHostKeys([]string{path}, []byte("hunter3"))
+	assert.Assert(t, errors.Is(err, x509.IncorrectPasswordError))
+
+	hostKeys, err := LoadHostKeys([]string{path}, []byte("hunter2"))
+	assert.Ok(t, err)
+	assert.Assert(t, len(hostKeys) == 2)
+
+	ed25519Pub, err := ssh.NewPublicKey(ed25519Key.Public())
+	assert.Ok(t, err)
+	assert.Assert(t, publicKeysEqual(hostKeys[0].PublicKey(), ed25519Pub))
+	assert.EqualString(t, hostKeys[1].PublicKey().Type(), "ecdsa-sha2-nistp256")
+}
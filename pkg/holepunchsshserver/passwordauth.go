@@ -0,0 +1,54 @@
+package holepunchsshserver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/passwordauth"
+	"golang.org/x/crypto/ssh"
+)
+
+// the backend decides which usernames are valid, so HP_SSH_USERNAME doesn't apply here
+
+func passwordAuthorizer(authenticator passwordauth.Authenticator) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(metadata ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		permissions, err := authenticatePassword(authenticator, metadata, string(password))
+		if err != nil {
+			return nil, err
+		}
+
+		return withAuthMethod(permissions, "password", ""), nil
+	}
+}
+
+// some clients (and humans behind them) only offer keyboard-interactive for passwords
+func keyboardInteractiveAuthorizer(authenticator passwordauth.Authenticator) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(metadata ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		permissions, err := func() (*ssh.Permissions, error) {
+			answers, err := challenge(metadata.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(answers) != 1 {
+				return nil, errors.New("expecting one answer")
+			}
+
+			return authenticatePassword(authenticator, metadata, answers[0])
+		}()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return withAuthMethod(permissions, "keyboard-interactive", ""), nil
+	}
+}
+
+func authenticatePassword(authenticator passwordauth.Authenticator, metadata ssh.ConnMetadata, password string) (*ssh.Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	return authenticator.Authenticate(ctx, metadata.User(), password, metadata.RemoteAddr())
+}
@@ -0,0 +1,149 @@
+package holepunchsshserver
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/function61/gokit/app/dynversion"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"golang.org/x/crypto/ssh"
+)
+
+// "session" channels are normally used for shells and running commands. we never spawn
+// those, but answer "exec" requests from a small set of built-in commands so clients can
+// introspect their tunnels:
+//
+//	$ ssh hp@server list-forwards
+
+var serverStarted = time.Now()
+
+type sessionCommand struct {
+	description string
+	run         func(output io.Writer, serverConn *ssh.ServerConn) error
+}
+
+var sessionCommands = map[string]sessionCommand{
+	"list-forwards": {"list your reverse forwards", func(output io.Writer, serverConn *ssh.ServerConn) error {
+		for _, fwd := range sshserverportforward.ReverseForwardsOf(sshidentity.Of(serverConn)) {
+			if _, err := fmt.Fprintf(output, "%s %s\n", fwd.Protocol, fwd.ListenAddr()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	"whoami": {"show your identity", func(output io.Writer, serverConn *ssh.ServerConn) error {
+		_, err := fmt.Fprintf(output, "%s\n", sshidentity.Of(serverConn))
+		return err
+	}},
+	"status": {"show server status", func(output io.Writer, serverConn *ssh.ServerConn) error {
+		_, err := fmt.Fprintf(
+			output,
+			"version: %s\nuptime: %s\nyour user's clients: %d\nyour address: %s\n",
+			dynversion.Version,
+			time.Since(serverStarted).Truncate(time.Second),
+			clientsOfUser(serverConn.User()),
+			serverConn.RemoteAddr())
+		return err
+	}},
+	"ping": {"reply immediately (measure latency with $ time ssh ... ping)", func(output io.Writer, serverConn *ssh.ServerConn) error {
+		_, err := fmt.Fprintf(output, "pong %s\n", time.Now().UTC().Format(time.RFC3339Nano))
+		return err
+	}},
+}
+
+// other users' (= maybe other tenants') clients are none of the caller's business
+func clientsOfUser(user string) int {
+	count := 0
+	for _, session := range Sessions() {
+		if session.Conn.User() == user {
+			count++
+		}
+	}
+	return count
+}
+
+// like sshserverportforward.RejectChannelRequests(), but serves "session" channels
+func handleSessionChannels(newChannels <-chan ssh.NewChannel, serverConn *ssh.ServerConn, logl *logex.Leveled) {
+	for newChannel := range newChannels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.Prohibited, fmt.Sprintf("channel type prohibited: %s", newChannel.ChannelType()))
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logl.Error.Printf("session Accept(): %s", err.Error())
+			continue
+		}
+
+		go serveSession(channel, requests, serverConn, logl)
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request, serverConn *ssh.ServerConn, logl *logex.Leveled) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var execMsg struct {
+				Command string
+			}
+			if err := ssh.Unmarshal(req.Payload, &execMsg); err != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+
+			_ = req.Reply(true, nil)
+
+			command := strings.TrimSpace(execMsg.Command)
+
+			logl.Debug.Printf("%s ran %s", sshidentity.Of(serverConn), command)
+
+			exit(channel, runSessionCommand(command, channel, serverConn))
+			return
+		case "shell": // accepted only to tell the user what they can do instead
+			_ = req.Reply(true, nil)
+
+			exit(channel, writeSessionUsage(channel.Stderr(), "interactive shell not available"))
+			return
+		default: // "pty-req", "env", "subsystem" etc.
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func runSessionCommand(command string, channel ssh.Channel, serverConn *ssh.ServerConn) error {
+	cmd, found := sessionCommands[command]
+	if !found {
+		return writeSessionUsage(channel.Stderr(), fmt.Sprintf("unknown command: %s", command))
+	}
+
+	return cmd.run(channel, serverConn)
+}
+
+func writeSessionUsage(output io.Writer, problem string) error {
+	lines := []string{problem, "", "available commands:"}
+	for _, name := range []string{"list-forwards", "whoami", "status", "ping"} {
+		lines = append(lines, fmt.Sprintf("  %-14s %s", name, sessionCommands[name].description))
+	}
+
+	_, _ = fmt.Fprintln(output, strings.Join(lines, "\n"))
+
+	return fmt.Errorf("%s", problem)
+}
+
+func exit(channel ssh.Channel, err error) {
+	status := uint32(0)
+	if err != nil {
+		status = 1
+	}
+
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&struct {
+		Status uint32
+	}{status}))
+}
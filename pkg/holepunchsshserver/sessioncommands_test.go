@@ -0,0 +1,115 @@
+package holepunchsshserver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionCommands(t *testing.T) {
+	permissions := &ssh.Permissions{}
+	sshidentity.SetIdentity(permissions, "laptop")
+
+	pair := sshtest.Connect(t, "hp", permissions)
+	go ssh.DiscardRequests(pair.ServerRequests)
+	go handleSessionChannels(pair.ServerChannels, pair.Server, logex.Levels(logex.Discard))
+
+	// returns stdout, stderr and exit status
+	run := func(start func(session *ssh.Session) error) (string, string, int) {
+		t.Helper()
+
+		session, err := pair.Client.NewSession()
+		assert.Ok(t, err)
+		defer session.Close()
+
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		session.Stdout = stdout
+		session.Stderr = stderr
+
+		assert.Ok(t, start(session))
+
+		exitStatus := 0
+		if err := session.Wait(); err != nil {
+			exitErr := &ssh.ExitError{}
+			assert.Assert(t, errors.As(err, &exitErr))
+			exitStatus = exitErr.ExitStatus()
+		}
+
+		return stdout.String(), stderr.String(), exitStatus
+	}
+
+	exec := func(command string) func(*ssh.Session) error {
+		return func(session *ssh.Session) error { return session.Start(command) }
+	}
+
+	stdout, stderr, exitStatus := run(exec("whoami"))
+	assert.EqualString(t, stdout, "hp/laptop\n")
+	assert.EqualString(t, stderr, "")
+	assert.Assert(t, exitStatus == 0)
+
+	stdout, _, exitStatus = run(exec(" ping\n"))
+	assert.Assert(t, strings.HasPrefix(stdout, "pong "))
+	assert.Assert(t, exitStatus == 0)
+
+	stdout, _, exitStatus = run(exec("list-forwards"))
+	assert.EqualString(t, stdout, "")
+	assert.Assert(t, exitStatus == 0)
+
+	stdout, stderr, exitStatus = run(exec("rm -rf /"))
+	assert.EqualString(t, stdout, "")
+	assert.EqualString(t, stderr, `unknown command: rm -rf /
+
+available commands:
+  list-forwards  list your reverse forwards
+  whoami         show your identity
+  status         show server status
+  ping           reply immediately (measure latency with $ time ssh ... ping)
+`)
+	assert.Assert(t, exitStatus == 1)
+
+	_, stderr, exitStatus = run(func(session *ssh.Session) error { return session.Shell() })
+	assert.Assert(t, strings.HasPrefix(stderr, "interactive shell not available\n"))
+	assert.Assert(t, exitStatus == 1)
+
+	// pty is refused, but the session is still usable
+	stdout, _, exitStatus = run(func(session *ssh.Session) error {
+		assert.EqualString(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}).Error(), "ssh: pty-req failed")
+
+		return session.Start("whoami")
+	})
+	assert.EqualString(t, stdout, "hp/laptop\n")
+	assert.Assert(t, exitStatus == 0)
+
+	_, err := pair.Client.Dial("unix", "/var/run/docker.sock")
+	assert.EqualString(t, err.Error(), "ssh: rejected: administratively prohibited (channel type prohibited: direct-streamlocal@openssh.com)")
+}
+
+func TestStatusCountsOnlyOwnUsersClients(t *testing.T) {
+	connect := func(user string) *sshtest.Pair {
+		pair := sshtest.Connect(t, user, sshidentity.Permissions(user))
+		sessions.track(pair.Server)
+		return pair
+	}
+
+	caller := connect("status-test")
+	_ = connect("status-test")
+	_ = connect("status-test-other-tenant")
+
+	go ssh.DiscardRequests(caller.ServerRequests)
+	go handleSessionChannels(caller.ServerChannels, caller.Server, logex.Levels(logex.Discard))
+
+	session, err := caller.Client.NewSession()
+	assert.Ok(t, err)
+	defer session.Close()
+
+	stdout, err := session.Output("status")
+	assert.Ok(t, err)
+	assert.Assert(t, strings.Contains(string(stdout), "\nyour user's clients: 2\n"))
+}
@@ -0,0 +1,73 @@
+package holepunchsshserver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+// a connected (and authenticated) client
+type Session struct {
+	Conn      *ssh.ServerConn
+	Identity  string
+	Connected time.Time
+}
+
+type sessionList struct {
+	mu       sync.Mutex
+	sessions map[*ssh.ServerConn]Session
+}
+
+var sessions = &sessionList{
+	sessions: map[*ssh.ServerConn]Session{},
+}
+
+// returns currently connected clients, oldest connection first
+func Sessions() []Session {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	list := []Session{}
+	for _, session := range sessions.sessions {
+		list = append(list, session)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Connected.Before(list[j].Connected) })
+
+	return list
+}
+
+// if the same client is connected multiple times, returns the most recent connection
+func SessionByIdentity(identity string) *Session {
+	var newest *Session
+	for _, session := range Sessions() {
+		if session.Identity == identity {
+			session := session
+			newest = &session
+		}
+	}
+
+	return newest
+}
+
+// tracks the connection as a session until the connection closes
+func (s *sessionList) track(conn *ssh.ServerConn) {
+	s.mu.Lock()
+	s.sessions[conn] = Session{
+		Conn:      conn,
+		Identity:  sshidentity.Of(conn),
+		Connected: time.Now(),
+	}
+	s.mu.Unlock()
+
+	go func() {
+		_ = conn.Wait()
+
+		s.mu.Lock()
+		delete(s.sessions, conn)
+		s.mu.Unlock()
+	}()
+}
@@ -0,0 +1,80 @@
+package holepunchsshserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessions(t *testing.T) {
+	connect := func(user string, name string) *sshtest.Pair {
+		permissions := &ssh.Permissions{}
+		sshidentity.SetIdentity(permissions, name)
+
+		pair := sshtest.Connect(t, user, permissions)
+		sessions.track(pair.Server)
+		time.Sleep(time.Millisecond) // so connection times differ
+
+		return pair
+	}
+
+	laptop := connect("hp", "sessions-test-laptop")
+	phone := connect("hp", "sessions-test-phone")
+	laptopAgain := connect("hp", "sessions-test-laptop")
+	otherUsersLaptop := connect("team-b", "sessions-test-laptop") // e.g. another tenant
+
+	identities := func() []string {
+		identities := []string{}
+		for _, session := range Sessions() {
+			if strings.Contains(session.Identity, "/sessions-test-") { // other tests' sessions may linger
+				identities = append(identities, session.Identity)
+			}
+		}
+		return identities
+	}
+
+	assert.EqualJson(t, identities(), `[
+  "hp/sessions-test-laptop",
+  "hp/sessions-test-phone",
+  "hp/sessions-test-laptop",
+  "team-b/sessions-test-laptop"
+]`)
+
+	// newest wins
+	assert.Assert(t, SessionByIdentity("hp/sessions-test-laptop").Conn == laptopAgain.Server)
+	assert.Assert(t, SessionByIdentity("hp/sessions-test-phone").Conn == phone.Server)
+	assert.Assert(t, SessionByIdentity("team-b/sessions-test-laptop").Conn == otherUsersLaptop.Server)
+	assert.Assert(t, SessionByIdentity("hp/sessions-test-tablet") == nil)
+	assert.Assert(t, SessionByIdentity("sessions-test-laptop") == nil)
+
+	// session is forgotten when its connection closes
+	laptopAgain.Client.Close()
+	waitFor(t, func() bool { return len(identities()) == 3 })
+
+	assert.Assert(t, SessionByIdentity("hp/sessions-test-laptop").Conn == laptop.Server)
+
+	laptop.Client.Close()
+	waitFor(t, func() bool { return len(identities()) == 2 })
+
+	assert.Assert(t, SessionByIdentity("hp/sessions-test-laptop") == nil)
+	assert.Assert(t, SessionByIdentity("team-b/sessions-test-laptop").Conn == otherUsersLaptop.Server)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("condition not met in time")
+}
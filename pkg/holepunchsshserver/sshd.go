@@ -2,85 +2,280 @@ package holepunchsshserver
 
 import (
 	"bytes"
+	"cmp"
 	"errors"
+	"fmt"
 	"log"
 	"net"
-	"os"
+	"strings"
 
 	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/auditlog"
+	"github.com/function61/holepunch-server/pkg/passwordauth"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
 	"github.com/function61/holepunch-server/pkg/sshserverportforward"
 	"golang.org/x/crypto/ssh"
 )
 
-func ServeConn(conn net.Conn, config *ssh.ServerConfig, logger *log.Logger) {
+// optional features of the server
+type Options struct {
+	SessionCommands bool // answer "exec" requests for built-in commands like "list-forwards"
+}
+
+func ServeConn(conn net.Conn, config *ssh.ServerConfig, options Options, logger *log.Logger) {
 	logl := logex.Levels(logger)
 
 	// Before use, a handshake must be performed on the incoming net.Conn.
 	sshServerConn, newChannelRequests, requests, err := ssh.NewServerConn(conn, config)
 	if err != nil {
 		logl.Error.Printf("Failed to handshake (%s)", err)
+		auditlog.Record(auditlog.Event{
+			Type:       auditlog.HandshakeFailure,
+			RemoteAddr: conn.RemoteAddr().String(),
+			Reason:     err.Error(),
+		})
 		return
 	}
 
-	logl.Info.Printf("Authorized user %s from %s (%s)",
+	auditAuthSuccess(sshServerConn)
+
+	logl.Info.Printf("Authorized user %s (%s) from %s (%s)",
 		sshServerConn.User(),
+		sshidentity.Of(sshServerConn),
 		sshServerConn.RemoteAddr(),
 		sshServerConn.ClientVersion())
 
+	sessions.track(sshServerConn)
+
+	go func() {
+		_ = sshServerConn.Wait()
+
+		auditlog.Record(auditlog.Event{
+			Type:       auditlog.Disconnect,
+			User:       sshServerConn.User(),
+			Identity:   sshidentity.Of(sshServerConn),
+			RemoteAddr: sshServerConn.RemoteAddr().String(),
+		})
+	}()
+
 	// handle portforwarding out-of-band requests, but discard all other
 	// these are reverse forwards
 	nonForwardReqs := sshserverportforward.ProcessPortForwardRequests(requests, sshServerConn)
 	go ssh.DiscardRequests(nonForwardReqs)
 
 	// these are normal forwards ("forward forwards")
-	nonForwardChans := sshserverportforward.ProcessPortForwardNewChannelRequests(newChannelRequests)
-	go sshserverportforward.RejectChannelRequests(nonForwardChans)
+	nonForwardChans := sshserverportforward.ProcessPortForwardNewChannelRequests(newChannelRequests, sshServerConn)
+	if options.SessionCommands {
+		go handleSessionChannels(nonForwardChans, sshServerConn, logl)
+	} else {
+		go sshserverportforward.RejectChannelRequests(nonForwardChans)
+	}
 }
 
-func DefaultConfig(hostPrivateKeyBytes []byte, clientPubKey string) (*ssh.ServerConfig, error) {
-	config := &ssh.ServerConfig{
-		PublicKeyCallback: keyAuthorizer(clientPubKey),
-	}
+// how clients authenticate. you need at least one of these.
+type AuthOptions struct {
+	// keys of the default user (HP_SSH_USERNAME). in authorized_keys format, i.e. one key per
+	// line. key's comment (if any) is used as the identity (device name) of the client.
+	ClientPubKeys string
+	// file with more keys in the same format. it's re-read when it changes, so clients can be
+	// added & revoked without restarting. OpenSSH's port forwarding options (like permitlisten)
+	// are honored for keys here and in ClientPubKeys.
+	AuthorizedKeysPath string
+	// CAs (same format) whose user certificates we accept for any known user. see certauth.go
+	TrustedUserCAs string
+	// more usernames, each with own keys & policy
+	Users []User
+	// for devices that can't do keys. enables "password" and "keyboard-interactive" methods
+	Password passwordauth.Authenticator
+	// consulted on every public key auth attempt after our own checks (permissions & err are
+	// their result), and has the final say. e.g. authzwebhook.Webhook.AuthorizeKey
+	KeyAuthorization func(metadata ssh.ConnMetadata, key ssh.PublicKey, permissions *ssh.Permissions, err error) (*ssh.Permissions, error)
+}
 
-	hostPrivateKey, err := ssh.ParsePrivateKey(hostPrivateKeyBytes)
+// hostKeys are from ParseHostKeys() (and optionally AddHostCerts()).
+func DefaultConfig(hostKeys []ssh.Signer, auth AuthOptions) (*ssh.ServerConfig, error) {
+	users, err := buildUsers(auth)
 	if err != nil {
 		return nil, err
 	}
 
-	config.AddHostKey(hostPrivateKey)
+	userCAs, err := parseAuthorizedKeys(auth.TrustedUserCAs)
+	if err != nil {
+		return nil, fmt.Errorf("trusted user CAs: %w", err)
+	}
+
+	if !hasKeys(users) && len(userCAs) == 0 && auth.Password == nil && auth.KeyAuthorization == nil {
+		return nil, errors.New("no authorized client pubkeys, authorized keys file, trusted user CAs, password auth or key authorization")
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: keyAuthorizer(users, userCAs, auth.KeyAuthorization),
+		AuthLogCallback:   auditAuthFailure,
+	}
+
+	if auth.Password != nil {
+		config.PasswordCallback = passwordAuthorizer(auth.Password)
+		config.KeyboardInteractiveCallback = keyboardInteractiveAuthorizer(auth.Password)
+	}
+
+	for _, hostKey := range hostKeys {
+		config.AddHostKey(hostKey)
+	}
 
 	return config, nil
 }
 
-func keyAuthorizer(expectedClientKeyAuthorizedFormat string) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
-	return func(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-		if metadata.User() != coalesce(os.Getenv("HP_SSH_USERNAME"), "hp") {
-			return nil, errors.New("unknown username")
+type authorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+	options []string
+}
+
+// hook can be nil
+func keyAuthorizer(
+	users map[string]*userKeys,
+	userCAs []authorizedKey,
+	hook func(ssh.ConnMetadata, ssh.PublicKey, *ssh.Permissions, error) (*ssh.Permissions, error),
+) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	certChecker := userCertChecker(userCAs)
+
+	authorize := func(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		user, known := users[metadata.User()]
+		if !known {
+			return nil, ErrUnknownUsername
+		}
+
+		// certs carry their own policy, so user's options don't apply
+		if cert, isCert := key.(*ssh.Certificate); isCert {
+			return authorizeCert(metadata, cert, certChecker)
 		}
 
-		expectedClientKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(expectedClientKeyAuthorizedFormat))
+		candidates, err := user.candidates()
 		if err != nil {
 			return nil, err
 		}
 
-		if !publicKeysEqual(key, expectedClientKey) {
-			return nil, errors.New("client pubkey not authorized")
+		for _, authorizedKey := range candidates {
+			if publicKeysEqual(key, authorizedKey.key) {
+				permissions := sshidentity.Permissions(cmp.Or(authorizedKey.comment, metadata.User()))
+				sshidentity.ApplyKeyOptions(permissions, append(append([]string{}, user.options...), authorizedKey.options...))
+				return permissions, nil
+			}
+		}
+
+		return nil, ErrKeyNotAuthorized
+	}
+
+	// this is also called for keys the client only asks about (without proving it has the private
+	// key), so successes are recorded only once the handshake completes
+	return func(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		permissions, err := authorize(metadata, key)
+		if hook != nil {
+			permissions, err = hook(metadata, key, permissions, err)
+		}
+
+		if err != nil {
+			return nil, &keyAuthError{err: err, key: keyFingerprint(key)}
 		}
 
-		return nil, nil
+		return withAuthMethod(permissions, "publickey", keyFingerprint(key)), nil
 	}
 }
 
-func publicKeysEqual(key1 ssh.PublicKey, key2 ssh.PublicKey) bool {
-	return bytes.Equal(key1.Marshal(), key2.Marshal())
+// remembers the key for the failure's audit event
+type keyAuthError struct {
+	err error
+	key string
+}
+
+func (k *keyAuthError) Error() string { return k.err.Error() }
+func (k *keyAuthError) Unwrap() error { return k.err }
+
+// for the success audit event. key is empty for non-key methods
+func withAuthMethod(permissions *ssh.Permissions, method string, key string) *ssh.Permissions {
+	if permissions == nil {
+		permissions = &ssh.Permissions{}
+	}
+
+	if permissions.Extensions == nil {
+		permissions.Extensions = map[string]string{}
+	}
+
+	permissions.Extensions[extensionAuthMethod] = method
+	permissions.Extensions[extensionAuthKey] = key
+
+	return permissions
 }
 
-func coalesce(items ...string) string {
-	for _, item := range items {
-		if item != "" {
-			return item
+const (
+	extensionAuthMethod = "holepunch-auth-method"
+	extensionAuthKey    = "holepunch-auth-key"
+)
+
+// ServerConfig.AuthLogCallback. only called for requests that can complete the authentication,
+// i.e. for keys only after the signature is verified
+func auditAuthFailure(metadata ssh.ConnMetadata, method string, err error) {
+	// success is recorded after the handshake. ErrNoAuth is for the "none" method clients
+	// start with to learn the available methods
+	if err == nil || errors.Is(err, ssh.ErrNoAuth) {
+		return
+	}
+
+	countAuthFailure(err)
+
+	key := ""
+	var keyErr *keyAuthError
+	if errors.As(err, &keyErr) {
+		key = keyErr.key
+	}
+
+	auditlog.Record(auditlog.Event{
+		Type:       auditlog.AuthFailure,
+		User:       metadata.User(),
+		RemoteAddr: metadata.RemoteAddr().String(),
+		Method:     method,
+		Key:        key,
+		Reason:     err.Error(),
+	})
+}
+
+func auditAuthSuccess(conn *ssh.ServerConn) {
+	event := auditlog.Event{
+		Type:       auditlog.AuthSuccess,
+		User:       conn.User(),
+		Identity:   sshidentity.Of(conn),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	if conn.Permissions != nil {
+		event.Method = conn.Permissions.Extensions[extensionAuthMethod]
+		event.Key = conn.Permissions.Extensions[extensionAuthKey]
+	}
+
+	auditlog.Record(event)
+}
+
+func parseAuthorizedKeys(authorizedKeysSerialized string) ([]authorizedKey, error) {
+	authorizedKeys := []authorizedKey{}
+
+	// line by line, because ssh.ParseAuthorizedKey() errors on input with only comments
+	for i, line := range strings.Split(authorizedKeysSerialized, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		authorizedKeys = append(authorizedKeys, authorizedKey{key, comment, options})
 	}
 
-	return ""
+	return authorizedKeys, nil
+}
+
+func publicKeysEqual(key1 ssh.PublicKey, key2 ssh.PublicKey) bool {
+	return bytes.Equal(key1.Marshal(), key2.Marshal())
 }
@@ -0,0 +1,126 @@
+package holepunchsshserver
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/auditlog"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthAudit(t *testing.T) {
+	events := &eventCollector{}
+	auditlog.SetSink(events, logex.Discard)
+	defer auditlog.SetSink(nil, logex.Discard)
+
+	clientKey := newSigner(t)
+	unknownKey := newSigner(t)
+
+	serverConfig, err := DefaultConfig([]ssh.Signer{newSigner(t)}, AuthOptions{
+		ClientPubKeys: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(clientKey.PublicKey()))) + " laptop",
+	})
+	assert.Ok(t, err)
+
+	// returns audited auth events as "<type> <method> <key> <identity>"
+	connect := func(clientKeys ...ssh.Signer) []string {
+		t.Helper()
+
+		events.reset()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Ok(t, err)
+		defer listener.Close()
+
+		serverDone := make(chan struct{})
+		go func() {
+			defer close(serverDone)
+
+			conn, err := listener.Accept()
+			assert.Ok(t, err)
+			defer conn.Close()
+
+			ServeConn(conn, serverConfig, Options{}, logex.Discard)
+		}()
+
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		assert.Ok(t, err)
+		defer clientConn.Close()
+
+		sshConn, _, _, err := ssh.NewClientConn(clientConn, listener.Addr().String(), &ssh.ClientConfig{
+			User:            "hp",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKeys...)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			sshConn.Close()
+		}
+
+		<-serverDone // ServeConn() returns after the handshake
+
+		return events.authEvents(t)
+	}
+
+	failuresBefore := AuthFailures()
+
+	clientKeyFingerprint := ssh.FingerprintSHA256(clientKey.PublicKey())
+	unknownKeyFingerprint := ssh.FingerprintSHA256(unknownKey.PublicKey())
+
+	assert.EqualJson(t, connect(clientKey), `[
+  "auth_success publickey `+clientKeyFingerprint+` hp/laptop"
+]`)
+
+	// client asks about each key before signing with it
+	assert.EqualJson(t, connect(unknownKey), `[
+  "auth_failure publickey `+unknownKeyFingerprint+` "
+]`)
+
+	assert.EqualJson(t, connect(unknownKey, clientKey), `[
+  "auth_failure publickey `+unknownKeyFingerprint+` ",
+  "auth_success publickey `+clientKeyFingerprint+` hp/laptop"
+]`)
+
+	failures := AuthFailures()
+	assert.Assert(t, failures["key_not_authorized"]-failuresBefore["key_not_authorized"] == 2)
+}
+
+type eventCollector struct {
+	lines [][]byte
+	mu    sync.Mutex
+}
+
+func (e *eventCollector) Write(line []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lines = append(e.lines, append([]byte{}, line...))
+	return nil
+}
+
+func (e *eventCollector) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lines = nil
+}
+
+func (e *eventCollector) authEvents(t *testing.T) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	authEvents := []string{}
+	for _, line := range e.lines {
+		event := auditlog.Event{}
+		assert.Ok(t, json.Unmarshal(line, &event))
+
+		if event.Type == auditlog.AuthSuccess || event.Type == auditlog.AuthFailure {
+			authEvents = append(authEvents, event.Type+" "+event.Method+" "+event.Key+" "+event.Identity)
+		}
+	}
+
+	return authEvents
+}
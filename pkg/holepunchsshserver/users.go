@@ -0,0 +1,136 @@
+package holepunchsshserver
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/function61/holepunch-server/pkg/passwordauth"
+)
+
+var (
+	ErrUnknownUsername  = errors.New("unknown username")
+	ErrKeyNotAuthorized = errors.New("client pubkey not authorized")
+)
+
+// an SSH username with its own keys & policy, e.g. for a team or a tenant. these are in
+// addition to the default user (HP_SSH_USERNAME, default "hp"), whose keys are in AuthOptions.
+type User struct {
+	Name               string `json:"name"`
+	AuthorizedKeysPath string `json:"authorized_keys"` // re-read on changes, like AuthorizedKeysPath
+	// authorized_keys -style options that are defaults for all of the user's keys, e.g.
+	// "restrict" or "permitlisten=\"8080\"". each key's own options come after these.
+	Options []string `json:"options"`
+}
+
+type userKeys struct {
+	keys     []authorizedKey
+	keysFile *authorizedKeysFile // nil if no file
+	options  []string
+}
+
+func (u *userKeys) candidates() ([]authorizedKey, error) {
+	if u.keysFile == nil {
+		return u.keys, nil
+	}
+
+	keysFromFile, err := u.keysFile.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]authorizedKey{}, u.keys...), keysFromFile...), nil
+}
+
+func defaultUsername() string {
+	return cmp.Or(os.Getenv("HP_SSH_USERNAME"), "hp")
+}
+
+// default user + additional users, keyed by username
+func buildUsers(auth AuthOptions) (map[string]*userKeys, error) {
+	defaultUserKeys, err := parseAuthorizedKeys(auth.ClientPubKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]*userKeys{
+		defaultUsername(): {keys: defaultUserKeys},
+	}
+
+	if auth.AuthorizedKeysPath != "" {
+		users[defaultUsername()].keysFile = newAuthorizedKeysFile(auth.AuthorizedKeysPath)
+	}
+
+	for _, user := range auth.Users {
+		if user.Name == "" || user.AuthorizedKeysPath == "" {
+			return nil, errors.New("user: name and authorized_keys required")
+		}
+
+		if _, duplicate := users[user.Name]; duplicate {
+			return nil, fmt.Errorf("user %s: defined twice (default user is %s)", user.Name, defaultUsername())
+		}
+
+		users[user.Name] = &userKeys{
+			keysFile: newAuthorizedKeysFile(user.AuthorizedKeysPath),
+			options:  user.Options,
+		}
+	}
+
+	// catch syntax errors at startup
+	for name, user := range users {
+		if _, err := user.candidates(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+	}
+
+	return users, nil
+}
+
+func hasKeys(users map[string]*userKeys) bool {
+	for _, user := range users {
+		if len(user.keys) > 0 || user.keysFile != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auth failure counts by reason, so "who's knocking with a wrong username" is told apart from
+// "our client's key isn't (or no longer) authorized"
+var authFailures = struct {
+	counts map[string]uint64
+	mu     sync.Mutex
+}{counts: map[string]uint64{}}
+
+func countAuthFailure(err error) {
+	reason := "other"
+	switch {
+	case errors.Is(err, ErrUnknownUsername):
+		reason = "unknown_username"
+	case errors.Is(err, ErrKeyNotAuthorized):
+		reason = "key_not_authorized"
+	case errors.Is(err, passwordauth.ErrInvalidCredentials):
+		reason = "invalid_credentials"
+	}
+
+	authFailures.mu.Lock()
+	defer authFailures.mu.Unlock()
+
+	authFailures.counts[reason]++
+}
+
+// since start, keyed by reason ("unknown_username" | "key_not_authorized" | "invalid_credentials" | "other")
+func AuthFailures() map[string]uint64 {
+	authFailures.mu.Lock()
+	defer authFailures.mu.Unlock()
+
+	counts := map[string]uint64{}
+	for reason, count := range authFailures.counts {
+		counts[reason] = count
+	}
+
+	return counts
+}
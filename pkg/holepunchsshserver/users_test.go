@@ -0,0 +1,60 @@
+package holepunchsshserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUsers(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "users")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	defaultUserKey := newSigner(t)
+	teamKey := newSigner(t)
+
+	teamKeysPath := filepath.Join(tempDir, "team-a.keys")
+	assert.Ok(t, ioutil.WriteFile(teamKeysPath, ssh.MarshalAuthorizedKey(teamKey.PublicKey()), 0600))
+
+	users, err := buildUsers(AuthOptions{
+		ClientPubKeys: string(ssh.MarshalAuthorizedKey(defaultUserKey.PublicKey())),
+		Users: []User{
+			{Name: "team-a", AuthorizedKeysPath: teamKeysPath, Options: []string{`permitlisten="8080"`}},
+		},
+	})
+	assert.Ok(t, err)
+
+	authorize := keyAuthorizer(users, nil, nil)
+
+	permissions, err := authorize(&fakeConnMetadata{"hp"}, defaultUserKey.PublicKey())
+	assert.Ok(t, err)
+	assert.Assert(t, sshidentity.ListenPermitted(&ssh.ServerConn{Permissions: permissions}, "localhost", 9000))
+
+	permissions, err = authorize(&fakeConnMetadata{"team-a"}, teamKey.PublicKey())
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "team-a")
+	conn := &ssh.ServerConn{Permissions: permissions}
+	assert.Assert(t, sshidentity.ListenPermitted(conn, "localhost", 8080))
+	assert.Assert(t, !sshidentity.ListenPermitted(conn, "localhost", 9000))
+
+	// keys are per-user
+	_, err = authorize(&fakeConnMetadata{"team-a"}, defaultUserKey.PublicKey())
+	assert.Assert(t, errors.Is(err, ErrKeyNotAuthorized))
+	_, err = authorize(&fakeConnMetadata{"hp"}, teamKey.PublicKey())
+	assert.Assert(t, errors.Is(err, ErrKeyNotAuthorized))
+
+	_, err = authorize(&fakeConnMetadata{"team-b"}, teamKey.PublicKey())
+	assert.Assert(t, errors.Is(err, ErrUnknownUsername))
+
+	_, err = buildUsers(AuthOptions{
+		Users: []User{{Name: "hp", AuthorizedKeysPath: teamKeysPath}},
+	})
+	assert.EqualString(t, err.Error(), "user hp: defined twice (default user is hp)")
+}
@@ -0,0 +1,442 @@
+// carries a byte stream (like SSH) over plain HTTP request/response pairs, for networks that
+// strip WebSocket upgrades and CONNECT. each session is a net.Conn on our side.
+//
+// protocol (paths relative to where Server is mounted):
+//
+//	POST /                       opens a session. responds 201 with the session token as body
+//	POST /<token>?offset=<n>     upload (can be chunked). n = bytes uploaded before this one
+//	GET  /<token>?offset=<n>     long-poll download. n = bytes downloaded so far. responds 200
+//	                             with data, 204 if there was none in a while, 410 when closed
+//	                             (and all data is acknowledged)
+//	DELETE /<token>              closes the session
+//
+// offsets make retries safe: data is only discarded once the client's next request
+// acknowledges it. a client must not have several uploads (or downloads) in flight.
+//
+// sessions can be opened without authenticating (that happens inside the stream), so their
+// number is capped in total and per client IP (see SetClientIp()).
+package longpollconnadapter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pollWait         = 25 * time.Second // under common proxies' idle timeouts
+	idleTimeout      = 60 * time.Second // session is closed if client has no request in flight for this long
+	maxPollResponse  = 256 * 1024
+	maxOutboundQueue = 1024 * 1024 // writes block when client is this far behind
+
+	defaultMaxSessions          = 1024
+	defaultMaxSessionsPerRemote = 16
+)
+
+var (
+	errClosed                = errors.New("session closed")
+	errBadOffset             = errors.New("bad offset")
+	errDeadlinesNotSupported = errors.New("deadlines not supported")
+	errTooManySessions       = errors.New("too many sessions")
+)
+
+// http.Handler. serve() gets each new session and owns it
+type Server struct {
+	serve      func(net.Conn)
+	sessionsMu sync.Mutex
+	// closed sessions stay until the client has polled the rest of the data (or goes idle)
+	sessions             map[string]*Conn
+	maxSessions          int
+	maxSessionsPerRemote int
+	idleTimeout          time.Duration
+	clientIp             func(*http.Request) string
+}
+
+func NewServer(serve func(net.Conn)) *Server {
+	return &Server{
+		serve:                serve,
+		sessions:             map[string]*Conn{},
+		maxSessions:          defaultMaxSessions,
+		maxSessionsPerRemote: defaultMaxSessionsPerRemote,
+		idleTimeout:          idleTimeout,
+		clientIp: func(r *http.Request) string {
+			return hostOf(r.RemoteAddr)
+		},
+	}
+}
+
+// which client a request is from, for the per-client session cap. defaults to the peer's IP,
+// which behind a reverse proxy is the proxy's
+func (s *Server) SetClientIp(clientIp func(*http.Request) string) {
+	s.clientIp = clientIp
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(r.URL.Path, "/")
+
+	if token == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		conn, err := s.open(r.RemoteAddr, s.clientIp(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTooManySessions) {
+				status = http.StatusServiceUnavailable
+			}
+
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(conn.token))
+		return
+	}
+
+	s.sessionsMu.Lock()
+	conn := s.sessions[token]
+	s.sessionsMu.Unlock()
+
+	if conn == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+
+	// an upload can block for long if the server side doesn't read
+	conn.requestStarted()
+	defer conn.requestDone()
+
+	if r.Method == http.MethodDelete {
+		_ = conn.Close()
+		s.remove(token) // client doesn't want the rest
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "offset required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if err := conn.upload(offset, r.Body); err != nil {
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		data, err := conn.poll(offset, r.Context().Done())
+		if err != nil {
+			if errors.Is(err, errClosed) { // client has everything
+				s.remove(token)
+			}
+
+			http.Error(w, err.Error(), statusForError(err))
+			return
+		}
+
+		if len(data) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(data)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) open(remoteAddr string, clientIp string) (*Conn, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if err := s.checkSessionLimits(clientIp); err != nil {
+		return nil, err
+	}
+
+	inboundReader, inboundWriter := io.Pipe()
+
+	conn := &Conn{
+		token:         token,
+		remoteAddr:    stringAddr(remoteAddr),
+		clientIp:      clientIp,
+		idleTimeout:   s.idleTimeout,
+		inboundReader: inboundReader,
+		inboundWriter: inboundWriter,
+		changed:       make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+
+	conn.idleTimer = time.AfterFunc(s.idleTimeout, func() {
+		_ = conn.Close()
+		s.remove(token)
+	})
+
+	s.sessions[token] = conn
+
+	go s.serve(conn)
+
+	return conn, nil
+}
+
+// call with sessionsMu held
+func (s *Server) checkSessionLimits(clientIp string) error {
+	if len(s.sessions) >= s.maxSessions {
+		return errTooManySessions
+	}
+
+	sessionsOfClient := 0
+	for _, conn := range s.sessions {
+		if conn.clientIp == clientIp {
+			sessionsOfClient++
+		}
+	}
+
+	if sessionsOfClient >= s.maxSessionsPerRemote {
+		return fmt.Errorf("%w from %s", errTooManySessions, clientIp)
+	}
+
+	return nil
+}
+
+func (s *Server) remove(token string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if conn, found := s.sessions[token]; found {
+		conn.idleTimer.Stop()
+		delete(s.sessions, token)
+	}
+}
+
+// our side of a session
+type Conn struct {
+	token       string
+	remoteAddr  net.Addr
+	clientIp    string
+	idleTimer   *time.Timer
+	idleTimeout time.Duration
+	inFlight    int // requests. guarded by mu
+
+	uploadMu      sync.Mutex
+	uploaded      int64 // bytes received from client
+	inboundReader *io.PipeReader
+	inboundWriter *io.PipeWriter
+
+	mu            sync.Mutex
+	outbound      []byte // not yet acknowledged by client
+	outboundStart int64  // offset of outbound[0]
+	changed       chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.inboundReader.Read(p)
+}
+
+// queued for the client's next poll. blocks if the client falls too far behind
+func (c *Conn) Write(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.isClosed() {
+			c.mu.Unlock()
+			return 0, errClosed
+		}
+
+		if len(c.outbound) < maxOutboundQueue {
+			c.outbound = append(c.outbound, p...)
+			c.signal()
+			c.mu.Unlock()
+			return len(p), nil
+		}
+
+		changed := c.changed
+		c.mu.Unlock()
+
+		<-changed
+	}
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		c.signal()
+		c.mu.Unlock()
+
+		_ = c.inboundWriter.CloseWithError(io.EOF)
+	})
+
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return stringAddr("") }
+func (c *Conn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *Conn) SetDeadline(t time.Time) error      { return errDeadlinesNotSupported }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return errDeadlinesNotSupported }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return errDeadlinesNotSupported }
+
+// offset is what the client thinks it has uploaded before. if an earlier upload partially
+// failed from the client's view but we got (some of) it, the already received part is skipped
+func (c *Conn) upload(offset int64, body io.Reader) error {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+
+	if offset > c.uploaded {
+		return errBadOffset
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, body, c.uploaded-offset); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(c.inboundWriter, body)
+	c.uploaded += n
+	if errors.Is(err, io.ErrClosedPipe) {
+		return errClosed
+	}
+
+	return err
+}
+
+// offset acknowledges everything before it. returns nil data if nothing arrived in a while
+func (c *Conn) poll(offset int64, cancel <-chan struct{}) ([]byte, error) {
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+
+	for {
+		c.mu.Lock()
+
+		if offset < c.outboundStart || offset > c.outboundStart+int64(len(c.outbound)) {
+			c.mu.Unlock()
+			return nil, errBadOffset
+		}
+
+		if acked := int(offset - c.outboundStart); acked > 0 {
+			c.outbound = c.outbound[acked:]
+			c.outboundStart = offset
+			c.signal() // writers may be waiting for room
+		}
+
+		if len(c.outbound) > 0 {
+			size := len(c.outbound)
+			if size > maxPollResponse {
+				size = maxPollResponse
+			}
+
+			data := make([]byte, size)
+			copy(data, c.outbound)
+			c.mu.Unlock()
+			return data, nil
+		}
+
+		if c.isClosed() {
+			c.mu.Unlock()
+			return nil, errClosed
+		}
+
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil, nil
+		case <-cancel:
+			return nil, nil
+		}
+	}
+}
+
+// the session isn't idle while any request is in flight
+func (c *Conn) requestStarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight++
+	c.idleTimer.Stop()
+}
+
+func (c *Conn) requestDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight--
+	if c.inFlight == 0 {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+// call with mu held
+func (c *Conn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errClosed):
+		return http.StatusGone
+	case errors.Is(err, errBadOffset):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// "192.0.2.1:4321" => "192.0.2.1"
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+type stringAddr string
+
+func (s stringAddr) Network() string { return "tcp" }
+func (s stringAddr) String() string  { return string(s) }
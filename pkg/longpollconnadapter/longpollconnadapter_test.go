@@ -0,0 +1,208 @@
+package longpollconnadapter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestSession(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+
+	server := httptest.NewServer(NewServer(func(conn net.Conn) {
+		defer conn.Close()
+
+		remoteAddrs <- conn.RemoteAddr().String()
+
+		_, _ = io.Copy(conn, conn) // echo
+	}))
+	defer server.Close()
+
+	do := func(method string, path string, body string) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.Ok(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.Ok(t, err)
+		return resp.StatusCode, string(respBody)
+	}
+
+	status, token := do(http.MethodPost, "/", "")
+	assert.Assert(t, status == http.StatusCreated)
+	assert.Assert(t, len(token) == 32)
+	assert.Assert(t, strings.HasPrefix(<-remoteAddrs, "127.0.0.1:"))
+
+	session := func(method string, offset int, body string) (int, string) {
+		return do(method, fmt.Sprintf("/%s?offset=%d", token, offset), body)
+	}
+
+	status, _ = session(http.MethodPost, 0, "hello")
+	assert.Assert(t, status == http.StatusNoContent)
+
+	status, body := session(http.MethodGet, 0, "")
+	assert.Assert(t, status == http.StatusOK)
+	assert.EqualString(t, body, "hello")
+
+	// not acknowledged yet, so a retry gets the same data
+	_, body = session(http.MethodGet, 0, "")
+	assert.EqualString(t, body, "hello")
+
+	// client retries an upload that we already got the start of
+	status, _ = session(http.MethodPost, 0, "hello world")
+	assert.Assert(t, status == http.StatusNoContent)
+
+	_, body = session(http.MethodGet, 5, "")
+	assert.EqualString(t, body, " world")
+
+	status, _ = session(http.MethodGet, 3, "") // already acknowledged
+	assert.Assert(t, status == http.StatusConflict)
+	status, _ = session(http.MethodPost, 100, "")
+	assert.Assert(t, status == http.StatusConflict)
+
+	status, _ = session(http.MethodDelete, 0, "")
+	assert.Assert(t, status == http.StatusNoContent)
+	status, _ = session(http.MethodGet, 11, "")
+	assert.Assert(t, status == http.StatusNotFound)
+}
+
+func TestServerSideClose(t *testing.T) {
+	server := httptest.NewServer(NewServer(func(conn net.Conn) {
+		_, _ = conn.Write([]byte("bye"))
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	_, token := do(t, server, http.MethodPost, "/")
+
+	// closed session stays until client has the data
+	status, body := do(t, server, http.MethodGet, "/"+token+"?offset=0")
+	assert.Assert(t, status == http.StatusOK)
+	assert.EqualString(t, body, "bye")
+
+	status, _ = do(t, server, http.MethodGet, "/"+token+"?offset=3")
+	assert.Assert(t, status == http.StatusGone)
+
+	status, _ = do(t, server, http.MethodGet, "/"+token+"?offset=3")
+	assert.Assert(t, status == http.StatusNotFound)
+}
+
+func TestSessionLimits(t *testing.T) {
+	handler := NewServer(func(conn net.Conn) {})
+	handler.maxSessions = 3
+	handler.maxSessionsPerRemote = 2
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	open := func() int {
+		status, _ := do(t, server, http.MethodPost, "/")
+		return status
+	}
+
+	assert.Assert(t, open() == http.StatusCreated)
+	assert.Assert(t, open() == http.StatusCreated)
+
+	status, body := do(t, server, http.MethodPost, "/")
+	assert.Assert(t, status == http.StatusServiceUnavailable)
+	assert.EqualString(t, body, "too many sessions from 127.0.0.1\n")
+
+	// other remote
+	_, err := handler.open("192.0.2.1:1234", "192.0.2.1")
+	assert.Ok(t, err)
+
+	_, err = handler.open("192.0.2.2:1234", "192.0.2.2")
+	assert.EqualString(t, err.Error(), "too many sessions")
+}
+
+func TestSessionLimitsPerClientBehindProxy(t *testing.T) {
+	handler := NewServer(func(conn net.Conn) {})
+	handler.maxSessionsPerRemote = 1
+	handler.SetClientIp(func(r *http.Request) string {
+		return r.Header.Get("X-Forwarded-For") // test server is the "trusted proxy"
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	open := func(clientIp string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/", nil)
+		assert.Ok(t, err)
+		req.Header.Set("X-Forwarded-For", clientIp)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Ok(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := open("192.0.2.1")
+	assert.Assert(t, status == http.StatusCreated)
+
+	// same peer (the proxy), but a different client
+	status, _ = open("192.0.2.2")
+	assert.Assert(t, status == http.StatusCreated)
+
+	status, body := open("192.0.2.1")
+	assert.Assert(t, status == http.StatusServiceUnavailable)
+	assert.EqualString(t, body, "too many sessions from 192.0.2.1\n")
+}
+
+func TestSessionNotIdleDuringBlockedUpload(t *testing.T) {
+	received := make(chan string, 1)
+
+	handler := NewServer(func(conn net.Conn) {
+		defer conn.Close()
+
+		time.Sleep(300 * time.Millisecond) // upload blocks until we read
+
+		data, _ := ioutil.ReadAll(io.LimitReader(conn, 5))
+		received <- string(data)
+	})
+	handler.idleTimeout = 100 * time.Millisecond
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	_, token := do(t, server, http.MethodPost, "/")
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/"+token+"?offset=0", strings.NewReader("hello"))
+	assert.Ok(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	resp.Body.Close()
+
+	assert.Assert(t, resp.StatusCode == http.StatusNoContent)
+	assert.EqualString(t, <-received, "hello")
+
+	// idle timer runs again once no request is in flight
+	time.Sleep(300 * time.Millisecond)
+
+	status, _ := do(t, server, http.MethodGet, "/"+token+"?offset=0")
+	assert.Assert(t, status == http.StatusNotFound)
+}
+
+func do(t *testing.T, server *httptest.Server, method string, path string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	assert.Ok(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	assert.Ok(t, err)
+	return resp.StatusCode, string(respBody)
+}
@@ -0,0 +1,229 @@
+package passwordauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+// authenticates with an LDAP simple bind as the user (RFC 4511). we only need bind, so instead
+// of pulling in an LDAP library this speaks the few messages we need.
+type LdapConfig struct {
+	Url     string   `json:"url"`     // "ldap://host:389" or "ldaps://host:636"
+	UserDn  string   `json:"user_dn"` // "uid=%s,ou=devices,dc=example,dc=com" (%s = username)
+	Options []string `json:"options"` // optional authorized_keys -style options for all users
+}
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+type ldapMessage struct {
+	MessageId  int
+	ProtocolOp asn1.RawValue
+}
+
+type ldapBindRequest struct { // [APPLICATION 0]
+	Version  int
+	Name     []byte
+	Password []byte `asn1:"tag:0"` // simple authentication
+}
+
+type ldapResult struct { // BindResponse is [APPLICATION 1]
+	ResultCode        asn1.Enumerated
+	MatchedDn         []byte
+	DiagnosticMessage []byte
+}
+
+type ldapAuthenticator struct {
+	conf   LdapConfig
+	scheme string
+	host   string
+}
+
+func NewLdap(conf LdapConfig) (Authenticator, error) {
+	ldapUrl, err := url.Parse(conf.Url)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+
+	host := ldapUrl.Host
+	switch ldapUrl.Scheme {
+	case "ldap":
+		if ldapUrl.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+	case "ldaps":
+		if ldapUrl.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme: %s", ldapUrl.Scheme)
+	}
+
+	if strings.Count(conf.UserDn, "%s") != 1 {
+		return nil, errors.New("ldap: user_dn must contain one %s")
+	}
+
+	return &ldapAuthenticator{conf, ldapUrl.Scheme, host}, nil
+}
+
+func (l *ldapAuthenticator) Authenticate(ctx context.Context, user string, password string, _ net.Addr) (*ssh.Permissions, error) {
+	// empty password would be an "unauthenticated bind", which succeeds (RFC 4513 section 5.1.2)
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	resultCode, err := ldapBind(conn, fmt.Sprintf(l.conf.UserDn, escapeDnValue(user)), password)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+
+	switch resultCode {
+	case ldapResultSuccess:
+		permissions := sshidentity.Permissions(user)
+		sshidentity.ApplyKeyOptions(permissions, l.conf.Options)
+		return permissions, nil
+	case ldapResultInvalidCredentials:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, fmt.Errorf("ldap: bind failed with result code %d", resultCode)
+	}
+}
+
+func (l *ldapAuthenticator) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", l.host)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.scheme == "ldaps" {
+		hostname, _, _ := net.SplitHostPort(l.host)
+		return tls.Client(conn, &tls.Config{ServerName: hostname}), nil
+	}
+
+	return conn, nil
+}
+
+// returns LDAP result code
+func ldapBind(conn io.ReadWriter, dn string, password string) (int, error) {
+	bindRequest, err := asn1.MarshalWithParams(ldapBindRequest{
+		Version:  3,
+		Name:     []byte(dn),
+		Password: []byte(password),
+	}, "application,tag:0")
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := asn1.Marshal(ldapMessage{
+		MessageId:  1,
+		ProtocolOp: asn1.RawValue{FullBytes: bindRequest},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	responseBytes, err := readBerElement(bufio.NewReader(conn))
+	if err != nil {
+		return 0, err
+	}
+
+	response := ldapMessage{}
+	if _, err := asn1.Unmarshal(responseBytes, &response); err != nil {
+		return 0, err
+	}
+
+	if response.MessageId != 1 || response.ProtocolOp.Class != asn1.ClassApplication || response.ProtocolOp.Tag != 1 {
+		return 0, errors.New("unexpected response")
+	}
+
+	result := ldapResult{}
+	if _, err := asn1.UnmarshalWithParams(response.ProtocolOp.FullBytes, &result, "application,tag:1"); err != nil {
+		return 0, err
+	}
+
+	return int(result.ResultCode), nil
+}
+
+// reads one (low tag number, definite length) BER element, which is what LDAP messages are
+func readBerElement(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 { // long form: low bits tell how many length bytes follow
+		lengthBytes := make([]byte, length&0x7f)
+		if len(lengthBytes) == 0 || len(lengthBytes) > 3 {
+			return nil, errors.New("unsupported BER length")
+		}
+
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return nil, err
+		}
+
+		header = append(header, lengthBytes...)
+
+		length = 0
+		for _, lengthByte := range lengthBytes {
+			length = length<<8 | int(lengthByte)
+		}
+	}
+
+	element := make([]byte, len(header)+length)
+	copy(element, header)
+	if _, err := io.ReadFull(reader, element[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return element, nil
+}
+
+// so usernames can't inject DN syntax (RFC 4514 section 2.4)
+func escapeDnValue(value string) string {
+	escaped := strings.Builder{}
+
+	for i, char := range value {
+		switch {
+		case strings.ContainsRune(`\,+"<>;=`, char),
+			i == 0 && (char == ' ' || char == '#'),
+			i == len(value)-1 && char == ' ':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(char)
+		case char == 0:
+			escaped.WriteString(`\00`)
+		default:
+			escaped.WriteRune(char)
+		}
+	}
+
+	return escaped.String()
+}
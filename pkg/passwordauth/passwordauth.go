@@ -0,0 +1,68 @@
+// password-based authentication (SSH "password" and "keyboard-interactive" methods) for devices
+// that can't do keys, with pluggable backends. backends return the same ssh.Permissions
+// (identity & port forwarding policy, see sshidentity) as key auth does.
+package passwordauth
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// wrong username or password (as opposed to the backend being unavailable)
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type Authenticator interface {
+	// returns ErrInvalidCredentials if user is unknown or password is wrong
+	Authenticate(ctx context.Context, user string, password string, remoteAddr net.Addr) (*ssh.Permissions, error)
+}
+
+// configuration for exactly one backend
+type Config struct {
+	File    string         `json:"file"` // see NewFile()
+	Webhook *WebhookConfig `json:"webhook"`
+	Ldap    *LdapConfig    `json:"ldap"`
+}
+
+// nil Authenticator if password auth is not configured
+func New(conf Config) (Authenticator, error) {
+	authenticators := []Authenticator{}
+
+	if conf.File != "" {
+		file, err := NewFile(conf.File)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, file)
+	}
+
+	if conf.Webhook != nil {
+		webhook, err := NewWebhook(*conf.Webhook)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, webhook)
+	}
+
+	if conf.Ldap != nil {
+		ldap, err := NewLdap(*conf.Ldap)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, ldap)
+	}
+
+	switch len(authenticators) {
+	case 0:
+		return nil, nil
+	case 1:
+		return authenticators[0], nil
+	default:
+		return nil, errors.New("password auth: configure only one of file, webhook or ldap")
+	}
+}
@@ -0,0 +1,208 @@
+package passwordauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var testRemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4321}
+
+func TestPasswordFile(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("camerapass"), bcrypt.MinCost)
+	assert.Ok(t, err)
+
+	salt := []byte("saltsaltsaltsalt")
+	argon2Hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("doorbellpass"), salt, 1, 1024, 1, 32)))
+
+	tempDir, err := ioutil.TempDir("", "passwordauth")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "passwords")
+	assert.Ok(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`# devices
+camera:%s
+doorbell:%s:permitlisten="localhost:8080"
+`, bcryptHash, argon2Hash)), 0600))
+
+	file, err := NewFile(path)
+	assert.Ok(t, err)
+
+	permissions, err := file.Authenticate(context.Background(), "camera", "camerapass", testRemoteAddr)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "camera")
+
+	permissions, err = file.Authenticate(context.Background(), "doorbell", "doorbellpass", testRemoteAddr)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "doorbell")
+	assertListenPermitted(t, permissions, 8080, true)
+	assertListenPermitted(t, permissions, 8081, false)
+
+	_, err = file.Authenticate(context.Background(), "doorbell", "camerapass", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	_, err = file.Authenticate(context.Background(), "nobody", "camerapass", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	// changes are picked up without restarting
+	assert.Ok(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("doorbell:%s\n", argon2Hash)), 0600))
+
+	_, err = file.Authenticate(context.Background(), "camera", "camerapass", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+	_, err = file.Authenticate(context.Background(), "doorbell", "doorbellpass", testRemoteAddr)
+	assert.Ok(t, err)
+
+	// broken edit fails logins until fixed
+	assert.Ok(t, ioutil.WriteFile(path, []byte("camera:plaintext\n"), 0600))
+
+	_, err = file.Authenticate(context.Background(), "doorbell", "doorbellpass", testRemoteAddr)
+	assert.EqualString(t, err.Error(), path+": line 1: unsupported password hash (use bcrypt or argon2)")
+
+	_, err = NewFile(path)
+	assert.EqualString(t, err.Error(), path+": line 1: unsupported password hash (use bcrypt or argon2)")
+
+	assert.Ok(t, os.Remove(path))
+
+	_, err = file.Authenticate(context.Background(), "doorbell", "doorbellpass", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	_, err = NewFile(path)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestDummyBcryptHash(t *testing.T) {
+	cost, err := bcrypt.Cost(dummyBcryptHash)
+	assert.Ok(t, err)
+	assert.Assert(t, cost == bcrypt.DefaultCost)
+
+	assert.Ok(t, bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte("dummy")))
+}
+
+func TestWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			http.Error(w, "who are you?", http.StatusInternalServerError)
+			return
+		}
+
+		req := webhookRequest{}
+		assert.Ok(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.EqualString(t, req.RemoteAddr, "192.168.1.2:4321")
+
+		switch {
+		case req.User == "camera" && req.Password == "camerapass":
+			_ = json.NewEncoder(w).Encode(webhookResponse{
+				Identity: "camera-livingroom",
+				Options:  []string{"no-port-forwarding"},
+			})
+		case req.User == "broken":
+			http.Error(w, "database down", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "nope", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := NewWebhook(WebhookConfig{Url: server.URL, BearerToken: "sekrit"})
+	assert.Ok(t, err)
+
+	permissions, err := webhook.Authenticate(context.Background(), "camera", "camerapass", testRemoteAddr)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "camera-livingroom")
+	assertListenPermitted(t, permissions, 8080, false)
+
+	_, err = webhook.Authenticate(context.Background(), "camera", "wrong", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	_, err = webhook.Authenticate(context.Background(), "broken", "camerapass", testRemoteAddr)
+	assert.EqualString(t, err.Error(), "webhook: unexpected status 503 Service Unavailable")
+}
+
+func TestLdap(t *testing.T) {
+	// stand-in LDAP server that only knows bind
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				requestBytes, err := readBerElement(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+
+				request := ldapMessage{}
+				bind := ldapBindRequest{}
+				if _, err := asn1.Unmarshal(requestBytes, &request); err != nil {
+					return
+				}
+				if _, err := asn1.UnmarshalWithParams(request.ProtocolOp.FullBytes, &bind, "application,tag:0"); err != nil {
+					return
+				}
+
+				resultCode := ldapResultInvalidCredentials
+				if string(bind.Name) == `uid=camera,ou=devices,dc=example,dc=com` && string(bind.Password) == "camerapass" {
+					resultCode = ldapResultSuccess
+				}
+
+				bindResponse, _ := asn1.MarshalWithParams(ldapResult{ResultCode: asn1.Enumerated(resultCode)}, "application,tag:1")
+				response, _ := asn1.Marshal(ldapMessage{request.MessageId, asn1.RawValue{FullBytes: bindResponse}})
+				_, _ = conn.Write(response)
+			}()
+		}
+	}()
+
+	ldap, err := NewLdap(LdapConfig{
+		Url:     "ldap://" + listener.Addr().String(),
+		UserDn:  "uid=%s,ou=devices,dc=example,dc=com",
+		Options: []string{`permitlisten="8080"`},
+	})
+	assert.Ok(t, err)
+
+	permissions, err := ldap.Authenticate(context.Background(), "camera", "camerapass", testRemoteAddr)
+	assert.Ok(t, err)
+	assert.EqualString(t, sshidentity.FromPermissions(permissions), "camera")
+	assertListenPermitted(t, permissions, 8080, true)
+	assertListenPermitted(t, permissions, 8081, false)
+
+	_, err = ldap.Authenticate(context.Background(), "camera", "wrong", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	_, err = ldap.Authenticate(context.Background(), "camera", "", testRemoteAddr)
+	assert.Assert(t, err == ErrInvalidCredentials)
+
+	assert.EqualString(t, escapeDnValue(`camera,ou=admins`), `camera\,ou\=admins`)
+	assert.EqualString(t, escapeDnValue(`#cam `), `\#cam\ `)
+}
+
+func assertListenPermitted(t *testing.T, permissions *ssh.Permissions, port uint32, expected bool) {
+	t.Helper()
+
+	assert.Assert(t, sshidentity.ListenPermitted(&ssh.ServerConn{Permissions: permissions}, "localhost", port) == expected)
+}
@@ -0,0 +1,249 @@
+package passwordauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// password file has one user per line (username is also the identity):
+//
+//	camera:$2y$10$...
+//	doorbell:$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>:permitlisten="8080"
+//
+// hashes are bcrypt (like from "$ htpasswd -nB camera") or argon2id/argon2i in PHC string
+// format. optional third field has authorized_keys -style options (comma separated).
+//
+// the file is re-read when it changes (checked on each auth attempt), so users can be added &
+// removed without restarting.
+type passwordFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]passwordFileUser
+}
+
+type passwordFileUser struct {
+	hash    string
+	options []string
+}
+
+// hash (of "dummy", default cost) to compare against for unknown users, so response time
+// doesn't reveal which users exist
+var dummyBcryptHash = []byte("$2a$10$X5gFHomV5JEhfpgC1geZcOEM7Vd1X2ag5EPJYVP0dALi/X2Y3p1Ma")
+
+func NewFile(path string) (Authenticator, error) {
+	file := &passwordFile{path: path}
+
+	// unlike with later changes, the file must exist & be valid at startup
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.currentUsers(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// non-existing file has no users. a broken edit fails logins (instead of silently keeping
+// users that were meant to be removed) until it's fixed
+func (p *passwordFile) currentUsers() (map[string]passwordFileUser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if p.users != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.users, nil
+	}
+
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := parsePasswordFile(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.path, err)
+	}
+
+	p.users = users
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+
+	return users, nil
+}
+
+func (p *passwordFile) Authenticate(_ context.Context, user string, password string, _ net.Addr) (*ssh.Permissions, error) {
+	users, err := p.currentUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	userEntry, found := users[user]
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	ok, err := verifyPasswordHash(userEntry.hash, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	permissions := sshidentity.Permissions(user)
+	sshidentity.ApplyKeyOptions(permissions, userEntry.options)
+
+	return permissions, nil
+}
+
+func parsePasswordFile(content []byte) (map[string]passwordFileUser, error) {
+	users := map[string]passwordFileUser{}
+
+	lineNumber := 0
+	lines := bufio.NewScanner(bytes.NewReader(content))
+	for lines.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// options can contain ":" (permitlisten="localhost:8080") but usernames & hashes can't
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expecting user:hash[:options]", lineNumber)
+		}
+
+		if err := validatePasswordHash(fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		user := passwordFileUser{hash: fields[1]}
+		if len(fields) == 3 && fields[2] != "" {
+			user.options = strings.Split(fields[2], ",")
+		}
+
+		users[fields[0]] = user
+	}
+
+	return users, lines.Err()
+}
+
+func validatePasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2"):
+		_, err := parseArgon2Hash(hash)
+		return err
+	default:
+		return errors.New("unsupported password hash (use bcrypt or argon2)")
+	}
+}
+
+// error only if hash is malformed
+func verifyPasswordHash(hash string, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		argon2Hash, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+
+		return argon2Hash.verify(password), nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+type argon2Hash struct {
+	variant     string // "argon2id" | "argon2i"
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>" (salt & hash in unpadded base64)
+func parseArgon2Hash(serialized string) (*argon2Hash, error) {
+	parts := strings.Split(serialized, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("malformed argon2 hash")
+	}
+
+	if parts[1] != "argon2id" && parts[1] != "argon2i" {
+		return nil, fmt.Errorf("unsupported argon2 variant: %s", parts[1])
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+
+	parsed := &argon2Hash{variant: parts[1]}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.iterations, &parsed.parallelism); err != nil {
+		return nil, fmt.Errorf("malformed argon2 parameters: %w", err)
+	}
+
+	var err error
+	parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+
+	parsed.hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+func (a *argon2Hash) verify(password string) bool {
+	keyFn := argon2.IDKey
+	if a.variant == "argon2i" {
+		keyFn = argon2.Key
+	}
+
+	actual := keyFn([]byte(password), a.salt, a.iterations, a.memory, a.parallelism, uint32(len(a.hash)))
+
+	return subtle.ConstantTimeCompare(actual, a.hash) == 1
+}
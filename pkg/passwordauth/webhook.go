@@ -0,0 +1,107 @@
+package passwordauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+// asks an HTTP endpoint whether the credentials are valid:
+//
+//	POST <url>
+//	{"user": "camera", "password": "...", "remote_addr": "192.168.1.2:4321"}
+//
+// 200 = valid, response body like {"identity": "camera", "options": ["permitlisten=\"8080\""]}
+// (both fields optional, identity defaults to user. options are authorized_keys -style).
+// 401 / 403 = invalid credentials. anything else = error, i.e. auth fails but it's logged as
+// the backend being broken.
+type WebhookConfig struct {
+	Url         string `json:"url"`
+	BearerToken string `json:"bearer_token"` // optional, so the endpoint can trust us
+}
+
+type webhookRequest struct {
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+type webhookResponse struct {
+	Identity string   `json:"identity"`
+	Options  []string `json:"options"`
+}
+
+type webhook struct {
+	conf       WebhookConfig
+	httpClient *http.Client
+}
+
+func NewWebhook(conf WebhookConfig) (Authenticator, error) {
+	if conf.Url == "" {
+		return nil, errors.New("webhook: url required")
+	}
+
+	return &webhook{
+		conf:       conf,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (w *webhook) Authenticate(ctx context.Context, user string, password string, remoteAddr net.Addr) (*ssh.Permissions, error) {
+	requestBody, err := json.Marshal(webhookRequest{
+		User:       user,
+		Password:   password,
+		RemoteAddr: remoteAddr.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.conf.Url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if w.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.conf.BearerToken)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// handled below
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+
+	result := webhookResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("webhook: bad response: %w", err)
+	}
+
+	identity := result.Identity
+	if identity == "" {
+		identity = user
+	}
+
+	permissions := sshidentity.Permissions(identity)
+	sshidentity.ApplyKeyOptions(permissions, result.Options)
+
+	return permissions, nil
+}
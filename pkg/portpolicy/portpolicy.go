@@ -0,0 +1,107 @@
+// decides which ports the proxies (HTTP reverse proxy, SNI proxy) route visitors to. the port
+// comes from the hostname ("8080.punch.example.com"), so without a policy visitors could reach
+// any local port of the server.
+package portpolicy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/function61/holepunch-server/pkg/portrange"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+)
+
+// used when neither AllowPorts nor DenyPorts is configured
+const defaultDenyPorts = "22,80,443,8080"
+
+var (
+	ErrPortNotAllowed = errors.New("port not allowed") // by allow/deny lists or VirtualHostAllowed
+	ErrNoForward      = errors.New("no forward")
+)
+
+// embedded in the proxies' options
+type Config struct {
+	// port ranges like "20000-20999,8000". if set, only these ports are routed to
+	AllowPorts string `json:"allow_ports"`
+	// these ports are never routed to
+	DenyPorts string `json:"deny_ports"`
+	// optional. can refuse a virtual host + port combination (e.g. the port belongs to a tenant
+	// that the hostname doesn't)
+	VirtualHostAllowed func(virtualHost string, port int) error `json:"-"`
+}
+
+type Policy struct {
+	allowPorts         portrange.List // empty = all
+	denyPorts          portrange.List
+	virtualHostAllowed func(virtualHost string, port int) error
+	// whether a client has a reverse forward for the port (overridable for tests)
+	HasForward func(port uint32) bool
+	// opens a stream into the port's reverse forward (overridable for tests)
+	DialForward func(port uint32, origin net.Addr) (io.ReadWriteCloser, error)
+}
+
+func New(conf Config) (*Policy, error) {
+	allowPorts, err := portrange.Parse(conf.AllowPorts)
+	if err != nil {
+		return nil, fmt.Errorf("allow_ports: %w", err)
+	}
+
+	denyPortsSerialized := conf.DenyPorts
+	if conf.AllowPorts == "" && conf.DenyPorts == "" {
+		denyPortsSerialized = defaultDenyPorts
+	}
+
+	denyPorts, err := portrange.Parse(denyPortsSerialized)
+	if err != nil {
+		return nil, fmt.Errorf("deny_ports: %w", err)
+	}
+
+	return &Policy{
+		allowPorts:         allowPorts,
+		denyPorts:          denyPorts,
+		virtualHostAllowed: conf.VirtualHostAllowed,
+		HasForward:         sshserverportforward.HasReverseForward,
+		DialForward:        sshserverportforward.DialReverseForwardOnPort,
+	}, nil
+}
+
+// only ports that a client currently reverse forwards (and that the allow/deny lists let
+// through) are routed to. virtualHost is the hostname (or TLS server name) port was parsed from
+func (p *Policy) Check(virtualHost string, port int) error {
+	if len(p.allowPorts) > 0 && !p.allowPorts.Contains(uint32(port)) {
+		return fmt.Errorf("%w: destination port %d not in allow list", ErrPortNotAllowed, port)
+	}
+
+	if p.denyPorts.Contains(uint32(port)) {
+		return fmt.Errorf("%w: destination port %d is denied", ErrPortNotAllowed, port)
+	}
+
+	if p.virtualHostAllowed != nil {
+		if err := p.virtualHostAllowed(virtualHost, port); err != nil {
+			return fmt.Errorf("%w: %v", ErrPortNotAllowed, err)
+		}
+	}
+
+	if !p.HasForward(uint32(port)) {
+		return fmt.Errorf("%w: no reverse forward for port %d", ErrNoForward, port)
+	}
+
+	return nil
+}
+
+// connects to the port's reverse forward through the SSH connection of the client that has it,
+// instead of dialing "localhost:<port>" (which may be someone else's listener for the same port
+// on another loopback address). call Check() first. origin is reported to the client
+func (p *Policy) Dial(port int, origin net.Addr) (io.ReadWriteCloser, error) {
+	stream, err := p.DialForward(uint32(port), origin)
+	switch {
+	case errors.Is(err, sshserverportforward.ErrNoReverseForward): // went away after Check()
+		return nil, fmt.Errorf("%w: %v", ErrNoForward, err)
+	case errors.Is(err, sshserverportforward.ErrAmbiguousReverseForward):
+		return nil, fmt.Errorf("%w: %v", ErrPortNotAllowed, err)
+	default:
+		return stream, err
+	}
+}
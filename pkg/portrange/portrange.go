@@ -0,0 +1,69 @@
+// lists of port ranges like "8000,8080-8089", for config files
+package portrange
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	from uint32
+	to   uint32 // inclusive
+}
+
+type List []portRange
+
+// "8000,8080-8089". empty string is an empty list
+func Parse(serialized string) (List, error) {
+	list := List{}
+
+	if strings.TrimSpace(serialized) == "" {
+		return list, nil
+	}
+
+	for _, item := range strings.Split(serialized, ",") {
+		item = strings.TrimSpace(item)
+
+		from, to := item, item
+		if idx := strings.Index(item, "-"); idx != -1 {
+			from, to = item[:idx], item[idx+1:]
+		}
+
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports: %s", item)
+		}
+
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toPort < fromPort {
+			return nil, fmt.Errorf("invalid ports: %s", item)
+		}
+
+		list = append(list, portRange{uint32(fromPort), uint32(toPort)})
+	}
+
+	return list, nil
+}
+
+func (l List) Contains(port uint32) bool {
+	for _, r := range l {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l List) Overlaps(other List) bool {
+	for _, r := range l {
+		for _, o := range other {
+			if r.from <= o.to && o.from <= r.to {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+// an adapter for representing a QUIC stream as a net.Conn. QUIC connections survive the client's
+// IP changing (connection migration), which TCP-based transports don't.
+package quicconnadapter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN protocol ID that clients must use
+const NextProto = "holepunch-ssh"
+
+type Adapter struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func New(conn *quic.Conn, stream *quic.Stream) *Adapter {
+	return &Adapter{
+		Stream: stream,
+		conn:   conn,
+	}
+}
+
+// QUIC stream's Close() only closes our sending side
+func (a *Adapter) Close() error {
+	a.Stream.CancelRead(0)
+	return a.Stream.Close()
+}
+
+func (a *Adapter) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+// changes if the client migrates
+func (a *Adapter) RemoteAddr() net.Addr {
+	return a.conn.RemoteAddr()
+}
+
+// QUIC requires TLS, but we don't need it for authenticating the server since SSH's host keys
+// do that. so by default a throwaway self-signed cert will do.
+func SelfSignedTlsConfig() (*tls.Config, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "holepunch-server"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDer}, PrivateKey: privateKey}},
+		NextProtos:   []string{NextProto},
+	}, nil
+}
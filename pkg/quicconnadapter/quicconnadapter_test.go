@@ -0,0 +1,66 @@
+package quicconnadapter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/quic-go/quic-go"
+)
+
+func TestStreamAsConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tlsConfig, err := SelfSignedTlsConfig()
+	assert.Ok(t, err)
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			return
+		}
+
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+
+		adapter := New(conn, stream)
+		defer adapter.Close()
+
+		_, _ = adapter.Write([]byte(adapter.RemoteAddr().Network() + "\n"))
+		_, _ = io.Copy(adapter, adapter) // echo
+	}()
+
+	client, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{NextProto},
+	}, nil)
+	assert.Ok(t, err)
+	defer client.CloseWithError(0, "")
+
+	stream, err := client.OpenStreamSync(ctx)
+	assert.Ok(t, err)
+
+	_, err = stream.Write([]byte("hello\n"))
+	assert.Ok(t, err)
+
+	reader := bufio.NewReader(stream)
+
+	network, err := reader.ReadString('\n')
+	assert.Ok(t, err)
+	assert.EqualString(t, network, "udp\n")
+
+	echoed, err := reader.ReadString('\n')
+	assert.Ok(t, err)
+	assert.EqualString(t, echoed, "hello\n")
+}
@@ -0,0 +1,185 @@
+package reverseproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/function61/gokit/log/logex"
+)
+
+// set for the device's service after basic auth (visitor-supplied one is always removed)
+const forwardedUserHeader = "X-Forwarded-User"
+
+// like Traefik's / nginx's auth_request: we ask the auth service (e.g. oauth2-proxy in front of
+// an OIDC IdP) about each request. 2xx lets the request through, anything else (e.g. a
+// redirect to the IdP's login page) is relayed to the visitor as-is.
+type ForwardAuth struct {
+	Url string `json:"url"`
+	// copied from the auth service's 2xx response to the request to the device, e.g. "X-Auth-Request-Email"
+	ResponseHeaders []string `json:"response_headers"`
+}
+
+type forwardAuth struct {
+	conf       ForwardAuth
+	httpClient *http.Client
+}
+
+// returns false if the request must not be forwarded, in which case the response was already written
+func (p *proxy) authorize(w http.ResponseWriter, req *http.Request, r *route, logl *logex.Leveled) bool {
+	fail := func(err error) bool {
+		logl.Info.Printf("%s %s: %v", req.Header.Get(requestIdHeader), req.Host, err)
+
+		p.writeError(w, req, err)
+		return false
+	}
+
+	if len(r.allowIps) > 0 {
+		if ip := p.visitorIp(req); !cidrsContain(r.allowIps, ip) {
+			return fail(fmt.Errorf("%w: %s not in allow_ips", errAccessDenied, ip))
+		}
+	}
+
+	if !r.hasCredentialMethods() {
+		return true
+	}
+
+	req.Header.Del(forwardedUserHeader)
+
+	scheme, credentials := splitAuthorization(req.Header.Get("Authorization"))
+
+	switch {
+	case scheme == "basic" && r.passwords != nil:
+		if user, ok := r.checkBasicAuth(req); ok {
+			req.Header.Del("Authorization") // meant for us, not for the device
+			req.Header.Set(forwardedUserHeader, user)
+			return true
+		}
+	case scheme == "bearer" && len(r.BearerTokens) > 0:
+		if r.checkBearerToken(credentials) {
+			req.Header.Del("Authorization")
+			return true
+		}
+	}
+
+	if r.forwardAuth != nil {
+		return r.forwardAuth.authorize(w, req, p.visitorIp(req), func(err error) bool {
+			return fail(fmt.Errorf("forward_auth: %w", err))
+		})
+	}
+
+	if r.passwords != nil {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, req.Host))
+	}
+	if len(r.BearerTokens) > 0 {
+		w.Header().Add("WWW-Authenticate", "Bearer")
+	}
+
+	if scheme == "" {
+		return fail(fmt.Errorf("%w: no credentials", errUnauthorized))
+	}
+
+	return fail(fmt.Errorf("%w: invalid %s credentials", errUnauthorized, scheme))
+}
+
+func (r *route) checkBasicAuth(req *http.Request) (string, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	if _, err := r.passwords.Authenticate(req.Context(), user, password, nil); err != nil {
+		return "", false
+	}
+
+	return user, true
+}
+
+func (r *route) checkBearerToken(token string) bool {
+	match := false
+	for _, candidate := range r.BearerTokens { // no early return, so timing doesn't tell which matched
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			match = true
+		}
+	}
+
+	return match
+}
+
+func (f *forwardAuth) authorize(
+	w http.ResponseWriter,
+	req *http.Request,
+	visitorIp string,
+	fail func(error) bool,
+) bool {
+	authReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, f.conf.Url, nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, header := range []string{"Cookie", "Authorization", requestIdHeader} {
+		if value := req.Header.Get(header); value != "" {
+			authReq.Header.Set(header, value)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	authReq.Header.Set("X-Forwarded-Method", req.Method)
+	authReq.Header.Set("X-Forwarded-Proto", proto)
+	authReq.Header.Set("X-Forwarded-Host", req.Host)
+	authReq.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	authReq.Header.Set("X-Forwarded-For", visitorIp)
+
+	resp, err := f.httpClient.Do(authReq)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		for _, header := range f.conf.ResponseHeaders {
+			req.Header.Del(header) // visitor can't supply these
+			if value := resp.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+
+		return true
+	}
+
+	if resp.StatusCode >= 500 {
+		return fail(fmt.Errorf("auth service responded %s", resp.Status))
+	}
+
+	// e.g. redirect to IdP's login or 401/403 from the auth service
+	for _, header := range []string{"Location", "Set-Cookie", "WWW-Authenticate", "Content-Type"} {
+		for _, value := range resp.Header.Values(header) {
+			w.Header().Add(header, value)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, io.LimitReader(resp.Body, 64*1024))
+
+	return false
+}
+
+// "Basic Zm9vOmJhcg==" => "basic", "Zm9vOmJhcg=="
+func splitAuthorization(header string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if parts[0] == "" {
+		return "", ""
+	}
+
+	if len(parts) == 1 {
+		return strings.ToLower(parts[0]), ""
+	}
+
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
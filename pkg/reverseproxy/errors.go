@@ -0,0 +1,104 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/function61/holepunch-server/pkg/portpolicy"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// shown to the visitor. details are only logged, so we don't leak e.g. tenant names
+var errorMessages = map[int]string{
+	http.StatusBadRequest:     "Can't tell which forward you want from the hostname.",
+	http.StatusUnauthorized:   "This forward requires authentication.",
+	http.StatusForbidden:      "This forward can't be reached through the proxy.",
+	http.StatusNotFound:       "No such forward. The device may be offline.",
+	http.StatusBadGateway:     "The device's service refused or failed the connection.",
+	http.StatusGatewayTimeout: "The device's service didn't answer in time.",
+}
+
+func statusForError(err error) int {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errBadHost):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, portpolicy.ErrPortNotAllowed), errors.Is(err, errAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, portpolicy.ErrNoForward):
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (p *proxy) writeError(w http.ResponseWriter, req *http.Request, err error) {
+	status := statusForError(err)
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if p.errorTemplate == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%d %s\n\n%s\n", status, http.StatusText(status), errorMessages[status])
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = p.errorTemplate.Execute(w, struct {
+		Status     int
+		StatusText string
+		Message    string
+		RequestId  string
+		Host       string
+	}{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    errorMessages[status],
+		RequestId:  req.Header.Get(requestIdHeader),
+		Host:       req.Host,
+	})
+}
+
+// keeps request ID from upstream proxy (if sane), otherwise generates one. it's passed on to
+// the device's service too, so logs can be correlated
+func ensureRequestId(req *http.Request) string {
+	requestId := req.Header.Get(requestIdHeader)
+	if requestId == "" || len(requestId) > 128 || !isPrintableAscii(requestId) {
+		requestId = newRequestId()
+		req.Header.Set(requestIdHeader, requestId)
+	}
+
+	return requestId
+}
+
+func newRequestId() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func isPrintableAscii(s string) bool {
+	for _, r := range s {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,249 @@
+package reverseproxy
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// which headers tell the device's service about the original request
+const (
+	forwardedHeadersXForwarded = "x-forwarded" // X-Forwarded-For, -Proto and -Host (default)
+	forwardedHeadersRfc7239    = "forwarded"   // RFC 7239 Forwarded
+	forwardedHeadersBoth       = "both"
+	forwardedHeadersNone       = "none"
+)
+
+// accepts both CIDRs and plain IPs
+func parseCidrs(items []string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", item)
+			}
+
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+
+			item = fmt.Sprintf("%s/%d", item, bits)
+		}
+
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
+
+func (p *proxy) fromTrustedProxy(req *http.Request) bool {
+	return cidrsContain(p.trusted, remoteIp(req))
+}
+
+func (p *proxy) visitorIp(req *http.Request) string {
+	return visitorIp(p.trusted, req)
+}
+
+// for other handlers behind the same proxies (like SSH over long-polling) that need to know
+// who the visitor is
+func VisitorIpResolver(trustedProxies []string) (func(*http.Request) string, error) {
+	trusted, err := parseCidrs(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	return func(req *http.Request) string {
+		return visitorIp(trusted, req)
+	}, nil
+}
+
+// visitor's IP: the peer, or if the peer is a trusted proxy, the last (= added by the
+// outermost trusted proxy) untrusted hop in X-Forwarded-For
+func visitorIp(trusted []*net.IPNet, req *http.Request) string {
+	ip := remoteIp(req)
+	if !cidrsContain(trusted, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		ip = hop
+		if !cidrsContain(trusted, hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func cidrsContain(cidrs []*net.IPNet, ipSerialized string) bool {
+	ip := net.ParseIP(ipSerialized)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// for the outgoing request (to the device). the hop info from a trusted proxy in front of us is
+// kept and added to, otherwise it's replaced because the visitor could've forged it.
+// httputil.ReverseProxy appends visitor's IP to X-Forwarded-For after this.
+func (p *proxy) setForwardedHeaders(outreq *http.Request) {
+	trusted := p.fromTrustedProxy(outreq)
+
+	proto := "http"
+	if outreq.TLS != nil {
+		proto = "https"
+	}
+
+	if !trusted {
+		for _, header := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			outreq.Header.Del(header)
+		}
+	}
+
+	mode := cmp.Or(p.options.ForwardedHeaders, forwardedHeadersXForwarded)
+
+	if mode == forwardedHeadersXForwarded || mode == forwardedHeadersBoth {
+		if outreq.Header.Get("X-Forwarded-Proto") == "" {
+			outreq.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if outreq.Header.Get("X-Forwarded-Host") == "" {
+			outreq.Header.Set("X-Forwarded-Host", outreq.Host)
+		}
+	} else {
+		outreq.Header["X-Forwarded-For"] = nil // tells httputil.ReverseProxy not to add it
+		outreq.Header.Del("X-Forwarded-Proto")
+		outreq.Header.Del("X-Forwarded-Host")
+	}
+
+	if mode == forwardedHeadersRfc7239 || mode == forwardedHeadersBoth {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(remoteIp(outreq)),
+			quoteForwardedValue(outreq.Host),
+			proto)
+
+		if prior := outreq.Header.Get("Forwarded"); prior != "" {
+			element = prior + ", " + element
+		}
+
+		outreq.Header.Set("Forwarded", element)
+	} else {
+		outreq.Header.Del("Forwarded")
+	}
+}
+
+func (r *route) modifyRequest(outreq *http.Request) {
+	for _, header := range r.RemoveRequestHeaders {
+		outreq.Header.Del(header)
+	}
+
+	for header, value := range r.SetRequestHeaders {
+		outreq.Header.Set(header, value)
+	}
+}
+
+func (r *route) modifyResponse(resp *http.Response) {
+	for _, header := range r.RemoveResponseHeaders {
+		resp.Header.Del(header)
+	}
+
+	for header, value := range r.SetResponseHeaders {
+		resp.Header.Set(header, value)
+	}
+}
+
+// devices' services don't know they're behind us, so redirects to e.g. "http://localhost:8080/login"
+// are turned into "http://8080.punch.example.com/login"
+func rewriteLocation(resp *http.Response, destinationPort int) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	locationUrl, err := url.Parse(location)
+	if err != nil || locationUrl.Host == "" {
+		return // relative redirects are fine as-is
+	}
+
+	switch locationUrl.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+	default:
+		return
+	}
+
+	port := locationUrl.Port()
+	if port == "" {
+		port = "80"
+		if locationUrl.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if port != strconv.Itoa(destinationPort) {
+		return
+	}
+
+	// what the visitor used (if there's a trusted proxy in front of us, it could be https)
+	proto := resp.Request.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+		if resp.Request.TLS != nil {
+			proto = "https"
+		}
+	}
+
+	locationUrl.Scheme = proto
+	locationUrl.Host = resp.Request.Host
+	resp.Header.Set("Location", locationUrl.String())
+}
+
+func remoteIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// RFC 7239: IPv6 addresses are bracketed & quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+// host may contain ":", which isn't allowed in a token
+func quoteForwardedValue(value string) string {
+	if strings.ContainsAny(value, `:[]" `) {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
@@ -1,66 +1,240 @@
 package reverseproxy
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/portpolicy"
 )
 
-var disallowedPorts = []int{22, 80, 443, 8080}
+type Options struct {
+	// html/template file for error pages, gets .Status, .StatusText, .Message, .RequestId and
+	// .Host. default is a plain text message
+	ErrorTemplate string `json:"error_template"`
+	// how long to wait for the device's service to start answering (default 60 s), after which
+	// the request fails with 504
+	TimeoutSeconds int `json:"timeout_seconds"`
+	portpolicy.Config
+	// CIDRs (or IPs) of proxies in front of us, whose X-Forwarded-* / Forwarded headers we keep
+	TrustedProxies []string `json:"trusted_proxies"`
+	// "x-forwarded" (default) | "forwarded" (RFC 7239) | "both" | "none"
+	ForwardedHeaders string  `json:"forwarded_headers"`
+	Routes           []Route `json:"routes"`
+}
+
+// request failures, mapped to status codes in statusForError()
+var (
+	errBadHost      = errors.New("bad host")
+	errUnauthorized = errors.New("unauthorized")
+	errAccessDenied = errors.New("access denied") // by route's allow_ips
+	// + portpolicy.ErrPortNotAllowed & portpolicy.ErrNoForward
+)
+
+type proxy struct {
+	options       Options
+	errorTemplate *template.Template // nil = plain text
+	ports         *portpolicy.Policy
+	trusted       []*net.IPNet
+	routes        []route
+	transport     *http.Transport // for requests that no route matches
+}
+
+func newProxy(options Options) (*proxy, error) {
+	ports, err := portpolicy.New(options.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch options.ForwardedHeaders {
+	case "", forwardedHeadersXForwarded, forwardedHeadersRfc7239, forwardedHeadersBoth, forwardedHeadersNone:
+	default:
+		return nil, fmt.Errorf("forwarded_headers: unsupported value '%s'", options.ForwardedHeaders)
+	}
+
+	trusted, err := parseCidrs(options.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	timeout := 60 * time.Second
+	if options.TimeoutSeconds != 0 {
+		timeout = time.Duration(options.TimeoutSeconds) * time.Second
+	}
+
+	routes, err := parseRoutes(options.Routes, timeout, ports)
+	if err != nil {
+		return nil, err
+	}
+
+	var errorTemplate *template.Template
+	if options.ErrorTemplate != "" {
+		errorTemplate, err = template.ParseFiles(options.ErrorTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("error_template: %w", err)
+		}
+	}
+
+	return &proxy{
+		options:       options,
+		errorTemplate: errorTemplate,
+		ports:         ports,
+		trusted:       trusted,
+		routes:        routes,
+		transport:     newTransport(timeout, nil, ports),
+	}, nil
+}
+
+// only ports that a client currently reverse forwards (and that the allow/deny lists let
+// through) are routed to. anything else gets a 404 instead of us dialing whatever happens to
+// listen on that local port.
+func Register(mux *http.ServeMux, options Options, logger *log.Logger) error {
+	p, err := newProxy(options)
+	if err != nil {
+		return err
+	}
 
-func Register(mux *http.ServeMux, logger *log.Logger) {
-	logl := logex.Levels(logger)
+	mux.Handle("/", p.handler(logex.Levels(logger)))
 
+	return nil
+}
+
+func (p *proxy) handler(logl *logex.Leveled) http.Handler {
 	reverseProxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			destinationPort, err := destinationPortFromVirtualHost(req.Host)
-			if err != nil {
-				logl.Error.Println(err.Error())
-
-				// leaving Scheme unset aborts the request gracefully
-			} else {
-				req.URL.Scheme = "http"
-				req.URL.Host = fmt.Sprintf("localhost:%d", destinationPort)
+			dest := req.Context().Value(destinationKey).(*destination)
+
+			req.URL.Scheme = dest.scheme
+			req.URL.Host = fmt.Sprintf("localhost:%d", dest.port)
+
+			p.setForwardedHeaders(req)
+
+			if dest.route != nil {
+				dest.route.modifyRequest(req)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			dest := resp.Request.Context().Value(destinationKey).(*destination)
+
+			rewriteLocation(resp, dest.port)
+
+			if dest.route != nil {
+				dest.route.modifyResponse(resp)
+			}
+
+			return nil
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if dest := req.Context().Value(destinationKey).(*destination); dest.route != nil {
+				return dest.route.transport.RoundTrip(req)
 			}
+
+			return p.transport.RoundTrip(req)
+		}),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logl.Error.Printf("%s %s: %v", req.Header.Get(requestIdHeader), req.Host, err)
+
+			p.writeError(w, req, err)
 		},
 	}
 
-	mux.Handle("/", reverseProxy)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := ensureRequestId(req)
+		w.Header().Set(requestIdHeader, requestId)
+
+		destinationPort, err := p.destinationPort(req.Host)
+		if err != nil {
+			logl.Debug.Printf("%s %s: %v", requestId, req.Host, err)
+
+			p.writeError(w, req, err)
+			return
+		}
+
+		route := p.routeFor(destinationPort)
+
+		if route != nil && !p.authorize(w, req, route, logl) {
+			return
+		}
+
+		scheme := schemeFromVirtualHost(req.Host)
+		if scheme == "" && route != nil {
+			scheme = route.UpstreamScheme
+		}
+
+		origin, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr) // nil if not TCP
+
+		reverseProxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), destinationKey, &destination{
+			port:   destinationPort,
+			scheme: cmp.Or(scheme, "http"),
+			route:  route,
+			origin: origin,
+		})))
+	})
+}
+
+type contextKey int
+
+const destinationKey contextKey = iota
+
+type destination struct {
+	port   int
+	scheme string // of the device's service
+	route  *route // nil if no route matched
+	origin net.Addr
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func (p *proxy) destinationPort(virtualHost string) (int, error) {
+	destinationPort, err := destinationPortFromVirtualHost(virtualHost)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.ports.Check(virtualHost, destinationPort); err != nil {
+		return 0, err
+	}
+
+	return destinationPort, nil
 }
 
-// 8081.punch.fn61.net => 8081
-var destinationPortRe = regexp.MustCompile(`^([0-9]+)\.`)
+// 8081.punch.fn61.net => 8081, 8443-https.punch.fn61.net => 8443 (+ scheme "https")
+var destinationPortRe = regexp.MustCompile(`^([0-9]+)(?:-(https?))?\.`)
 
 func destinationPortFromVirtualHost(virtualHost string) (int, error) {
 	matches := destinationPortRe.FindStringSubmatch(virtualHost)
 	if matches == nil {
-		return 0, errors.New("failed to determine destination port from vhost")
+		return 0, fmt.Errorf("%w: failed to determine destination port from vhost", errBadHost)
 	}
 
 	destinationPort, err := strconv.Atoi(matches[1])
-	if err != nil { // should not happen
-		return 0, err
-	}
-
-	if isDisallowedPort(destinationPort) {
-		return 0, errors.New("destination port is disallowed")
+	if err != nil || destinationPort > 65535 {
+		return 0, fmt.Errorf("%w: invalid destination port", errBadHost)
 	}
 
 	return destinationPort, nil
 }
 
-func isDisallowedPort(port int) bool {
-	for _, disallowedPort := range disallowedPorts {
-		if port == disallowedPort {
-			return true
-		}
+// "" if virtual host doesn't specify it
+func schemeFromVirtualHost(virtualHost string) string {
+	matches := destinationPortRe.FindStringSubmatch(virtualHost)
+	if matches == nil {
+		return ""
 	}
 
-	return false
+	return matches[2]
 }
@@ -2,16 +2,40 @@ package reverseproxy
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/function61/gokit/log/logex"
 	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/portpolicy"
 )
 
-func TestDestinationPortFromVirtualHost(t *testing.T) {
-	testCase := func(input string, destinationPortExpected int, errExpected error) {
+func TestDestinationPort(t *testing.T) {
+	forwarded := map[uint32]bool{8081: true, 4431: true, 80: true, 20000: true, 20100: true}
+
+	newTestProxy := func(options Options) *proxy {
 		t.Helper()
 
-		destinationPort, err := destinationPortFromVirtualHost(input)
+		p, err := newProxy(options)
+		assert.Ok(t, err)
+		fakeForwards(p.ports, func(port uint32) bool { return forwarded[port] })
+		return p
+	}
+
+	testCase := func(p *proxy, input string, destinationPortExpected int, errExpected error) {
+		t.Helper()
+
+		destinationPort, err := p.destinationPort(input)
 
 		if errExpected == nil {
 			assert.Assert(t, err == errExpected)
@@ -20,14 +44,219 @@ func TestDestinationPortFromVirtualHost(t *testing.T) {
 		}
 
 		assert.Assert(t, destinationPort == destinationPortExpected)
+	}
+
+	defaults := newTestProxy(Options{})
+
+	testCase(defaults, "8081.punch.fn61.net", 8081, nil)
+	testCase(defaults, "4431.com", 4431, nil)
+	testCase(defaults, "4431.com:80", 4431, nil)
+	testCase(defaults, "4431-https.punch.fn61.net", 4431, nil)
+
+	testCase(defaults, "80.punch.fn61.net", 0, errors.New("port not allowed: destination port 80 is denied"))
+	testCase(defaults, "5432.punch.fn61.net", 0, errors.New("no forward: no reverse forward for port 5432"))
+	testCase(defaults, "4431", 0, errors.New("bad host: failed to determine destination port from vhost"))
+	testCase(defaults, "4431:80", 0, errors.New("bad host: failed to determine destination port from vhost"))
+	testCase(defaults, "4431-ftp.punch.fn61.net", 0, errors.New("bad host: failed to determine destination port from vhost"))
+	testCase(defaults, "99999.punch.fn61.net", 0, errors.New("bad host: invalid destination port"))
+
+	allowList := newTestProxy(Options{Config: portpolicy.Config{AllowPorts: "20000-20999", DenyPorts: "20100"}})
+
+	testCase(allowList, "20000.punch.fn61.net", 20000, nil)
+	testCase(allowList, "8081.punch.fn61.net", 0, errors.New("port not allowed: destination port 8081 not in allow list"))
+	testCase(allowList, "20100.punch.fn61.net", 0, errors.New("port not allowed: destination port 20100 is denied"))
+
+	// explicit deny list replaces the default one
+	denyList := newTestProxy(Options{Config: portpolicy.Config{DenyPorts: "8081"}})
+
+	testCase(denyList, "80.punch.fn61.net", 80, nil)
+	testCase(denyList, "8081.punch.fn61.net", 0, errors.New("port not allowed: destination port 8081 is denied"))
+
+	_, err := newProxy(Options{Config: portpolicy.Config{AllowPorts: "http"}})
+	assert.EqualString(t, err.Error(), "allow_ports: invalid ports: http")
+}
+
+func TestErrorResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(2 * time.Second)
+		}
+
+		_, _ = w.Write([]byte("hello from " + r.Header.Get("X-Request-Id")))
+	}))
+	defer upstream.Close()
+
+	upstreamPort := portOf(t, upstream.Listener.Addr())
+
+	// a port that nobody listens on
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	closedPort := portOf(t, closedListener.Addr())
+	assert.Ok(t, closedListener.Close())
+
+	tempDir, err := ioutil.TempDir("", "reverseproxy")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	templatePath := filepath.Join(tempDir, "error.html")
+	assert.Ok(t, ioutil.WriteFile(templatePath, []byte("<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p><small>{{.RequestId}} {{.Host}}</small>"), 0600))
+
+	p, err := newProxy(Options{Config: portpolicy.Config{DenyPorts: "22"}, TimeoutSeconds: 1})
+	assert.Ok(t, err)
+	fakeForwards(p.ports, func(port uint32) bool { return port == upstreamPort || port == closedPort })
+	handler := p.handler(logex.Levels(logex.Discard))
+
+	request := func(host string, path string, requestId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		if requestId != "" {
+			req.Header.Set("X-Request-Id", requestId)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	upstreamHost := strconv.Itoa(int(upstreamPort)) + ".punch.example.com"
 
+	ok := request(upstreamHost, "/", "abc-123")
+	assert.Assert(t, ok.Code == http.StatusOK)
+	assert.EqualString(t, ok.Body.String(), "hello from abc-123")
+	assert.EqualString(t, ok.Header().Get("X-Request-Id"), "abc-123")
+
+	for _, tc := range []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{"punch.example.com", "/", http.StatusBadRequest},
+		{"22.punch.example.com", "/", http.StatusForbidden},
+		{"5432.punch.example.com", "/", http.StatusNotFound},
+		{strconv.Itoa(int(closedPort)) + ".punch.example.com", "/", http.StatusBadGateway},
+		{upstreamHost, "/slow", http.StatusGatewayTimeout},
+	} {
+		rec := request(tc.host, tc.path, "")
+		assert.Assert(t, rec.Code == tc.status)
+		assert.Assert(t, len(rec.Header().Get("X-Request-Id")) == 24) // generated
+		assert.Assert(t, strings.HasPrefix(rec.Body.String(), strconv.Itoa(tc.status)+" "))
 	}
 
-	testCase("8081.punch.fn61.net", 8081, nil)
-	testCase("4431.com", 4431, nil)
-	testCase("4431.com:80", 4431, nil)
+	p, err = newProxy(Options{ErrorTemplate: templatePath})
+	assert.Ok(t, err)
+	fakeForwards(p.ports, func(port uint32) bool { return false })
+	handler = p.handler(logex.Levels(logex.Discard))
+
+	notFound := request("5432.punch.example.com", "/", "abc-123")
+	assert.EqualString(t, notFound.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.EqualString(t, notFound.Body.String(), "<h1>404 Not Found</h1><p>No such forward. The device may be offline.</p><small>abc-123 5432.punch.example.com</small>")
+}
+
+func portOf(t *testing.T, addr net.Addr) uint32 {
+	t.Helper()
+
+	_, portStr, err := net.SplitHostPort(addr.String())
+	assert.Ok(t, err)
+
+	port, err := strconv.Atoi(portStr)
+	assert.Ok(t, err)
+
+	return uint32(port)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "camera-firmware/1.0")
+		w.Header().Set("Location", "http://localhost:"+r.URL.Query().Get("port")+"/login")
+
+		for _, header := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "X-Secret", "X-Device-Token"} {
+			fmt.Fprintf(w, "%s=%s\n", header, r.Header.Get(header))
+		}
+	}))
+	defer upstream.Close()
+
+	upstreamPort := portOf(t, upstream.Listener.Addr())
+	upstreamHost := fmt.Sprintf("%d.punch.example.com", upstreamPort)
+
+	request := func(options Options, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
 
-	testCase("80.punch.fn61.net", 0, errors.New("destination port is disallowed"))
-	testCase("4431", 0, errors.New("failed to determine destination port from vhost"))
-	testCase("4431:80", 0, errors.New("failed to determine destination port from vhost"))
+		p, err := newProxy(options)
+		assert.Ok(t, err)
+		fakeForwards(p.ports, func(port uint32) bool { return true })
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/?port=%d", upstreamHost, upstreamPort), nil)
+		req.RemoteAddr = remoteAddr
+		for header, value := range headers {
+			req.Header.Set(header, value)
+		}
+
+		rec := httptest.NewRecorder()
+		p.handler(logex.Levels(logex.Discard)).ServeHTTP(rec, req)
+		assert.Assert(t, rec.Code == http.StatusOK)
+		return rec
+	}
+
+	forged := map[string]string{
+		"X-Forwarded-For":   "10.1.1.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example.com",
+		"Forwarded":         "for=10.1.1.1",
+		"X-Secret":          "visitor-supplied",
+	}
+
+	// untrusted visitor's headers are replaced
+	assert.EqualString(t, request(Options{}, "192.0.2.1:1234", forged).Body.String(), `X-Forwarded-For=192.0.2.1
+X-Forwarded-Proto=http
+X-Forwarded-Host=`+upstreamHost+`
+Forwarded=
+X-Secret=visitor-supplied
+X-Device-Token=
+`)
+
+	// trusted proxy's are kept and added to
+	assert.EqualString(t, request(Options{
+		TrustedProxies:   []string{"10.0.0.0/8"},
+		ForwardedHeaders: "both",
+	}, "10.0.0.5:1234", forged).Body.String(), `X-Forwarded-For=10.1.1.1, 10.0.0.5
+X-Forwarded-Proto=https
+X-Forwarded-Host=evil.example.com
+Forwarded=for=10.1.1.1, for=10.0.0.5;host=`+upstreamHost+`;proto=http
+X-Secret=visitor-supplied
+X-Device-Token=
+`)
+
+	rec := request(Options{
+		ForwardedHeaders: "forwarded",
+		Routes: []Route{
+			{Ports: "1-1000"}, // doesn't match, so next one applies
+			{
+				RemoveRequestHeaders:  []string{"X-Secret"},
+				SetRequestHeaders:     map[string]string{"X-Device-Token": "s3cr3t"},
+				RemoveResponseHeaders: []string{"Server"},
+				SetResponseHeaders:    map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+			},
+		},
+	}, "[2001:db8::1]:1234", forged)
+	assert.EqualString(t, rec.Body.String(), `X-Forwarded-For=
+X-Forwarded-Proto=
+X-Forwarded-Host=
+Forwarded=for="[2001:db8::1]";host=`+upstreamHost+`;proto=http
+X-Secret=
+X-Device-Token=s3cr3t
+`)
+	assert.EqualString(t, rec.Header().Get("Server"), "")
+	assert.EqualString(t, rec.Header().Get("Strict-Transport-Security"), "max-age=31536000")
+	assert.EqualString(t, rec.Header().Get("Location"), "http://"+upstreamHost+"/login")
+
+	_, err := newProxy(Options{ForwardedHeaders: "x-real-ip"})
+	assert.EqualString(t, err.Error(), "forwarded_headers: unsupported value 'x-real-ip'")
+	_, err = newProxy(Options{TrustedProxies: []string{"10.0.0.300"}})
+	assert.EqualString(t, err.Error(), "trusted_proxies: invalid IP: 10.0.0.300")
+}
+
+// ports for which hasForward() is true are "reverse forwarded" to whatever listens on 127.0.0.1:<port>
+func fakeForwards(ports *portpolicy.Policy, hasForward func(port uint32) bool) {
+	ports.HasForward = hasForward
+	ports.DialForward = func(port uint32, _ net.Addr) (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	}
 }
@@ -0,0 +1,131 @@
+package reverseproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/passwordauth"
+	"github.com/function61/holepunch-server/pkg/portpolicy"
+	"github.com/function61/holepunch-server/pkg/portrange"
+)
+
+// settings for requests to some ports. first route whose ports match wins
+type Route struct {
+	Ports string `json:"ports"` // like "8000,8080-8089". empty = all ports
+
+	SetRequestHeaders     map[string]string `json:"set_request_headers"`
+	RemoveRequestHeaders  []string          `json:"remove_request_headers"`
+	SetResponseHeaders    map[string]string `json:"set_response_headers"`
+	RemoveResponseHeaders []string          `json:"remove_response_headers"`
+
+	// access control (see auth.go). visitor's IP must be in AllowIps (if set), and if any of
+	// the credential methods are set the visitor must pass one of them
+	AllowIps     []string     `json:"allow_ips"`     // CIDRs or IPs
+	Htpasswd     string       `json:"htpasswd"`      // file for basic auth, bcrypt ("$ htpasswd -nB") or argon2
+	BearerTokens []string     `json:"bearer_tokens"` // "Authorization: Bearer <token>"
+	ForwardAuth  *ForwardAuth `json:"forward_auth"`
+
+	// "http" (default) | "https". hostnames like "8443-https.punch.example.com" override this
+	UpstreamScheme string       `json:"upstream_scheme"`
+	UpstreamTls    *UpstreamTls `json:"upstream_tls"`
+}
+
+type route struct {
+	Route
+	ports       portrange.List
+	allowIps    []*net.IPNet
+	passwords   passwordauth.Authenticator // nil if no htpasswd
+	forwardAuth *forwardAuth               // nil if not configured
+	transport   *http.Transport            // has route's upstream TLS settings
+}
+
+func (r *route) hasCredentialMethods() bool {
+	return r.passwords != nil || len(r.BearerTokens) > 0 || r.forwardAuth != nil
+}
+
+func parseRoutes(routesConf []Route, timeout time.Duration, policy *portpolicy.Policy) ([]route, error) {
+	routes := []route{}
+
+	for i, conf := range routesConf {
+		r, err := parseRoute(conf, timeout, policy)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+
+		routes = append(routes, *r)
+	}
+
+	return routes, nil
+}
+
+func parseRoute(conf Route, timeout time.Duration, policy *portpolicy.Policy) (*route, error) {
+	ports, err := portrange.Parse(conf.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	allowIps, err := parseCidrs(conf.AllowIps)
+	if err != nil {
+		return nil, fmt.Errorf("allow_ips: %w", err)
+	}
+
+	r := &route{
+		Route:    conf,
+		ports:    ports,
+		allowIps: allowIps,
+	}
+
+	if conf.Htpasswd != "" {
+		r.passwords, err = passwordauth.NewFile(conf.Htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd: %w", err)
+		}
+	}
+
+	if conf.ForwardAuth != nil {
+		if conf.ForwardAuth.Url == "" {
+			return nil, fmt.Errorf("forward_auth: url required")
+		}
+
+		r.forwardAuth = &forwardAuth{
+			conf:       *conf.ForwardAuth,
+			httpClient: &http.Client{Timeout: 10 * time.Second, CheckRedirect: dontFollowRedirects},
+		}
+	}
+
+	switch conf.UpstreamScheme {
+	case "", "http", "https":
+	default:
+		return nil, fmt.Errorf("upstream_scheme: unsupported value '%s'", conf.UpstreamScheme)
+	}
+
+	var tlsConfig *tls.Config
+	if conf.UpstreamTls != nil {
+		tlsConfig, err = conf.UpstreamTls.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: %w", err)
+		}
+	}
+
+	r.transport = newTransport(timeout, tlsConfig, policy)
+
+	return r, nil
+}
+
+// nil if no route matches
+func (p *proxy) routeFor(port int) *route {
+	for i := range p.routes {
+		if len(p.routes[i].ports) == 0 || p.routes[i].ports.Contains(uint32(port)) {
+			return &p.routes[i]
+		}
+	}
+
+	return nil
+}
+
+func dontFollowRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
@@ -0,0 +1,138 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/portpolicy"
+)
+
+// how we talk TLS to devices that only serve HTTPS (routers, NAS boxes etc.). by default the
+// cert is verified against system CAs for ServerName (default "localhost", since that's what we dial)
+type UpstreamTls struct {
+	ServerName         string `json:"server_name"` // SNI, also what the cert is verified for
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	PinnedCert         string `json:"pinned_cert"` // PEM file. device must present exactly this cert (self-signed is fine)
+	CaCert             string `json:"ca_cert"`     // PEM file of CA(s) to verify against instead of system CAs
+}
+
+func (u *UpstreamTls) tlsConfig() (*tls.Config, error) {
+	modes := 0
+	for _, set := range []bool{u.InsecureSkipVerify, u.PinnedCert != "", u.CaCert != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, errors.New("specify only one of insecure_skip_verify, pinned_cert and ca_cert")
+	}
+
+	conf := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CaCert != "" {
+		pem, err := ioutil.ReadFile(u.CaCert)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", u.CaCert)
+		}
+	}
+
+	if u.PinnedCert != "" {
+		pinned, err := readPemCert(u.PinnedCert)
+		if err != nil {
+			return nil, err
+		}
+
+		// chain & hostname don't matter, the exact cert does
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+				return errors.New("upstream cert doesn't match pinned_cert")
+			}
+
+			return nil
+		}
+	}
+
+	return conf, nil
+}
+
+// returns DER
+func readPemCert(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+
+	return block.Bytes, nil
+}
+
+// requests go to "localhost:<port>" (that's also the default TLS server name), but connections
+// are opened through the SSH connection of the client that reverse forwards the port
+func newTransport(timeout time.Duration, tlsConfig *tls.Config, ports *portpolicy.Policy) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+		_, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+
+		// keep-alive connections are reused for later visitors, but the client only learns the first
+		origin := net.Addr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if dest, ok := ctx.Value(destinationKey).(*destination); ok && dest.origin != nil {
+			origin = dest.origin
+		}
+
+		stream, err := ports.Dial(port, origin)
+		if err != nil {
+			return nil, err
+		}
+
+		return &streamConn{ReadWriteCloser: stream, remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}, nil
+	}
+
+	return transport
+}
+
+// SSH channels aren't net.Conns, which http.Transport wants. the transport's own timeouts
+// close the connection instead of relying on deadlines, so those are no-ops
+type streamConn struct {
+	io.ReadWriteCloser
+	remoteAddr net.Addr
+}
+
+func (s *streamConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (s *streamConn) RemoteAddr() net.Addr               { return s.remoteAddr }
+func (s *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (s *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (s *streamConn) SetWriteDeadline(t time.Time) error { return nil }
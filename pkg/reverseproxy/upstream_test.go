@@ -0,0 +1,80 @@
+package reverseproxy
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestHttpsUpstream(t *testing.T) {
+	// like a router's admin UI with a self-signed cert
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "sni=%s", r.TLS.ServerName)
+	}))
+	upstream.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // handshake failures are expected
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	upstreamPort := portOf(t, upstream.Listener.Addr())
+
+	tempDir, err := ioutil.TempDir("", "reverseproxy")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	certPath := filepath.Join(tempDir, "upstream.pem")
+	assert.Ok(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+
+	otherCertPath := filepath.Join(tempDir, "other.pem")
+	assert.Ok(t, ioutil.WriteFile(otherCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("some other cert")}), 0600))
+
+	request := func(hostLabel string, route Route) *httptest.ResponseRecorder {
+		t.Helper()
+
+		p, err := newProxy(Options{Routes: []Route{route}})
+		assert.Ok(t, err)
+		fakeForwards(p.ports, func(port uint32) bool { return true })
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%s.punch.example.com/", hostLabel), nil)
+		rec := httptest.NewRecorder()
+		p.handler(logex.Levels(logex.Discard)).ServeHTTP(rec, req)
+		return rec
+	}
+
+	https := fmt.Sprintf("%d-https", upstreamPort)
+
+	// plain HTTP to an HTTPS port
+	assert.Assert(t, request(fmt.Sprintf("%d", upstreamPort), Route{}).Code == http.StatusBadRequest)
+	// self-signed cert isn't trusted by default
+	assert.Assert(t, request(https, Route{}).Code == http.StatusBadGateway)
+
+	skipVerify := request(https, Route{UpstreamTls: &UpstreamTls{InsecureSkipVerify: true}})
+	assert.Assert(t, skipVerify.Code == http.StatusOK)
+	assert.EqualString(t, skipVerify.Body.String(), "sni=localhost")
+
+	pinned := request(https, Route{UpstreamTls: &UpstreamTls{PinnedCert: certPath, ServerName: "router.lan"}})
+	assert.Assert(t, pinned.Code == http.StatusOK)
+	assert.EqualString(t, pinned.Body.String(), "sni=router.lan")
+
+	assert.Assert(t, request(https, Route{UpstreamTls: &UpstreamTls{PinnedCert: otherCertPath}}).Code == http.StatusBadGateway)
+
+	// httptest's cert is valid for example.com
+	caCert := request(fmt.Sprintf("%d", upstreamPort), Route{UpstreamScheme: "https", UpstreamTls: &UpstreamTls{CaCert: certPath, ServerName: "example.com"}})
+	assert.Assert(t, caCert.Code == http.StatusOK)
+	assert.EqualString(t, caCert.Body.String(), "sni=example.com")
+
+	assert.Assert(t, request(https, Route{UpstreamTls: &UpstreamTls{CaCert: certPath}}).Code == http.StatusBadGateway)
+
+	_, err = newProxy(Options{Routes: []Route{{UpstreamTls: &UpstreamTls{InsecureSkipVerify: true, CaCert: certPath}}}})
+	assert.EqualString(t, err.Error(), "routes[0]: upstream_tls: specify only one of insecure_skip_verify, pinned_cert and ca_cert")
+	_, err = newProxy(Options{Routes: []Route{{UpstreamScheme: "ftp"}}})
+	assert.EqualString(t, err.Error(), "routes[0]: upstream_scheme: unsupported value 'ftp'")
+}
@@ -0,0 +1,196 @@
+// TLS passthrough for non-HTTP services (MQTT over TLS etc.): peeks at the server name (SNI)
+// in the ClientHello and pipes the raw TCP stream to a client's reverse forward, without
+// terminating TLS. like the HTTP reverse proxy, "8883.punch.example.com" reaches port 8883.
+package sniproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/function61/gokit/io/bidipipe"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/sync/taskrunner"
+	"github.com/function61/holepunch-server/pkg/portpolicy"
+)
+
+// visitor has this long to send its ClientHello
+const clientHelloTimeout = 10 * time.Second
+
+// same port policy (and defaults) as the HTTP reverse proxy's. VirtualHostAllowed gets the server name
+type Options struct {
+	portpolicy.Config
+}
+
+type proxy struct {
+	ports *portpolicy.Policy
+}
+
+func newProxy(options Options) (*proxy, error) {
+	ports, err := portpolicy.New(options.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxy{ports}, nil
+}
+
+func Serve(ctx context.Context, addr string, options Options, logger *log.Logger) error {
+	p, err := newProxy(options)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	logex.Levels(logger).Info.Printf("Listening on %s", addr)
+
+	return p.serve(ctx, listener, logger)
+}
+
+func (p *proxy) serve(ctx context.Context, listener net.Listener, logger *log.Logger) error {
+	logl := logex.Levels(logger)
+
+	tasks := taskrunner.New(ctx, logger)
+
+	tasks.Start("listener "+listener.Addr().String(), func(ctx context.Context) error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return nil // expected error
+				default:
+					return err // unexpected error
+				}
+			}
+
+			go func() {
+				if err := p.serveOne(conn); err != nil {
+					logl.Debug.Printf("%s: %s", conn.RemoteAddr(), err.Error())
+				}
+			}()
+		}
+	})
+
+	tasks.Start("listenercloser", func(ctx context.Context) error {
+		<-ctx.Done()
+		return listener.Close()
+	})
+
+	return tasks.Wait()
+}
+
+func (p *proxy) serveOne(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return err
+	}
+
+	serverName, clientHello, err := peekServerName(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	port, err := p.destinationPort(serverName)
+	if err != nil {
+		return err
+	}
+
+	upstream, err := p.ports.Dial(port, conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	return bidipipe.Pipe(
+		bidipipe.WithName("Visitor", &replayedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(clientHello), conn)}),
+		bidipipe.WithName("Upstream", upstream))
+}
+
+func (p *proxy) destinationPort(serverName string) (int, error) {
+	matches := destinationPortRe.FindStringSubmatch(serverName)
+	if matches == nil {
+		return 0, fmt.Errorf("failed to determine destination port from server name '%s'", serverName)
+	}
+
+	port, err := strconv.Atoi(matches[1])
+	if err != nil || port > 65535 {
+		return 0, fmt.Errorf("invalid destination port in server name '%s'", serverName)
+	}
+
+	if err := p.ports.Check(serverName, port); err != nil {
+		return 0, err
+	}
+
+	return port, nil
+}
+
+// 8883.punch.fn61.net => 8883
+var destinationPortRe = regexp.MustCompile(`^([0-9]+)\.`)
+
+var errClientHelloRead = errors.New("client hello read")
+
+// lets crypto/tls parse the ClientHello for us. returns the server name and the bytes read
+// (which are to be replayed to the upstream)
+func peekServerName(conn io.Reader) (string, []byte, error) {
+	read := &bytes.Buffer{}
+	serverName := ""
+
+	err := tls.Server(&readOnlyConn{reader: io.TeeReader(conn, read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead // aborts the handshake
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", nil, fmt.Errorf("reading ClientHello: %w", err)
+	}
+
+	if serverName == "" {
+		return "", nil, errors.New("ClientHello has no server name")
+	}
+
+	return serverName, read.Bytes(), nil
+}
+
+// for peeking at the ClientHello. writes (like the TLS alert for the aborted handshake) are
+// dropped so the visitor doesn't see them
+type readOnlyConn struct {
+	net.Conn // nil, only to satisfy the interface
+	reader   io.Reader
+}
+
+func (r *readOnlyConn) Read(p []byte) (int, error)         { return r.reader.Read(p) }
+func (r *readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (r *readOnlyConn) Close() error                       { return nil }
+func (r *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (r *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (r *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (r *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (r *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// visitor's conn, but reads start with the already consumed ClientHello
+type replayedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (r *replayedConn) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
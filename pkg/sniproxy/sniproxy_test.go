@@ -0,0 +1,105 @@
+package sniproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/portpolicy"
+)
+
+func TestPassthrough(t *testing.T) {
+	// stands in for e.g. an MQTT broker, TLS terminated on the device
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.TLS.ServerName)
+	}))
+	defer upstream.Close()
+
+	_, upstreamPortStr, err := net.SplitHostPort(upstream.Listener.Addr().String())
+	assert.Ok(t, err)
+	upstreamPort, err := strconv.Atoi(upstreamPortStr)
+	assert.Ok(t, err)
+
+	p, err := newProxy(Options{portpolicy.Config{DenyPorts: "22"}})
+	assert.Ok(t, err)
+	fakeForwards(p.ports, func(port uint32) bool { return int(port) == upstreamPort || port == 22 })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = p.serve(ctx, listener, logex.Discard) }()
+
+	get := func(serverName string) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", listener.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+
+		resp, err := client.Get("https://whatever/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get(fmt.Sprintf("%d.punch.example.com", upstreamPort))
+	assert.Ok(t, err)
+	assert.EqualString(t, body, fmt.Sprintf("hello %d.punch.example.com", upstreamPort))
+
+	for _, serverName := range []string{"22.punch.example.com", "5432.punch.example.com", "punch.example.com"} {
+		_, err := get(serverName)
+		assert.Assert(t, err != nil)
+	}
+}
+
+func TestDestinationPort(t *testing.T) {
+	p, err := newProxy(Options{portpolicy.Config{
+		AllowPorts: "8000-8999",
+		VirtualHostAllowed: func(serverName string, port int) error {
+			if port == 8001 {
+				return fmt.Errorf("port %d belongs to tenant team-a", port)
+			}
+			return nil
+		},
+	}})
+	assert.Ok(t, err)
+	fakeForwards(p.ports, func(port uint32) bool { return port != 8002 })
+
+	destinationPort := func(serverName string) string {
+		port, err := p.destinationPort(serverName)
+		if err != nil {
+			return err.Error()
+		}
+		return strconv.Itoa(port)
+	}
+
+	assert.EqualString(t, destinationPort("8883.punch.example.com"), "8883")
+	assert.EqualString(t, destinationPort("8001.punch.example.com"), "port not allowed: port 8001 belongs to tenant team-a")
+	assert.EqualString(t, destinationPort("8002.punch.example.com"), "no forward: no reverse forward for port 8002")
+	assert.EqualString(t, destinationPort("9000.punch.example.com"), "port not allowed: destination port 9000 not in allow list")
+	assert.EqualString(t, destinationPort("mqtt.punch.example.com"), "failed to determine destination port from server name 'mqtt.punch.example.com'")
+}
+
+// ports for which hasForward() is true are "reverse forwarded" to whatever listens on 127.0.0.1:<port>
+func fakeForwards(ports *portpolicy.Policy, hasForward func(port uint32) bool) {
+	ports.HasForward = hasForward
+	ports.DialForward = func(port uint32, _ net.Addr) (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	}
+}
@@ -0,0 +1,194 @@
+// minimal SOCKS5 (RFC 1928) server that supports only the CONNECT command without
+// authentication. where the connections go is decided by a pluggable Dialer
+package socks5server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/function61/gokit/io/bidipipe"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/sync/taskrunner"
+)
+
+const (
+	socksVersion = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	addrTypeIPv4   = 0x01
+	addrTypeDomain = 0x03
+	addrTypeIPv6   = 0x04
+
+	replySucceeded           = 0x00
+	replyHostUnreachable     = 0x04
+	replyCommandNotSupported = 0x07
+	replyAddrTypeUnsupported = 0x08
+)
+
+// opens a stream to host:port on behalf of a SOCKS client (whose address is origin)
+type Dialer func(host string, port int, origin net.Addr) (io.ReadWriteCloser, error)
+
+func Serve(ctx context.Context, addr string, dial Dialer, logger *log.Logger) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	logl := logex.Levels(logger)
+
+	logl.Info.Printf("Listening on %s", addr)
+
+	tasks := taskrunner.New(ctx, logger)
+
+	tasks.Start("listener "+addr, func(ctx context.Context) error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return nil // expected error
+				default:
+					return err // unexpected error
+				}
+			}
+
+			go func() {
+				if err := serveOne(conn, dial); err != nil {
+					logl.Error.Printf("%s: %s", conn.RemoteAddr(), err.Error())
+				}
+			}()
+		}
+	})
+
+	tasks.Start("listenercloser", func(ctx context.Context) error {
+		<-ctx.Done()
+		return listener.Close()
+	})
+
+	return tasks.Wait()
+}
+
+func serveOne(conn net.Conn, dial Dialer) error {
+	defer conn.Close()
+
+	if err := negotiateAuthMethod(conn); err != nil {
+		return err
+	}
+
+	host, port, err := readConnectRequest(conn)
+	if err != nil {
+		return err
+	}
+
+	upstream, err := dial(host, port, conn.RemoteAddr())
+	if err != nil {
+		_ = writeReply(conn, replyHostUnreachable)
+		return fmt.Errorf("dial %s: %w", net.JoinHostPort(host, strconv.Itoa(port)), err)
+	}
+
+	if err := writeReply(conn, replySucceeded); err != nil {
+		upstream.Close()
+		return err
+	}
+
+	return bidipipe.Pipe(
+		bidipipe.WithName("SOCKS client", conn),
+		bidipipe.WithName("Upstream", upstream))
+}
+
+func negotiateAuthMethod(conn io.ReadWriter) error {
+	header := make([]byte, 2) // version, number of methods
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if method == methodNoAuth {
+			_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+			return err
+		}
+	}
+
+	_, _ = conn.Write([]byte{socksVersion, methodNoAcceptable})
+
+	return errors.New("client does not support no-auth method")
+}
+
+func readConnectRequest(conn io.ReadWriter) (string, int, error) {
+	header := make([]byte, 4) // version, command, reserved, address type
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, err
+	}
+
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	if header[1] != cmdConnect {
+		_ = writeReply(conn, replyCommandNotSupported)
+		return "", 0, fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case addrTypeIPv4, addrTypeIPv6:
+		ipLen := net.IPv4len
+		if header[3] == addrTypeIPv6 {
+			ipLen = net.IPv6len
+		}
+
+		ip := make([]byte, ipLen)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, err
+		}
+
+		host = net.IP(ip).String()
+	case addrTypeDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, domainLen); err != nil {
+			return "", 0, err
+		}
+
+		domain := make([]byte, domainLen[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", 0, err
+		}
+
+		host = string(domain)
+	default:
+		_ = writeReply(conn, replyAddrTypeUnsupported)
+		return "", 0, fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, err
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// we don't have a meaningful bound address to report, so it's always 0.0.0.0:0
+func writeReply(conn io.Writer, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,59 @@
+package socks5server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestReadConnectRequest(t *testing.T) {
+	testCase := func(request []byte, hostExpected string, portExpected int, errExpected string) {
+		t.Helper()
+
+		conn := &fakeConn{bytes.NewBuffer(request), &bytes.Buffer{}}
+
+		host, port, err := readConnectRequest(conn)
+		if errExpected == "" {
+			assert.Ok(t, err)
+		} else {
+			assert.EqualString(t, err.Error(), errExpected)
+		}
+
+		assert.EqualString(t, host, hostExpected)
+		assert.Assert(t, port == portExpected)
+	}
+
+	testCase([]byte{5, 1, 0, 1, 192, 168, 1, 2, 0x1f, 0x90}, "192.168.1.2", 8080, "")
+	testCase(append(append([]byte{5, 1, 0, 3, 8}, "mydevice"...), 0, 80), "mydevice", 80, "")
+	testCase([]byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}, "::1", 22, "")
+
+	testCase([]byte{4, 1, 0, 1}, "", 0, "unsupported SOCKS version 4")
+	testCase([]byte{5, 2, 0, 1}, "", 0, "unsupported command 2")
+	testCase([]byte{5, 1, 0, 9}, "", 0, "unsupported address type 9")
+}
+
+func TestNegotiateAuthMethod(t *testing.T) {
+	conn := &fakeConn{bytes.NewBuffer([]byte{5, 2, 2, 0}), &bytes.Buffer{}}
+
+	assert.Ok(t, negotiateAuthMethod(conn))
+	assert.Assert(t, bytes.Equal(conn.written.Bytes(), []byte{5, 0}))
+
+	conn = &fakeConn{bytes.NewBuffer([]byte{5, 1, 2}), &bytes.Buffer{}}
+
+	assert.EqualString(t, negotiateAuthMethod(conn).Error(), "client does not support no-auth method")
+	assert.Assert(t, bytes.Equal(conn.written.Bytes(), []byte{5, 0xff}))
+}
+
+type fakeConn struct {
+	toRead  *bytes.Buffer
+	written *bytes.Buffer
+}
+
+func (f *fakeConn) Read(p []byte) (int, error) {
+	return f.toRead.Read(p)
+}
+
+func (f *fakeConn) Write(p []byte) (int, error) {
+	return f.written.Write(p)
+}
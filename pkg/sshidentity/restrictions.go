@@ -0,0 +1,107 @@
+package sshidentity
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// port forwarding restrictions decided by the auth callback. without these the client may
+// forward anything (subject to the server's other checks)
+const (
+	extensionPermitListen    = "holepunch-permit-listen"     // comma separated, "" = nothing permitted
+	extensionNoDirectForward = "holepunch-no-direct-forward" // presence denies "direct-tcpip"
+)
+
+// restricts which reverse forwards the client may request. items are like OpenSSH's
+// permitlisten: "port" or "host:port", where port can be "*". no items = no reverse forwards.
+func RestrictListen(permissions *ssh.Permissions, permitListen []string) {
+	extensions(permissions)[extensionPermitListen] = strings.Join(permitListen, ",")
+}
+
+func DenyDirectForwards(permissions *ssh.Permissions) {
+	extensions(permissions)[extensionNoDirectForward] = ""
+}
+
+// applies the subset of OpenSSH's authorized_keys options (see sshd(8)) that concerns us:
+// no-port-forwarding, restrict (of which only port forwarding restriction matters to us),
+// port-forwarding (lifts restrict) and permitlisten="[host:]port" (can be given many times).
+// other options are ignored. also for non-key auth methods, so policies look the same.
+func ApplyKeyOptions(permissions *ssh.Permissions, options []string) {
+	portForwarding := true
+	permitListen := []string{}
+
+	for _, option := range options {
+		name, value := option, ""
+		if idx := strings.Index(option, "="); idx != -1 {
+			name, value = option[:idx], strings.Trim(option[idx+1:], `"`)
+		}
+
+		switch strings.ToLower(name) {
+		case "no-port-forwarding", "restrict":
+			portForwarding = false
+		case "port-forwarding":
+			portForwarding = true
+		case "permitlisten":
+			permitListen = append(permitListen, value)
+		}
+	}
+
+	if !portForwarding {
+		RestrictListen(permissions, nil)
+		DenyDirectForwards(permissions)
+	} else if len(permitListen) > 0 {
+		RestrictListen(permissions, permitListen)
+	}
+}
+
+// whether client may request a reverse forward listening on host:port
+func ListenPermitted(conn *ssh.ServerConn, host string, port uint32) bool {
+	if conn.Permissions == nil {
+		return true
+	}
+
+	permitListen, restricted := conn.Permissions.Extensions[extensionPermitListen]
+	if !restricted {
+		return true
+	}
+
+	for _, permitted := range strings.Split(permitListen, ",") {
+		if permitted != "" && listenMatches(permitted, host, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func DirectForwardsPermitted(conn *ssh.ServerConn) bool {
+	if conn.Permissions == nil {
+		return true
+	}
+
+	_, denied := conn.Permissions.Extensions[extensionNoDirectForward]
+	return !denied
+}
+
+func listenMatches(permitted string, host string, port uint32) bool {
+	permittedHost, permittedPort := "*", permitted
+	if idx := strings.LastIndex(permitted, ":"); idx != -1 {
+		permittedHost, permittedPort = permitted[:idx], permitted[idx+1:]
+	}
+
+	if permittedHost != "*" && permittedHost != host {
+		return false
+	}
+
+	return permittedPort == "*" || permittedPort == strconv.Itoa(int(port))
+}
+
+func extensions(permissions *ssh.Permissions) map[string]string {
+	if permissions.Extensions == nil {
+		permissions.Extensions = map[string]string{}
+	}
+
+	return permissions.Extensions
+}
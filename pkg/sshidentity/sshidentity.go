@@ -0,0 +1,61 @@
+// carries the authenticated client's identity inside ssh.Permissions, so the auth callbacks
+// and the rest of the server (port forwarding, proxies) agree on who's on the other end
+package sshidentity
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// stored in ssh.Permissions.Extensions, which x/crypto/ssh hands over from the auth
+// callback to the resulting *ssh.ServerConn
+const extensionIdentity = "holepunch-identity"
+
+// for use as the return value from an auth callback
+func Permissions(identity string) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			extensionIdentity: identity,
+		},
+	}
+}
+
+// overrides identity of permissions from an auth callback
+func SetIdentity(permissions *ssh.Permissions, identity string) {
+	if permissions.Extensions == nil {
+		permissions.Extensions = map[string]string{}
+	}
+
+	permissions.Extensions[extensionIdentity] = identity
+}
+
+// returns identity of an authenticated connection: "<user>/<name>" (e.g. "hp/laptop"). names
+// (key comments, cert key IDs) are only unique within a user, and users can be different
+// tenants, so the identity is namespaced by the user. it's just "<user>" if the auth callback
+// didn't attach a name
+func Of(conn *ssh.ServerConn) string {
+	name := Name(conn)
+	if name == conn.User() {
+		return name
+	}
+
+	return conn.User() + "/" + name
+}
+
+// the name (e.g. device name) the auth callback attached, without the user. falls back to the
+// username. not unique across users, so use Of() for telling clients apart
+func Name(conn *ssh.ServerConn) string {
+	if name := FromPermissions(conn.Permissions); name != "" {
+		return name
+	}
+
+	return conn.User()
+}
+
+// returns empty string if the permissions don't carry an identity
+func FromPermissions(permissions *ssh.Permissions) string {
+	if permissions == nil {
+		return ""
+	}
+
+	return permissions.Extensions[extensionIdentity]
+}
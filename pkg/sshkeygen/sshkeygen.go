@@ -0,0 +1,59 @@
+// generates SSH keypairs in OpenSSH's own private key format, which (unlike PKCS #8) OpenSSH
+// can read for ed25519 keys. x/crypto/ssh can parse but not write this format.
+package sshkeygen
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// see PROTOCOL.key in OpenSSH's source
+const opensshMagic = "openssh-key-v1\x00"
+
+// returns PEM-encoded ("OPENSSH PRIVATE KEY") unencrypted private key and its public key
+func Ed25519(comment string) ([]byte, ssh.PublicKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checkBytes := make([]byte, 4)
+	if _, err := rand.Read(checkBytes); err != nil {
+		return nil, nil, err
+	}
+	check := binary.BigEndian.Uint32(checkBytes)
+
+	privateSection := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Public  []byte
+		Private []byte // seed + public key, like in Go
+		Comment string
+	}{check, check, ssh.KeyAlgoED25519, publicKey, privateKey, comment})
+
+	// pad to cipher block size (8 for "none") with bytes 1, 2, 3, ...
+	for i := byte(1); len(privateSection)%8 != 0; i++ {
+		privateSection = append(privateSection, i)
+	}
+
+	keyFile := append([]byte(opensshMagic), ssh.Marshal(struct {
+		CipherName     string
+		KdfName        string
+		KdfOptions     string
+		NumKeys        uint32
+		PublicKey      []byte
+		PrivateSection []byte
+	}{"none", "none", "", 1, sshPublicKey.Marshal(), privateSection})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: keyFile}), sshPublicKey, nil
+}
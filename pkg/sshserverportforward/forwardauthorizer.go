@@ -0,0 +1,99 @@
+package sshserverportforward
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// describes a client's request to set up a forward (as opposed to StreamInfo, which describes
+// one connection through an already granted forward)
+type ForwardRequest struct {
+	Conn *ssh.ServerConn
+	Kind string // "tcpip-forward" | "udp-forward" | "direct-tcpip"
+	Addr string // listen address for reverse forwards, destination for "direct-tcpip"
+	Port uint32
+}
+
+// called after the built-in permission checks. returning an error refuses the request.
+type ForwardAuthorizer func(req ForwardRequest) error
+
+var (
+	forwardAuthorizers   = []ForwardAuthorizer{}
+	forwardAuthorizersMu sync.Mutex
+)
+
+// authorizers are run in the order they were added, first refusal wins
+func AddForwardAuthorizer(authorizer ForwardAuthorizer) {
+	forwardAuthorizersMu.Lock()
+	defer forwardAuthorizersMu.Unlock()
+
+	forwardAuthorizers = append(forwardAuthorizers, authorizer)
+}
+
+func authorizeForward(req ForwardRequest) error {
+	forwardAuthorizersMu.Lock()
+	authorizers := append([]ForwardAuthorizer{}, forwardAuthorizers...)
+	forwardAuthorizersMu.Unlock()
+
+	for _, authorizer := range authorizers {
+		if err := authorizer(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// like ForwardAuthorizer, but for limits that depend on the current reverse forwards (like
+// ReverseForwardCountOfUser()). reverse forward reservations are serialized while this runs, so
+// the counts can't change before the forward is added. don't do slow things here.
+type ForwardLimiter func(req ForwardRequest) error
+
+var (
+	forwardLimiter   ForwardLimiter // nil = no limits
+	forwardLimiterMu sync.Mutex
+	reservationMu    sync.Mutex
+)
+
+func SetForwardLimiter(limiter ForwardLimiter) {
+	forwardLimiterMu.Lock()
+	defer forwardLimiterMu.Unlock()
+
+	forwardLimiter = limiter
+}
+
+var (
+	errAlreadyReserved = errors.New("already reserved")
+	// we'd have to tell the client which port the OS picked, and that port would've skipped
+	// permitlisten and the forward authorizers (e.g. tenants' port pools)
+	errServerChosenPort = errors.New("port 0 (server chooses the port) not supported")
+)
+
+// checks the limiter and adds the reverse forward to list in one go
+func reserveForward(req ForwardRequest, list *forwardList, forwardingDetails channelForwardMsg) (*chan bool, error) {
+	if forwardingDetails.Rport == 0 {
+		return nil, errServerChosenPort
+	}
+
+	forwardLimiterMu.Lock()
+	limiter := forwardLimiter
+	forwardLimiterMu.Unlock()
+
+	reservationMu.Lock()
+	defer reservationMu.Unlock()
+
+	if limiter != nil {
+		if err := limiter(req); err != nil {
+			return nil, err
+		}
+	}
+
+	cancelCh := list.add(forwardingDetails, req.Conn)
+	if cancelCh == nil {
+		return nil, errAlreadyReserved
+	}
+
+	return cancelCh, nil
+}
@@ -1,13 +1,19 @@
 package sshserverportforward
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 
 	"github.com/function61/gokit/io/bidipipe"
 	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/auditlog"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -18,9 +24,13 @@ import (
 
 var logl = logex.Levels(logex.Discard)
 
+// used for "direct-tcpip" (= forward forward) dials. hostnames are resolved with the
+// system resolver unless overridden with SetResolver()
+var directDialer = &net.Dialer{}
+
 // this needs to be global (because TCP ports are global)
 var fwdList = &forwardList{
-	reverseCancellations: map[string]chan bool{},
+	reverseForwards: map[string]*reverseForward{},
 }
 
 // returns a new channel that receives all non-portforwarding requests.
@@ -34,7 +44,11 @@ func ProcessPortForwardRequests(requests <-chan *ssh.Request, serverConn *ssh.Se
 			case "tcpip-forward":
 				processTcpipForwardReq(req, serverConn, fwdList)
 			case "cancel-tcpip-forward":
-				processTcpipCancelForwardReq(req, fwdList)
+				processTcpipCancelForwardReq(req, serverConn, fwdList, "tcp")
+			case udpForwardRequestType:
+				processUdpForwardReq(req, serverConn, udpFwdList)
+			case udpCancelForwardRequestType:
+				processTcpipCancelForwardReq(req, serverConn, udpFwdList, "udp")
 			default:
 				nonForwardRequests <- req
 			}
@@ -48,14 +62,12 @@ func processTcpipForwardReq(req *ssh.Request, serverConn *ssh.ServerConn, fwdLis
 	var forwardingDetails channelForwardMsg
 	if err := ssh.Unmarshal(req.Payload, &forwardingDetails); err != nil {
 		logl.Error.Println(err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "tcp", "", err.Error())
 		_ = req.Reply(false, nil)
 		return
 	}
 
-	// TODO: use IP.IsLoopback() || IP.IsUnspecified()
-	isForwardTunnel := forwardingDetails.Addr != "127.0.0.1" && forwardingDetails.Addr != "0.0.0.0" && forwardingDetails.Addr != "localhost"
-
-	if isForwardTunnel {
+	if !isReverseForwardBindAddr(forwardingDetails.Addr) {
 		/* from RFC:
 		"When a connection comes to a locally forwarded TCP/IP port, the
 		following packet is sent to the other side.  Note that these messages
@@ -68,9 +80,31 @@ func processTcpipForwardReq(req *ssh.Request, serverConn *ssh.ServerConn, fwdLis
 		return
 	}
 
-	cancelCh := fwdList.add(forwardingDetails)
-	if cancelCh == nil {
-		logl.Error.Println("TCP/IP reverse forward already reserved")
+	if !sshidentity.ListenPermitted(serverConn, forwardingDetails.Addr, forwardingDetails.Rport) {
+		logl.Error.Printf("reverse forward %s not permitted", forwardingDetails.listenAddr())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "tcp", forwardingDetails.listenAddr(), "not permitted")
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	forwardReq := ForwardRequest{
+		Conn: serverConn,
+		Kind: "tcpip-forward",
+		Addr: forwardingDetails.Addr,
+		Port: forwardingDetails.Rport,
+	}
+
+	if err := authorizeForward(forwardReq); err != nil {
+		logl.Error.Printf("reverse forward %s refused: %s", forwardingDetails.listenAddr(), err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "tcp", forwardingDetails.listenAddr(), err.Error())
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	cancelCh, err := reserveForward(forwardReq, fwdList, forwardingDetails)
+	if err != nil {
+		logl.Error.Printf("TCP/IP reverse forward %s refused: %s", forwardingDetails.listenAddr(), err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "tcp", forwardingDetails.listenAddr(), err.Error())
 		_ = req.Reply(false, nil)
 		return
 	}
@@ -83,7 +117,8 @@ func processTcpipForwardReq(req *ssh.Request, serverConn *ssh.ServerConn, fwdLis
 		*cancelCh)
 }
 
-func processTcpipCancelForwardReq(req *ssh.Request, fwdList *forwardList) {
+// also used for UDP
+func processTcpipCancelForwardReq(req *ssh.Request, serverConn *ssh.ServerConn, fwdList *forwardList, protocol string) {
 	var cancelForwardDetails channelForwardMsg
 	if err := ssh.Unmarshal(req.Payload, &cancelForwardDetails); err != nil {
 		logl.Error.Println(err.Error())
@@ -91,16 +126,17 @@ func processTcpipCancelForwardReq(req *ssh.Request, fwdList *forwardList) {
 		return
 	}
 
-	if fwdList.cancel(cancelForwardDetails) {
+	if fwdList.cancelIfOwnedBy(cancelForwardDetails, serverConn) {
+		auditForward(auditlog.ReverseForwardCancelled, serverConn, protocol, cancelForwardDetails.listenAddr(), "")
 		_ = req.Reply(true, nil)
 	} else {
-		logl.Error.Println("cancel request for non-existent port")
+		logl.Error.Println("cancel request for non-existent port (or someone else's)")
 		_ = req.Reply(false, nil)
 	}
 }
 
 // does same for ssh.NewChannel as above ProcessPortForwardRequests() does for ssh.Request
-func ProcessPortForwardNewChannelRequests(newChannelRequests <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+func ProcessPortForwardNewChannelRequests(newChannelRequests <-chan ssh.NewChannel, serverConn *ssh.ServerConn) <-chan ssh.NewChannel {
 	nonForwardNewChannels := make(chan ssh.NewChannel, 1)
 
 	go func() {
@@ -114,7 +150,7 @@ func ProcessPortForwardNewChannelRequests(newChannelRequests <-chan ssh.NewChann
 					continue
 				}
 
-				go processOnePortForwardRequest(forwardingDetails, newChannel)
+				go processOnePortForwardRequest(forwardingDetails, newChannel, serverConn)
 			default:
 				nonForwardNewChannels <- newChannel
 			}
@@ -131,13 +167,15 @@ func processOnePortReverseRequest(
 	fwdList *forwardList,
 	cancel <-chan bool,
 ) {
-	listenAddr := fmt.Sprintf("%s:%d", forwardingDetails.Addr, forwardingDetails.Rport)
+	listenAddr := forwardingDetails.listenAddr()
 
 	logl.Info.Printf("Adding reverse listener to %s", listenAddr)
 
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		logl.Error.Println(err.Error())
+		fwdList.cancelIfCurrent(forwardingDetails, cancel)
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "tcp", listenAddr, err.Error())
 		_ = req.Reply(false, nil)
 		return
 	}
@@ -149,7 +187,7 @@ func processOnePortReverseRequest(
 			connToForward, err := listener.Accept()
 			if err != nil {
 				logl.Error.Printf("Accept() failed: %s", err.Error())
-				fwdList.cancel(forwardingDetails)
+				fwdList.cancelIfCurrent(forwardingDetails, cancel)
 				return
 			}
 
@@ -167,18 +205,14 @@ func processOnePortReverseRequest(
 		// returns when SSH connection exists
 		_ = serverConn.Wait()
 
-		fwdList.cancel(forwardingDetails)
+		fwdList.cancelIfCurrent(forwardingDetails, cancel)
 	}()
 
-	/*	FIXME: we probably should implement to-spec where responding with port if port in req was 0
+	auditForward(auditlog.ReverseForwardGranted, serverConn, "tcp", listenAddr, "")
 
-		type channelForwardResponse struct {
-			Port uint32
-		}
-	*/
 	_ = req.Reply(true, nil)
 
-	// wait until reverse forward is: (all signalled via fwdList.cancel())
+	// wait until reverse forward is: (all signalled via fwdList.cancelIf*())
 	// - cancelled explicitly by the client or
 	// - the connection breaks
 	// - listener.Accept() fails
@@ -187,55 +221,230 @@ func processOnePortReverseRequest(
 }
 
 func forwardOneReverseConnection(sshServerConn *ssh.ServerConn, connToForward net.Conn, forwardingDetails channelForwardMsg) error {
-	remoteAddr := connToForward.RemoteAddr()
-	remoteHost, remotePortStr, err := net.SplitHostPort(remoteAddr.String())
+	tcpStreamCh, err := openForwardedChannel(sshServerConn, forwardingDetails, connToForward.RemoteAddr())
 	if err != nil {
+		connToForward.Close()
 		return err
 	}
 
-	remotePort, err := strconv.Atoi(remotePortStr)
+	return bidipipe.Pipe(
+		bidipipe.WithName("SSH tunnel", tcpStreamCh),
+		bidipipe.WithName("Local connection", connToForward))
+}
+
+// opens a channel to the client for one connection coming into its reverse forward
+func openForwardedChannel(sshServerConn *ssh.ServerConn, forwardingDetails channelForwardMsg, origin net.Addr) (io.ReadWriteCloser, error) {
+	wrap, err := interceptStream(StreamInfo{
+		Identity: sshidentity.Of(sshServerConn),
+		User:     sshServerConn.User(),
+		Kind:     "forwarded-tcpip",
+		Addr:     forwardingDetails.Addr,
+		Port:     forwardingDetails.Rport,
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	originHost, originPort, err := splitHostPort(origin)
+	if err != nil {
+		abandonStream(wrap)
+		return nil, err
 	}
 
 	fordwardedMsg := &forwardedTCPPayload{
 		Addr:       forwardingDetails.Addr,
 		Port:       forwardingDetails.Rport,
-		OriginAddr: remoteHost,
-		OriginPort: uint32(remotePort),
+		OriginAddr: originHost,
+		OriginPort: originPort,
 	}
 
 	// TCP stream is modeled as a SSH channel. it conveniently implements
 	// io.ReadWriteCloser so we can just pipe the TCP connection and SSH channel in both directions
 	tcpStreamCh, reqs, err := sshServerConn.OpenChannel("forwarded-tcpip", ssh.Marshal(fordwardedMsg))
 	if err != nil {
-		return err
+		abandonStream(wrap)
+		return nil, err
 	}
 
 	// we're not expecting any requests for this channel
 	go ssh.DiscardRequests(reqs)
 
-	return bidipipe.Pipe(
-		bidipipe.WithName("SSH tunnel", tcpStreamCh),
-		bidipipe.WithName("Local connection", connToForward))
+	return wrap(tcpStreamCh), nil
+}
+
+type ReverseForward struct {
+	Protocol string // "tcp" | "udp"
+	Addr     string
+	Port     uint32
+}
+
+func (r ReverseForward) ListenAddr() string {
+	return net.JoinHostPort(r.Addr, strconv.Itoa(int(r.Port)))
+}
+
+// reverse forwards that a client (across all its connections) currently has, sorted by
+// protocol and address
+func ReverseForwardsOf(identity string) []ReverseForward {
+	forwards := []ReverseForward{}
+
+	for _, list := range []struct {
+		protocol string
+		list     *forwardList
+	}{
+		{"tcp", fwdList},
+		{"udp", udpFwdList},
+	} {
+		for _, details := range list.list.byIdentity(identity) {
+			forwards = append(forwards, ReverseForward{list.protocol, details.Addr, details.Rport})
+		}
+	}
+
+	sort.Slice(forwards, func(i, j int) bool {
+		if forwards[i].Protocol != forwards[j].Protocol {
+			return forwards[i].Protocol < forwards[j].Protocol
+		}
+		return forwards[i].ListenAddr() < forwards[j].ListenAddr()
+	})
+
+	return forwards
+}
+
+// whether some client currently has a TCP reverse forward listening on port
+func HasReverseForward(port uint32) bool {
+	return fwdList.hasPort(port)
+}
+
+// number of reverse forwards (TCP and UDP) that clients logged in as user currently have
+func ReverseForwardCountOfUser(user string) int {
+	return fwdList.countByUser(user) + udpFwdList.countByUser(user)
+}
+
+var (
+	ErrNoReverseForward        = errors.New("no reverse forward")
+	ErrAmbiguousReverseForward = errors.New("port reverse forwarded by several clients")
+)
+
+// opens a stream into a reverse forward of a client, identified by its identity (see
+// sshidentity) and the port it reverse forwards. this way you can reach a client's forwarded
+// services without going through the TCP listener we've set up for the reverse forward.
+// origin is reported to the client as the originator of the connection.
+func DialReverseForward(identity string, port uint32, origin net.Addr) (io.ReadWriteCloser, error) {
+	fwd := fwdList.findByIdentityAndPort(identity, port)
+	if fwd == nil {
+		return nil, fmt.Errorf("%w for %s port %d", ErrNoReverseForward, identity, port)
+	}
+
+	return openForwardedChannel(fwd.serverConn, fwd.details, origin)
+}
+
+// opens a stream into the TCP reverse forward that listens on port, without going through the
+// listener. dialing "localhost:<port>" instead could reach a different service than the forward
+// (the client bound e.g. [::1]:port while something else listens on 127.0.0.1:port).
+func DialReverseForwardOnPort(port uint32, origin net.Addr) (io.ReadWriteCloser, error) {
+	fwd, err := fwdList.findByPort(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return openForwardedChannel(fwd.serverConn, fwd.details, origin)
+}
+
+// asks the client to connect to host:port on its side, i.e. the reverse of a client's
+// "direct-tcpip" request. this doesn't require the client to have declared a reverse forward
+// beforehand, so it's up to the client which destinations it permits (clients that don't
+// support this will reject the channel).
+func DialThroughClient(sshServerConn *ssh.ServerConn, host string, port uint32, origin net.Addr) (io.ReadWriteCloser, error) {
+	wrap, err := interceptStream(StreamInfo{
+		Identity: sshidentity.Of(sshServerConn),
+		User:     sshServerConn.User(),
+		Kind:     "dial-through-client",
+		Addr:     host,
+		Port:     port,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	originHost, originPort, err := splitHostPort(origin)
+	if err != nil {
+		abandonStream(wrap)
+		return nil, err
+	}
+
+	directMsg := &channelOpenDirectMsg{
+		Raddr: host,
+		Rport: port,
+		Laddr: originHost,
+		Lport: originPort,
+	}
+
+	logl.Info.Printf("dialing %s through client %s", net.JoinHostPort(host, strconv.Itoa(int(port))), sshidentity.Of(sshServerConn))
+
+	tcpStreamCh, reqs, err := sshServerConn.OpenChannel("direct-tcpip", ssh.Marshal(directMsg))
+	if err != nil {
+		abandonStream(wrap)
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	return wrap(tcpStreamCh), nil
 }
 
-func processOnePortForwardRequest(forwardingDetails channelOpenDirectMsg, newChannel ssh.NewChannel) {
-	remoteAddr := fmt.Sprintf("%s:%d", forwardingDetails.Raddr, forwardingDetails.Rport)
+func processOnePortForwardRequest(forwardingDetails channelOpenDirectMsg, newChannel ssh.NewChannel, serverConn *ssh.ServerConn) {
+	remoteAddr := net.JoinHostPort(forwardingDetails.Raddr, strconv.Itoa(int(forwardingDetails.Rport)))
+
+	if !sshidentity.DirectForwardsPermitted(serverConn) {
+		logl.Error.Printf("forwarding %s not permitted", remoteAddr)
+		auditForward(auditlog.DirectForwardRefused, serverConn, "tcp", remoteAddr, "not permitted")
+		_ = newChannel.Reject(ssh.Prohibited, "port forwarding not permitted")
+		return
+	}
+
+	if err := authorizeForward(ForwardRequest{
+		Conn: serverConn,
+		Kind: "direct-tcpip",
+		Addr: forwardingDetails.Raddr,
+		Port: forwardingDetails.Rport,
+	}); err != nil {
+		logl.Error.Printf("forwarding %s refused: %s", remoteAddr, err.Error())
+		auditForward(auditlog.DirectForwardRefused, serverConn, "tcp", remoteAddr, err.Error())
+		_ = newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	wrap, err := interceptStream(StreamInfo{
+		Identity: sshidentity.Of(serverConn),
+		User:     serverConn.User(),
+		Kind:     "direct-tcpip",
+		Addr:     forwardingDetails.Raddr,
+		Port:     forwardingDetails.Rport,
+	})
+	if err != nil {
+		logl.Error.Printf("forwarding %s refused: %s", remoteAddr, err.Error())
+		auditForward(auditlog.DirectForwardRefused, serverConn, "tcp", remoteAddr, err.Error())
+		_ = newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
 
 	logl.Info.Printf("forwarding %s", remoteAddr)
 	defer logl.Info.Println("closing")
 
-	rconn, err := net.Dial("tcp", remoteAddr)
+	rconn, err := directDialer.DialContext(context.Background(), "tcp", remoteAddr)
 	if err != nil {
+		abandonStream(wrap)
 		logl.Error.Println(err.Error())
+		auditForward(auditlog.DirectForwardRefused, serverConn, "tcp", remoteAddr, err.Error())
 		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
 		return
 	}
 	defer rconn.Close()
 
+	auditForward(auditlog.DirectForwardDial, serverConn, "tcp", remoteAddr, "")
+
 	tcpStreamCh, reqs, err := newChannel.Accept()
 	if err != nil {
+		abandonStream(wrap)
 		logl.Error.Println("channel Accept() failed")
 		return
 	}
@@ -243,14 +452,46 @@ func processOnePortForwardRequest(forwardingDetails channelOpenDirectMsg, newCha
 	go ssh.DiscardRequests(reqs)
 
 	if err := bidipipe.Pipe(bidipipe.WithName(
-		"SSH tunnel", tcpStreamCh),
+		"SSH tunnel", wrap(tcpStreamCh)),
 		bidipipe.WithName("Local connection", rconn),
 	); err != nil {
 		logl.Error.Println(err.Error())
 	}
 }
 
+func auditForward(eventType string, serverConn *ssh.ServerConn, protocol string, target string, reason string) {
+	auditlog.Record(auditlog.Event{
+		Type:       eventType,
+		User:       serverConn.User(),
+		Identity:   sshidentity.Of(serverConn),
+		RemoteAddr: serverConn.RemoteAddr().String(),
+		Protocol:   protocol,
+		Target:     target,
+		Reason:     reason,
+	})
+}
+
 // this is ugly design
 func SetLogger(logr *log.Logger) {
 	logl = logex.Levels(logr)
 }
+
+// resolver used for hostnames in "direct-tcpip" requests
+func SetResolver(resolver *net.Resolver) {
+	directDialer = &net.Dialer{Resolver: resolver}
+}
+
+// returns resolver that sends all queries to given DNS server (e.g. "192.168.1.1:53")
+func ResolverForDnsServer(dnsServerAddr string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(dnsServerAddr); err != nil {
+		return nil, errors.New("DNS server must be given as <host>:<port>")
+	}
+
+	return &net.Resolver{
+		PreferGo: true, // the cgo resolver would not respect Dial
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, network, dnsServerAddr)
+		},
+	}, nil
+}
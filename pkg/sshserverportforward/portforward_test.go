@@ -0,0 +1,230 @@
+package sshserverportforward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialThroughClient(t *testing.T) {
+	defer func(previous []StreamInterceptor) { streamInterceptors = previous }(streamInterceptors)
+
+	reserved := 0
+	streamInterceptors = []StreamInterceptor{
+		func(StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+			reserved++
+
+			return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+				return &releasingStream{ReadWriteCloser: clientSide, release: func() { reserved-- }}
+			}, nil
+		},
+	}
+
+	pair := sshtest.Connect(t, "hp", nil)
+	go ssh.DiscardRequests(pair.ServerRequests)
+
+	dialed := make(chan channelOpenDirectMsg, 2)
+
+	// the device: echoes on port 80, has nothing listening elsewhere
+	go func() {
+		for newChannel := range pair.Client.HandleChannelOpen("direct-tcpip") {
+			msg := channelOpenDirectMsg{}
+			assert.Ok(t, ssh.Unmarshal(newChannel.ExtraData(), &msg))
+			dialed <- msg
+
+			if msg.Rport != 80 {
+				_ = newChannel.Reject(ssh.ConnectionFailed, "connection refused")
+				continue
+			}
+
+			channel, reqs, err := newChannel.Accept()
+			assert.Ok(t, err)
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				defer channel.Close()
+				_, _ = io.Copy(channel, channel)
+			}()
+		}
+	}()
+
+	operator := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	stream, err := DialThroughClient(pair.Server, "localhost", 80, operator)
+	assert.Ok(t, err)
+	assert.EqualJson(t, <-dialed, `{
+  "Raddr": "localhost",
+  "Rport": 80,
+  "Laddr": "192.0.2.1",
+  "Lport": 1234
+}`)
+
+	_, err = stream.Write([]byte("hello"))
+	assert.Ok(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(stream, echoed)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(echoed), "hello")
+
+	assert.Assert(t, reserved == 1)
+	assert.Ok(t, stream.Close())
+	assert.Assert(t, reserved == 0)
+
+	// rejected by device => interceptors' reservations are released
+	_, err = DialThroughClient(pair.Server, "localhost", 81, operator)
+	assert.EqualString(t, err.Error(), "ssh: rejected: connect failed (connection refused)")
+	<-dialed
+	assert.Assert(t, reserved == 0)
+}
+
+func TestDialReverseForwardOnPort(t *testing.T) {
+	// some other service listens on 127.0.0.1:port, the client forwards [::1]:port
+	otherService, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer otherService.Close()
+	port := uint32(otherService.Addr().(*net.TCPAddr).Port)
+
+	forward := func(addr string) {
+		t.Helper()
+
+		pair := sshtest.Connect(t, "hp", nil)
+		go ssh.DiscardRequests(ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+		go func() {
+			for newChannel := range pair.Client.HandleChannelOpen("forwarded-tcpip") {
+				channel, reqs, err := newChannel.Accept()
+				assert.Ok(t, err)
+				go ssh.DiscardRequests(reqs)
+
+				_, _ = channel.Write([]byte("forwarded " + addr))
+				channel.Close()
+			}
+		}()
+
+		ok, _, err := pair.Client.SendRequest("tcpip-forward", true, ssh.Marshal(&channelForwardMsg{
+			Addr:  addr,
+			Rport: port,
+		}))
+		assert.Ok(t, err)
+		assert.Assert(t, ok)
+	}
+
+	forward("::1")
+
+	operator := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	stream, err := DialReverseForwardOnPort(port, operator)
+	assert.Ok(t, err)
+	response, err := io.ReadAll(stream)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(response), "forwarded ::1")
+
+	// can't tell which client visitors of the port want
+	forward("127.0.0.2")
+
+	_, err = DialReverseForwardOnPort(port, operator)
+	assert.Assert(t, errors.Is(err, ErrAmbiguousReverseForward))
+
+	_, err = DialReverseForwardOnPort(1, operator)
+	assert.EqualString(t, err.Error(), "no reverse forward for port 1")
+}
+
+func TestForwardSurvivesPreviousOwnerDisconnecting(t *testing.T) {
+	freeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	port := uint32(freeListener.Addr().(*net.TCPAddr).Port)
+	assert.Ok(t, freeListener.Close())
+
+	// client that answers connections into its forward with its name
+	connect := func(name string) *sshtest.Pair {
+		pair := sshtest.Connect(t, "hp", nil)
+		go ssh.DiscardRequests(ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+		go func() {
+			for newChannel := range pair.Client.HandleChannelOpen("forwarded-tcpip") {
+				channel, reqs, err := newChannel.Accept()
+				assert.Ok(t, err)
+				go ssh.DiscardRequests(reqs)
+
+				_, _ = channel.Write([]byte(name))
+				channel.Close()
+			}
+		}()
+
+		return pair
+	}
+
+	forward := func(pair *sshtest.Pair, requestType string) bool {
+		ok, _, err := pair.Client.SendRequest(requestType, true, ssh.Marshal(&channelForwardMsg{
+			Addr:  "127.0.0.1",
+			Rport: port,
+		}))
+		assert.Ok(t, err)
+		return ok
+	}
+
+	visit := func() string {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		assert.Ok(t, err)
+		defer conn.Close()
+		assert.Ok(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		response, err := io.ReadAll(conn)
+		assert.Ok(t, err)
+		return string(response)
+	}
+
+	a := connect("a")
+	b := connect("b")
+
+	assert.Assert(t, forward(a, "tcpip-forward"))
+	assert.Assert(t, !forward(b, "tcpip-forward"))
+	assert.Assert(t, !forward(b, "cancel-tcpip-forward")) // not b's to cancel
+	assert.EqualString(t, visit(), "a")
+
+	assert.Assert(t, forward(a, "cancel-tcpip-forward"))
+
+	// a's listener is closed asynchronously after the cancel
+	granted := false
+	for i := 0; i < 50 && !granted; i++ {
+		granted = forward(b, "tcpip-forward")
+		if !granted {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	assert.Assert(t, granted)
+
+	assert.Ok(t, a.Client.Close())
+	_ = a.Server.Wait()
+
+	time.Sleep(50 * time.Millisecond) // a's goroutines see the disconnect
+
+	assert.EqualString(t, visit(), "b")
+	assert.Assert(t, HasReverseForward(port))
+}
+
+func TestServerChosenPortRefused(t *testing.T) {
+	pair := sshtest.Connect(t, "hp", nil)
+	go ssh.DiscardRequests(ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+	for _, requestType := range []string{"tcpip-forward", udpForwardRequestType} {
+		ok, _, err := pair.Client.SendRequest(requestType, true, ssh.Marshal(&channelForwardMsg{
+			Addr:  "127.0.0.1",
+			Rport: 0,
+		}))
+		assert.Ok(t, err)
+		assert.Assert(t, !ok)
+	}
+
+	assert.Assert(t, len(ReverseForwardsOf(sshidentity.Of(pair.Server))) == 0)
+}
@@ -1,5 +1,10 @@
 package sshserverportforward
 
+import (
+	"net"
+	"strconv"
+)
+
 // these structs copy-pasted from golang.org/x/crypto/ssh/tcpip.go
 // (couldn't link to them because they are private)
 
@@ -9,6 +14,10 @@ type channelForwardMsg struct {
 	Rport uint32
 }
 
+func (c channelForwardMsg) listenAddr() string {
+	return net.JoinHostPort(c.Addr, strconv.Itoa(int(c.Rport)))
+}
+
 // See RFC 4254, section 7.2
 type forwardedTCPPayload struct {
 	Addr       string
@@ -3,46 +3,155 @@ package sshserverportforward
 import (
 	"fmt"
 	"sync"
+
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
 )
 
 type forwardList struct {
 	sync.Mutex
-	reverseCancellations map[string]chan bool
+	reverseForwards map[string]*reverseForward
+}
+
+type reverseForward struct {
+	details    channelForwardMsg
+	serverConn *ssh.ServerConn
+	cancel     chan bool
 }
 
-func (f *forwardList) add(cfm channelForwardMsg) *chan bool {
+func (f *forwardList) add(cfm channelForwardMsg, serverConn *ssh.ServerConn) *chan bool {
 	f.Lock()
 	defer f.Unlock()
 
 	cancellationKey := toCancellationKey(cfm)
 
-	if _, exists := f.reverseCancellations[cancellationKey]; exists {
+	if _, exists := f.reverseForwards[cancellationKey]; exists {
 		return nil
 	}
 
 	cancelCh := make(chan bool, 1)
-	f.reverseCancellations[cancellationKey] = cancelCh
+	f.reverseForwards[cancellationKey] = &reverseForward{
+		details:    cfm,
+		serverConn: serverConn,
+		cancel:     cancelCh,
+	}
 
 	return &cancelCh
 }
 
-func (f *forwardList) cancel(cfm channelForwardMsg) bool {
+// for client's cancel requests: a client can only cancel its own forwards
+func (f *forwardList) cancelIfOwnedBy(cfm channelForwardMsg, owner *ssh.ServerConn) bool {
+	return f.cancelIf(cfm, func(fwd *reverseForward) bool { return fwd.serverConn == owner })
+}
+
+// for when a forward's listener fails or its connection ends. by then the address may have
+// been cancelled and granted again (to another client, or to the same one), and that forward
+// has to stay. cancel is the channel add() returned for the forward
+func (f *forwardList) cancelIfCurrent(cfm channelForwardMsg, cancel <-chan bool) bool {
+	return f.cancelIf(cfm, func(fwd *reverseForward) bool { return fwd.cancel == cancel })
+}
+
+func (f *forwardList) cancelIf(cfm channelForwardMsg, cancelThis func(*reverseForward) bool) bool {
 	f.Lock()
 	defer f.Unlock()
 
 	cancellationKey := toCancellationKey(cfm)
 
-	cancelCh, exists := f.reverseCancellations[cancellationKey]
-	if !exists {
+	fwd, exists := f.reverseForwards[cancellationKey]
+	if !exists || !cancelThis(fwd) {
 		return false
 	}
 
-	cancelCh <- true
-	delete(f.reverseCancellations, cancellationKey)
+	fwd.cancel <- true
+	delete(f.reverseForwards, cancellationKey)
 
 	return true
 }
 
+// finds reverse forward by the identity of the client that requested it, and its port
+func (f *forwardList) findByIdentityAndPort(identity string, port uint32) *reverseForward {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, fwd := range f.reverseForwards {
+		if fwd.details.Rport == port && sshidentity.Of(fwd.serverConn) == identity {
+			return fwd
+		}
+	}
+
+	return nil
+}
+
+// the port's forward(s) (e.g. 127.0.0.1 and ::1) must belong to the same connection, so that
+// we know which client to route to
+func (f *forwardList) findByPort(port uint32) (*reverseForward, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var found *reverseForward
+	for _, fwd := range f.reverseForwards {
+		if fwd.details.Rport != port {
+			continue
+		}
+
+		if found != nil && found.serverConn != fwd.serverConn {
+			return nil, fmt.Errorf("%w: %d", ErrAmbiguousReverseForward, port)
+		}
+
+		// deterministic pick when one client has several bind addresses for the port
+		if found == nil || fwd.details.Addr < found.details.Addr {
+			found = fwd
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%w for port %d", ErrNoReverseForward, port)
+	}
+
+	return found, nil
+}
+
+func (f *forwardList) byIdentity(identity string) []channelForwardMsg {
+	f.Lock()
+	defer f.Unlock()
+
+	forwards := []channelForwardMsg{}
+	for _, fwd := range f.reverseForwards {
+		if sshidentity.Of(fwd.serverConn) == identity {
+			forwards = append(forwards, fwd.details)
+		}
+	}
+
+	return forwards
+}
+
+func (f *forwardList) hasPort(port uint32) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, fwd := range f.reverseForwards {
+		if fwd.details.Rport == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *forwardList) countByUser(user string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	count := 0
+	for _, fwd := range f.reverseForwards {
+		if fwd.serverConn.User() == user {
+			count++
+		}
+	}
+
+	return count
+}
+
 func toCancellationKey(cfm channelForwardMsg) string {
 	return fmt.Sprintf("%s:%d", cfm.Addr, cfm.Rport)
 }
@@ -0,0 +1,76 @@
+package sshserverportforward
+
+import (
+	"io"
+	"sync"
+)
+
+// describes one forwarded connection, so interceptors can decide what to do with it
+type StreamInfo struct {
+	Identity string // client whose forward this is (see sshidentity)
+	User     string // SSH username of that client
+	Kind     string // "forwarded-tcpip" | "direct-tcpip" | "forwarded-udp" | "dial-through-client"
+	Addr     string // reverse forward's listen address or forward forward's destination
+	Port     uint32
+}
+
+// called before a connection is forwarded. returning an error refuses the connection.
+// otherwise the returned func wraps the client's side of the stream (reads = data from the
+// client, writes = data to the client), e.g. for traffic shaping or accounting.
+//
+// the returned func is always called. if the stream can't be set up after all (a later
+// interceptor refuses it or the client rejects the channel), it gets an empty stream that is
+// closed right away, so whatever was reserved for the stream can be released in Close().
+type StreamInterceptor func(stream StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error)
+
+var (
+	streamInterceptors   = []StreamInterceptor{}
+	streamInterceptorsMu sync.Mutex
+)
+
+// interceptors are run in the order they were added
+func AddStreamInterceptor(interceptor StreamInterceptor) {
+	streamInterceptorsMu.Lock()
+	defer streamInterceptorsMu.Unlock()
+
+	streamInterceptors = append(streamInterceptors, interceptor)
+}
+
+// returns func that applies all the interceptors' wrappers (or error if any interceptor refuses).
+// if the caller then fails to set up the stream, it must call abandonStream()
+func interceptStream(stream StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+	streamInterceptorsMu.Lock()
+	interceptors := append([]StreamInterceptor{}, streamInterceptors...)
+	streamInterceptorsMu.Unlock()
+
+	wrappers := []func(io.ReadWriteCloser) io.ReadWriteCloser{}
+	wrapAll := func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+		for _, wrap := range wrappers {
+			clientSide = wrap(clientSide)
+		}
+
+		return clientSide
+	}
+
+	for _, interceptor := range interceptors {
+		wrap, err := interceptor(stream)
+		if err != nil {
+			abandonStream(wrapAll) // interceptors before this one
+			return nil, err
+		}
+
+		wrappers = append(wrappers, wrap)
+	}
+
+	return wrapAll, nil
+}
+
+func abandonStream(wrap func(io.ReadWriteCloser) io.ReadWriteCloser) {
+	_ = wrap(abandonedStream{}).Close()
+}
+
+type abandonedStream struct{}
+
+func (abandonedStream) Read([]byte) (int, error)  { return 0, io.EOF }
+func (abandonedStream) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+func (abandonedStream) Close() error              { return nil }
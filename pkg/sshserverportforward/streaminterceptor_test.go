@@ -0,0 +1,53 @@
+package sshserverportforward
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+)
+
+func TestRefusedStreamIsAbandoned(t *testing.T) {
+	defer func(previous []StreamInterceptor) { streamInterceptors = previous }(streamInterceptors)
+
+	reserved := 0
+
+	streamInterceptors = []StreamInterceptor{
+		func(StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+			reserved++
+
+			return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+				return &releasingStream{ReadWriteCloser: clientSide, release: func() { reserved-- }}
+			}, nil
+		},
+		func(stream StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+			if stream.Port == 22 {
+				return nil, errors.New("port 22 refused")
+			}
+
+			return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser { return clientSide }, nil
+		},
+	}
+
+	_, err := interceptStream(StreamInfo{Port: 22})
+	assert.EqualString(t, err.Error(), "port 22 refused")
+	assert.Assert(t, reserved == 0)
+
+	// e.g. client rejected the channel
+	wrap, err := interceptStream(StreamInfo{Port: 80})
+	assert.Ok(t, err)
+	assert.Assert(t, reserved == 1)
+	abandonStream(wrap)
+	assert.Assert(t, reserved == 0)
+}
+
+type releasingStream struct {
+	io.ReadWriteCloser
+	release func()
+}
+
+func (r *releasingStream) Close() error {
+	r.release()
+	return r.ReadWriteCloser.Close()
+}
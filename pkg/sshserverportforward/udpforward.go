@@ -0,0 +1,407 @@
+package sshserverportforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/function61/holepunch-server/pkg/auditlog"
+	"github.com/function61/holepunch-server/pkg/sshidentity"
+	"golang.org/x/crypto/ssh"
+)
+
+// UDP reverse forwarding is not part of the SSH spec, so it's implemented with custom
+// (RFC 4250 "name@domain") request & channel types that mirror their TCP counterparts:
+//
+//   - global request "udp-forward@function61.com" (payload like "tcpip-forward") makes us bind a
+//     UDP port
+//   - for each source address sending datagrams to that port we open a
+//     "forwarded-udp@function61.com" channel (payload like "forwarded-tcpip") to the client
+//   - inside the channel datagrams are framed as <uint16 big endian length><payload>, in both
+//     directions
+//   - flows that have been idle for udpFlowIdleTimeout get their channel closed
+const (
+	udpForwardRequestType       = "udp-forward@function61.com"
+	udpCancelForwardRequestType = "cancel-udp-forward@function61.com"
+	udpForwardedChannelType     = "forwarded-udp@function61.com"
+)
+
+const (
+	udpFlowIdleTimeout = 60 * time.Second
+	udpFlowQueueLength = 64 // datagrams waiting for the client. more are dropped
+	maxDatagramSize    = 65535
+)
+
+// UDP ports are separate from TCP ports, so these get their own list
+var udpFwdList = &forwardList{
+	reverseForwards: map[string]*reverseForward{},
+}
+
+func processUdpForwardReq(req *ssh.Request, serverConn *ssh.ServerConn, fwdList *forwardList) {
+	var forwardingDetails channelForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &forwardingDetails); err != nil {
+		logl.Error.Println(err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", "", err.Error())
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	// there's no local UDP forward the client could be telling us about, so refuse outright
+	if !isReverseForwardBindAddr(forwardingDetails.Addr) {
+		logl.Error.Printf("UDP reverse forward %s: bind address not allowed", forwardingDetails.listenAddr())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", forwardingDetails.listenAddr(), "bind address not allowed")
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	if !sshidentity.ListenPermitted(serverConn, forwardingDetails.Addr, forwardingDetails.Rport) {
+		logl.Error.Printf("UDP reverse forward %s not permitted", forwardingDetails.listenAddr())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", forwardingDetails.listenAddr(), "not permitted")
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	forwardReq := ForwardRequest{
+		Conn: serverConn,
+		Kind: "udp-forward",
+		Addr: forwardingDetails.Addr,
+		Port: forwardingDetails.Rport,
+	}
+
+	if err := authorizeForward(forwardReq); err != nil {
+		logl.Error.Printf("UDP reverse forward %s refused: %s", forwardingDetails.listenAddr(), err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", forwardingDetails.listenAddr(), err.Error())
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	cancelCh, err := reserveForward(forwardReq, fwdList, forwardingDetails)
+	if err != nil {
+		logl.Error.Printf("UDP reverse forward %s refused: %s", forwardingDetails.listenAddr(), err.Error())
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", forwardingDetails.listenAddr(), err.Error())
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	go processOneUdpReverseRequest(
+		forwardingDetails,
+		req,
+		serverConn,
+		fwdList,
+		*cancelCh)
+}
+
+func processOneUdpReverseRequest(
+	forwardingDetails channelForwardMsg,
+	req *ssh.Request,
+	serverConn *ssh.ServerConn,
+	fwdList *forwardList,
+	cancel <-chan bool,
+) {
+	listenAddr := forwardingDetails.listenAddr()
+
+	logl.Info.Printf("Adding UDP reverse listener to %s", listenAddr)
+
+	packetConn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		logl.Error.Println(err.Error())
+		fwdList.cancelIfCurrent(forwardingDetails, cancel)
+		auditForward(auditlog.ReverseForwardRefused, serverConn, "udp", listenAddr, err.Error())
+		_ = req.Reply(false, nil)
+		return
+	}
+	defer logl.Info.Printf("Removed UDP reverse listener %s", listenAddr)
+	defer packetConn.Close()
+
+	flows := newUdpFlows(packetConn, serverConn, forwardingDetails)
+	defer flows.closeAll()
+
+	go func() {
+		if err := flows.receiveDatagrams(); err != nil {
+			logl.Error.Printf("ReadFrom() failed: %s", err.Error())
+			fwdList.cancelIfCurrent(forwardingDetails, cancel)
+		}
+	}()
+
+	// not given cancel, because only one receive gets fwdList.cancelIf*()'s signal
+	stopIdleCloser := make(chan struct{})
+	defer close(stopIdleCloser)
+
+	go flows.closeIdleFlows(stopIdleCloser)
+
+	go func() {
+		// returns when SSH connection exists
+		_ = serverConn.Wait()
+
+		fwdList.cancelIfCurrent(forwardingDetails, cancel)
+	}()
+
+	auditForward(auditlog.ReverseForwardGranted, serverConn, "udp", listenAddr, "")
+
+	_ = req.Reply(true, nil)
+
+	<-cancel
+}
+
+// datagrams from one source address are one flow, i.e. one SSH channel. each flow has its own
+// goroutine that opens the channel and writes into it, so a client that's slow to accept or read
+// the channel only holds up its own flow, not the whole port
+type udpFlow struct {
+	sourceAddr net.Addr
+	queue      chan []byte // datagrams waiting to be written into the channel
+	lastActive time.Time   // protected by udpFlows.mu
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+type udpFlows struct {
+	mu                sync.Mutex
+	flows             map[string]*udpFlow
+	closed            bool // after closeAll() no new flows are added
+	packetConn        net.PacketConn
+	serverConn        *ssh.ServerConn
+	forwardingDetails channelForwardMsg
+}
+
+func newUdpFlows(packetConn net.PacketConn, serverConn *ssh.ServerConn, forwardingDetails channelForwardMsg) *udpFlows {
+	return &udpFlows{
+		flows:             map[string]*udpFlow{},
+		packetConn:        packetConn,
+		serverConn:        serverConn,
+		forwardingDetails: forwardingDetails,
+	}
+}
+
+// returns error only if the listener fails
+func (u *udpFlows) receiveDatagrams() error {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, sourceAddr, err := u.packetConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		flow := u.flowFor(sourceAddr)
+		if flow == nil { // forward is being closed
+			continue
+		}
+
+		select {
+		case flow.queue <- append([]byte(nil), buf[:n]...):
+		default: // like a full socket buffer would
+			logl.Debug.Printf("UDP flow for %s: queue full, dropping datagram", sourceAddr.String())
+		}
+	}
+}
+
+// finds existing flow or starts a new one (nil if the forward is closed). counts as activity
+func (u *udpFlows) flowFor(sourceAddr net.Addr) *udpFlow {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil
+	}
+
+	flow, exists := u.flows[sourceAddr.String()]
+	if !exists {
+		flow = &udpFlow{
+			sourceAddr: sourceAddr,
+			queue:      make(chan []byte, udpFlowQueueLength),
+			closed:     make(chan struct{}),
+		}
+		u.flows[sourceAddr.String()] = flow
+
+		go u.runFlow(flow)
+	}
+
+	flow.lastActive = time.Now()
+
+	return flow
+}
+
+func (u *udpFlows) runFlow(flow *udpFlow) {
+	defer u.remove(flow)
+
+	channel, err := u.openChannel(flow.sourceAddr)
+	if err != nil {
+		logl.Error.Printf("UDP flow for %s: %s", flow.sourceAddr.String(), err.Error())
+		return
+	}
+
+	// also unblocks writes into the channel, and sendReplies()
+	go func() {
+		<-flow.closed
+		channel.Close()
+	}()
+
+	go func() {
+		defer flow.close()
+
+		if err := u.sendReplies(flow, channel); err != nil {
+			logl.Error.Printf("UDP flow for %s: %s", flow.sourceAddr.String(), err.Error())
+		}
+	}()
+
+	for {
+		select {
+		case <-flow.closed:
+			return
+		case datagram := <-flow.queue:
+			if err := writeDatagram(channel, datagram); err != nil {
+				logl.Error.Printf("UDP flow for %s: %s", flow.sourceAddr.String(), err.Error())
+				return
+			}
+		}
+	}
+}
+
+func (u *udpFlows) openChannel(sourceAddr net.Addr) (io.ReadWriteCloser, error) {
+	wrap, err := interceptStream(StreamInfo{
+		Identity: sshidentity.Of(u.serverConn),
+		User:     u.serverConn.User(),
+		Kind:     "forwarded-udp",
+		Addr:     u.forwardingDetails.Addr,
+		Port:     u.forwardingDetails.Rport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	originHost, originPort, err := splitHostPort(sourceAddr)
+	if err != nil {
+		abandonStream(wrap)
+		return nil, err
+	}
+
+	channel, reqs, err := u.serverConn.OpenChannel(udpForwardedChannelType, ssh.Marshal(&forwardedTCPPayload{
+		Addr:       u.forwardingDetails.Addr,
+		Port:       u.forwardingDetails.Rport,
+		OriginAddr: originHost,
+		OriginPort: originPort,
+	}))
+	if err != nil {
+		abandonStream(wrap)
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	return wrap(channel), nil
+}
+
+// datagrams from client (inside the channel) back to the source address
+func (u *udpFlows) sendReplies(flow *udpFlow, channel io.Reader) error {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		datagram, err := readDatagram(channel, buf)
+		if err != nil {
+			select {
+			case <-flow.closed: // we closed the channel
+				return nil
+			default:
+			}
+
+			if err == io.EOF { // client closed the flow
+				return nil
+			}
+
+			return err
+		}
+
+		u.mu.Lock()
+		flow.lastActive = time.Now()
+		u.mu.Unlock()
+
+		if _, err := u.packetConn.WriteTo(datagram, flow.sourceAddr); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *udpFlows) closeIdleFlows(stop <-chan struct{}) {
+	ticker := time.NewTicker(udpFlowIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			u.mu.Lock()
+			for key, flow := range u.flows {
+				if now.Sub(flow.lastActive) > udpFlowIdleTimeout {
+					flow.close()
+					delete(u.flows, key)
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+// flow is compared so we don't remove a newer flow (from the same source address) that replaced it
+func (u *udpFlows) remove(flow *udpFlow) {
+	flow.close()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.flows[flow.sourceAddr.String()] == flow {
+		delete(u.flows, flow.sourceAddr.String())
+	}
+}
+
+func (u *udpFlows) closeAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+
+	for key, flow := range u.flows {
+		flow.close()
+		delete(u.flows, key)
+	}
+}
+
+func writeDatagram(destination io.Writer, datagram []byte) error {
+	if len(datagram) > maxDatagramSize {
+		return errors.New("datagram too large")
+	}
+
+	// single Write() so the frame doesn't get interleaved
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+
+	_, err := destination.Write(frame)
+	return err
+}
+
+// buf must be at least maxDatagramSize long. returned datagram is a slice of buf
+func readDatagram(source io.Reader, buf []byte) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(source, header); err != nil {
+		return nil, err // io.EOF if stream ended cleanly between datagrams
+	}
+
+	datagram := buf[:binary.BigEndian.Uint16(header)]
+	if _, err := io.ReadFull(source, datagram); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return datagram, nil
+}
@@ -0,0 +1,183 @@
+package sshserverportforward
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	stream := &bytes.Buffer{}
+
+	assert.Ok(t, writeDatagram(stream, []byte("hello")))
+	assert.Ok(t, writeDatagram(stream, []byte{}))
+	assert.Ok(t, writeDatagram(stream, []byte("world")))
+
+	assert.Assert(t, bytes.Equal(stream.Bytes()[0:7], []byte{0, 5, 'h', 'e', 'l', 'l', 'o'}))
+
+	buf := make([]byte, maxDatagramSize)
+
+	readString := func() string {
+		datagram, err := readDatagram(stream, buf)
+		assert.Ok(t, err)
+		return string(datagram)
+	}
+
+	assert.EqualString(t, readString(), "hello")
+	assert.EqualString(t, readString(), "")
+	assert.EqualString(t, readString(), "world")
+
+	_, err := readDatagram(stream, buf)
+	assert.Assert(t, err == io.EOF)
+
+	_, err = readDatagram(bytes.NewBuffer([]byte{0, 5, 'h'}), buf)
+	assert.Assert(t, err == io.ErrUnexpectedEOF)
+}
+
+func TestUdpForwardCancelAndReRequest(t *testing.T) {
+	pair := sshtest.Connect(t, "joonas", nil)
+	go ssh.DiscardRequests(ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+	// client echoes datagrams back
+	go func() {
+		for newChannel := range pair.Client.HandleChannelOpen(udpForwardedChannelType) {
+			channel, reqs, err := newChannel.Accept()
+			assert.Ok(t, err)
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				_, _ = io.Copy(channel, channel)
+			}()
+		}
+	}()
+
+	port := freeUdpPort(t)
+
+	forward := func(requestType string, addr string) bool {
+		ok, _, err := pair.Client.SendRequest(requestType, true, ssh.Marshal(&channelForwardMsg{
+			Addr:  addr,
+			Rport: port,
+		}))
+		assert.Ok(t, err)
+		return ok
+	}
+
+	roundTrip := func() string {
+		t.Helper()
+
+		conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		assert.Ok(t, err)
+		defer conn.Close()
+		assert.Ok(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		_, err = conn.Write([]byte("ping"))
+		assert.Ok(t, err)
+
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		assert.Ok(t, err)
+		return string(buf[:n])
+	}
+
+	assert.Assert(t, !forward(udpForwardRequestType, "192.0.2.1"))
+
+	assert.Assert(t, forward(udpForwardRequestType, "127.0.0.1"))
+	assert.EqualString(t, roundTrip(), "ping")
+
+	assert.Assert(t, forward(udpCancelForwardRequestType, "127.0.0.1"))
+
+	// listener is closed asynchronously after the cancel
+	reGranted := false
+	for i := 0; i < 50 && !reGranted; i++ {
+		reGranted = forward(udpForwardRequestType, "127.0.0.1")
+		if !reGranted {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	assert.Assert(t, reGranted)
+	assert.EqualString(t, roundTrip(), "ping")
+}
+
+func freeUdpPort(t *testing.T) uint32 {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer conn.Close()
+
+	return uint32(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestSlowUdpFlowDoesntHoldUpOthers(t *testing.T) {
+	pair := sshtest.Connect(t, "joonas", nil)
+	go ssh.DiscardRequests(ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+	slowSource, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer slowSource.Close()
+	fastSource, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer fastSource.Close()
+
+	acceptSlow := make(chan struct{})
+
+	// client echoes datagrams back, but takes its time accepting slowSource's flow
+	go func() {
+		for newChannel := range pair.Client.HandleChannelOpen(udpForwardedChannelType) {
+			go func(newChannel ssh.NewChannel) {
+				msg := forwardedTCPPayload{}
+				assert.Ok(t, ssh.Unmarshal(newChannel.ExtraData(), &msg))
+				if int(msg.OriginPort) == slowSource.LocalAddr().(*net.UDPAddr).Port {
+					<-acceptSlow
+				}
+
+				channel, reqs, err := newChannel.Accept()
+				assert.Ok(t, err)
+				go ssh.DiscardRequests(reqs)
+
+				_, _ = io.Copy(channel, channel)
+			}(newChannel)
+		}
+	}()
+
+	port := freeUdpPort(t)
+
+	ok, _, err := pair.Client.SendRequest(udpForwardRequestType, true, ssh.Marshal(&channelForwardMsg{
+		Addr:  "127.0.0.1",
+		Rport: port,
+	}))
+	assert.Ok(t, err)
+	assert.Assert(t, ok)
+
+	forwardAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)}
+
+	send := func(source net.PacketConn, msg string) {
+		_, err := source.WriteTo([]byte(msg), forwardAddr)
+		assert.Ok(t, err)
+	}
+
+	receive := func(source net.PacketConn) string {
+		t.Helper()
+
+		assert.Ok(t, source.SetReadDeadline(time.Now().Add(5*time.Second)))
+		buf := make([]byte, 64)
+		n, _, err := source.ReadFrom(buf)
+		assert.Ok(t, err)
+		return string(buf[:n])
+	}
+
+	send(slowSource, "slow")
+	send(fastSource, "fast")
+	assert.EqualString(t, receive(fastSource), "fast")
+
+	// slow flow's datagram waited in its queue
+	close(acceptSlow)
+	assert.EqualString(t, receive(slowSource), "slow")
+}
@@ -2,6 +2,8 @@ package sshserverportforward
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -14,3 +16,29 @@ func RejectChannelRequests(channelRequests <-chan ssh.NewChannel) {
 		_ = channelRequest.Reject(ssh.Prohibited, fmt.Sprintf("channel type prohibited: %s", channelRequest.ChannelType()))
 	}
 }
+
+func splitHostPort(addr net.Addr) (string, uint32, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, uint32(port), nil
+}
+
+// reverse forwards are only bound for loopback or "all interfaces" addresses. for other
+// addresses the client is (per RFC) just telling us about its local forward
+func isReverseForwardBindAddr(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -0,0 +1,85 @@
+// helpers for tests that need a real SSH connection
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// both ends of an authenticated SSH connection. server's channels & requests are left for the
+// test to process
+type Pair struct {
+	Server         *ssh.ServerConn
+	ServerChannels <-chan ssh.NewChannel
+	ServerRequests <-chan *ssh.Request
+	Client         *ssh.Client
+}
+
+// connects as user. permissions are what the server's auth callback would have given (can be nil).
+// both ends are closed when the test ends.
+func Connect(t *testing.T, user string, permissions *ssh.Permissions) *Pair {
+	t.Helper()
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return permissions, nil
+		},
+	}
+	serverConfig.AddHostKey(NewSigner(t))
+
+	// not net.Pipe(), because both ends write their version banner before reading
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	pair := &Pair{}
+	serverErr := make(chan error, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+
+		pair.Server, pair.ServerChannels, pair.ServerRequests, err = ssh.NewServerConn(conn, serverConfig)
+		serverErr <- err
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Ok(t, err)
+
+	sshClientConn, clientChannels, clientRequests, err := ssh.NewClientConn(clientConn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(NewSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Ok(t, err)
+	assert.Ok(t, <-serverErr)
+
+	pair.Client = ssh.NewClient(sshClientConn, clientChannels, clientRequests)
+
+	t.Cleanup(func() {
+		pair.Client.Close()
+		pair.Server.Close()
+	})
+
+	return pair
+}
+
+func NewSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Ok(t, err)
+
+	return signer
+}
@@ -0,0 +1,222 @@
+// lets several tenants (e.g. teams) share one server without colliding with or reaching into
+// each other's forwards. a client's tenant is decided by its SSH username.
+//
+// each tenant has a pool of ports that only its clients may reverse forward, and that only it
+// can reach (with "direct-tcpip" or through the reverse proxy with its hostname suffix). clients
+// that don't belong to any tenant can't touch any tenant's ports either.
+package tenancy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/function61/holepunch-server/pkg/portrange"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+)
+
+type Tenant struct {
+	Name  string   `json:"name"`
+	Users []string `json:"users"` // SSH usernames whose clients belong to this tenant
+	// port pool for reverse forwards, e.g. "20000-20999" or "8000,8080-8089"
+	Ports string `json:"ports"`
+	// for the reverse proxies: "<port><suffix>" reaches the tenant's port, e.g. ".team-a.punch.example.com"
+	HostnameSuffix string `json:"hostname_suffix"`
+	MaxForwards    int    `json:"max_forwards"`    // concurrent reverse forwards, 0 = unlimited
+	MaxConnections int    `json:"max_connections"` // concurrent forwarded connections, 0 = unlimited
+}
+
+type tenant struct {
+	Tenant
+	ports portrange.List
+
+	connectionsMu sync.Mutex
+	connections   int
+}
+
+func (t *tenant) hasPort(port uint32) bool {
+	return t.ports.Contains(port)
+}
+
+type Tenants struct {
+	tenants []*tenant
+	byUser  map[string]*tenant
+}
+
+func New(tenantsConf []Tenant) (*Tenants, error) {
+	t := &Tenants{
+		tenants: []*tenant{},
+		byUser:  map[string]*tenant{},
+	}
+
+	for _, conf := range tenantsConf {
+		if conf.Name == "" || len(conf.Users) == 0 || conf.Ports == "" {
+			return nil, errors.New("tenant: name, users and ports required")
+		}
+
+		ports, err := portrange.Parse(conf.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", conf.Name, err)
+		}
+
+		if conf.HostnameSuffix != "" && !strings.HasPrefix(conf.HostnameSuffix, ".") {
+			return nil, fmt.Errorf("tenant %s: hostname_suffix must start with '.'", conf.Name)
+		}
+
+		current := &tenant{Tenant: conf, ports: ports}
+
+		for _, other := range t.tenants {
+			if ports.Overlaps(other.ports) {
+				return nil, fmt.Errorf("tenant %s: ports overlap with tenant %s", conf.Name, other.Name)
+			}
+
+			if conf.HostnameSuffix != "" && strings.EqualFold(conf.HostnameSuffix, other.HostnameSuffix) {
+				return nil, fmt.Errorf("tenant %s: hostname_suffix same as tenant %s's", conf.Name, other.Name)
+			}
+		}
+
+		for _, user := range conf.Users {
+			if other, taken := t.byUser[user]; taken {
+				return nil, fmt.Errorf("tenant %s: user %s already belongs to tenant %s", conf.Name, user, other.Name)
+			}
+
+			t.byUser[user] = current
+		}
+
+		t.tenants = append(t.tenants, current)
+	}
+
+	return t, nil
+}
+
+// for sshserverportforward.AddForwardAuthorizer()
+func (t *Tenants) AuthorizeForward(req sshserverportforward.ForwardRequest) error {
+	own := t.byUser[req.Conn.User()]
+
+	// destination can be anywhere, as long as it's not someone else's reverse forward
+	if req.Kind == "direct-tcpip" {
+		if owner := t.ownerOfPort(req.Port); owner != nil && owner != own {
+			return fmt.Errorf("port %d belongs to tenant %s", req.Port, owner.Name)
+		}
+
+		return nil
+	}
+
+	return t.checkPort(own, req.Port)
+}
+
+// sshserverportforward.SetForwardLimiter(). enforces MaxForwards
+func (t *Tenants) LimitForwards(req sshserverportforward.ForwardRequest) error {
+	own := t.byUser[req.Conn.User()]
+	if own == nil || own.MaxForwards == 0 {
+		return nil
+	}
+
+	forwards := 0
+	for _, user := range own.Users {
+		forwards += sshserverportforward.ReverseForwardCountOfUser(user)
+	}
+
+	if forwards >= own.MaxForwards {
+		return fmt.Errorf("tenant %s: max forwards (%d) reached", own.Name, own.MaxForwards)
+	}
+
+	return nil
+}
+
+// sshserverportforward.StreamInterceptor. limits concurrent connections of a tenant
+func (t *Tenants) Intercept(stream sshserverportforward.StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+	own := t.byUser[stream.User]
+	if own == nil || own.MaxConnections == 0 {
+		return passthrough, nil
+	}
+
+	// slot is reserved right away, so concurrent opens can't exceed the limit. if the stream
+	// isn't set up after all, we get an already closed stream, which releases it
+	own.connectionsMu.Lock()
+	defer own.connectionsMu.Unlock()
+
+	if own.connections >= own.MaxConnections {
+		return nil, fmt.Errorf("tenant %s: max connections (%d) reached", own.Name, own.MaxConnections)
+	}
+
+	own.connections++
+
+	return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+		return &countedStream{ReadWriteCloser: clientSide, tenant: own}
+	}, nil
+}
+
+// for the reverse proxy & SNI proxy. virtualHost is like "8080.team-a.punch.example.com[:80]", port is
+// the one parsed from it
+func (t *Tenants) VirtualHostAllowed(virtualHost string, port int) error {
+	host := strings.ToLower(virtualHost)
+	if idx := strings.LastIndex(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+
+	// strip the port label
+	suffix := host
+	if idx := strings.Index(host, "."); idx != -1 {
+		suffix = host[idx:]
+	}
+
+	var own *tenant
+	for _, tenant := range t.tenants {
+		if tenant.HostnameSuffix != "" && strings.EqualFold(tenant.HostnameSuffix, suffix) {
+			own = tenant
+			break
+		}
+	}
+
+	return t.checkPort(own, uint32(port))
+}
+
+// own is nil for clients / hostnames that don't belong to any tenant
+func (t *Tenants) checkPort(own *tenant, port uint32) error {
+	if own != nil {
+		if !own.hasPort(port) {
+			return fmt.Errorf("port %d not in tenant %s's pool", port, own.Name)
+		}
+
+		return nil
+	}
+
+	if owner := t.ownerOfPort(port); owner != nil {
+		return fmt.Errorf("port %d belongs to tenant %s", port, owner.Name)
+	}
+
+	return nil
+}
+
+func (t *Tenants) ownerOfPort(port uint32) *tenant {
+	for _, tenant := range t.tenants {
+		if tenant.hasPort(port) {
+			return tenant
+		}
+	}
+
+	return nil
+}
+
+type countedStream struct {
+	io.ReadWriteCloser
+	tenant *tenant
+	once   sync.Once
+}
+
+func (c *countedStream) Close() error {
+	c.once.Do(func() {
+		c.tenant.connectionsMu.Lock()
+		c.tenant.connections--
+		c.tenant.connectionsMu.Unlock()
+	})
+
+	return c.ReadWriteCloser.Close()
+}
+
+func passthrough(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+	return clientSide
+}
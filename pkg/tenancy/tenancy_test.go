@@ -0,0 +1,243 @@
+package tenancy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"github.com/function61/holepunch-server/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIsolation(t *testing.T) {
+	tenants, err := New([]Tenant{
+		{Name: "team-a", Users: []string{"team-a"}, Ports: "20000-20099", HostnameSuffix: ".a.punch.example.com"},
+		{Name: "team-b", Users: []string{"team-b", "team-b-ci"}, Ports: "20100-20199,21000", HostnameSuffix: ".b.punch.example.com"},
+	})
+	assert.Ok(t, err)
+
+	forward := func(user string, kind string, port uint32) string {
+		return errStr(tenants.AuthorizeForward(sshserverportforward.ForwardRequest{
+			Conn: &ssh.ServerConn{Conn: &fakeConn{user: user}},
+			Kind: kind,
+			Addr: "localhost",
+			Port: port,
+		}))
+	}
+
+	assert.EqualString(t, forward("team-a", "tcpip-forward", 20000), "")
+	assert.EqualString(t, forward("team-a", "tcpip-forward", 20100), "port 20100 not in tenant team-a's pool")
+	assert.EqualString(t, forward("team-b-ci", "udp-forward", 21000), "")
+	assert.EqualString(t, forward("hp", "tcpip-forward", 8080), "")
+	assert.EqualString(t, forward("hp", "tcpip-forward", 20000), "port 20000 belongs to tenant team-a")
+
+	assert.EqualString(t, forward("team-a", "direct-tcpip", 443), "")
+	assert.EqualString(t, forward("team-a", "direct-tcpip", 20001), "")
+	assert.EqualString(t, forward("team-a", "direct-tcpip", 20101), "port 20101 belongs to tenant team-b")
+	assert.EqualString(t, forward("hp", "direct-tcpip", 20001), "port 20001 belongs to tenant team-a")
+
+	assert.EqualString(t, errStr(tenants.VirtualHostAllowed("20000.a.punch.example.com", 20000)), "")
+	assert.EqualString(t, errStr(tenants.VirtualHostAllowed("20000.A.punch.example.com:80", 20000)), "")
+	assert.EqualString(t, errStr(tenants.VirtualHostAllowed("20100.a.punch.example.com", 20100)), "port 20100 not in tenant team-a's pool")
+	assert.EqualString(t, errStr(tenants.VirtualHostAllowed("20100.punch.example.com", 20100)), "port 20100 belongs to tenant team-b")
+	assert.EqualString(t, errStr(tenants.VirtualHostAllowed("8081.punch.example.com", 8081)), "")
+}
+
+func TestMaxConnections(t *testing.T) {
+	tenants, err := New([]Tenant{
+		{Name: "team-a", Users: []string{"team-a"}, Ports: "20000-20099", MaxConnections: 1},
+	})
+	assert.Ok(t, err)
+
+	stream := sshserverportforward.StreamInfo{User: "team-a", Kind: "forwarded-tcpip", Port: 20000}
+
+	wrap, err := tenants.Intercept(stream)
+	assert.Ok(t, err)
+	first := wrap(nopStream{})
+
+	_, err = tenants.Intercept(stream)
+	assert.EqualString(t, err.Error(), "tenant team-a: max connections (1) reached")
+
+	// closing twice doesn't free up two slots
+	assert.Ok(t, first.Close())
+	assert.Ok(t, first.Close())
+
+	wrap, err = tenants.Intercept(stream)
+	assert.Ok(t, err)
+	_ = wrap(nopStream{})
+
+	_, err = tenants.Intercept(stream)
+	assert.Assert(t, err != nil)
+
+	// other users are not limited
+	_, err = tenants.Intercept(sshserverportforward.StreamInfo{User: "hp"})
+	assert.Ok(t, err)
+}
+
+func TestMaxConnectionsConcurrently(t *testing.T) {
+	tenants, err := New([]Tenant{
+		{Name: "team-a", Users: []string{"team-a"}, Ports: "20000-20099", MaxConnections: 5},
+	})
+	assert.Ok(t, err)
+
+	stream := sshserverportforward.StreamInfo{User: "team-a", Kind: "forwarded-tcpip", Port: 20000}
+
+	granted := make(chan func(io.ReadWriteCloser) io.ReadWriteCloser, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// slot is taken before the stream is wrapped
+			if wrap, err := tenants.Intercept(stream); err == nil {
+				granted <- wrap
+			}
+		}()
+	}
+	wg.Wait()
+	close(granted)
+
+	wraps := []func(io.ReadWriteCloser) io.ReadWriteCloser{}
+	for wrap := range granted {
+		wraps = append(wraps, wrap)
+	}
+	assert.Assert(t, len(wraps) == 5)
+
+	// a stream that wasn't set up after all (sshserverportforward gives the wrapper a closed one)
+	assert.Ok(t, wraps[0](nopStream{}).Close())
+
+	_, err = tenants.Intercept(stream)
+	assert.Ok(t, err)
+}
+
+func TestMaxForwardsConcurrently(t *testing.T) {
+	tenants, err := New([]Tenant{
+		{Name: "team-a", Users: []string{"team-a", "team-a-ci"}, Ports: "1-65535", MaxForwards: 3},
+	})
+	assert.Ok(t, err)
+
+	sshserverportforward.SetForwardLimiter(tenants.LimitForwards)
+	defer sshserverportforward.SetForwardLimiter(nil)
+
+	pairs := []*sshtest.Pair{
+		sshtest.Connect(t, "team-a", nil),
+		sshtest.Connect(t, "team-a-ci", nil),
+	}
+
+	granted := make(chan bool, 10)
+	wg := sync.WaitGroup{}
+	for _, pair := range pairs {
+		go ssh.DiscardRequests(sshserverportforward.ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+
+		for i := 0; i < 5; i++ {
+			port := freePort(t)
+
+			wg.Add(1)
+			go func(pair *sshtest.Pair) {
+				defer wg.Done()
+
+				ok, _, err := pair.Client.SendRequest("tcpip-forward", true, ssh.Marshal(&struct {
+					Addr  string
+					Rport uint32
+				}{"127.0.0.1", port}))
+				assert.Ok(t, err)
+				granted <- ok
+			}(pair)
+		}
+	}
+	wg.Wait()
+	close(granted)
+
+	grantedCount := 0
+	for ok := range granted {
+		if ok {
+			grantedCount++
+		}
+	}
+	assert.Assert(t, grantedCount == 3)
+}
+
+func TestCancelOnlyOwnForwards(t *testing.T) {
+	teamA := sshtest.Connect(t, "team-a", nil)
+	teamB := sshtest.Connect(t, "team-b", nil)
+
+	for _, pair := range []*sshtest.Pair{teamA, teamB} {
+		go ssh.DiscardRequests(sshserverportforward.ProcessPortForwardRequests(pair.ServerRequests, pair.Server))
+	}
+
+	port := freePort(t)
+
+	request := func(pair *sshtest.Pair, requestType string) bool {
+		ok, _, err := pair.Client.SendRequest(requestType, true, ssh.Marshal(&struct {
+			Addr  string
+			Rport uint32
+		}{"127.0.0.1", port}))
+		assert.Ok(t, err)
+		return ok
+	}
+
+	assert.Assert(t, request(teamA, "tcpip-forward"))
+
+	assert.Assert(t, !request(teamB, "cancel-tcpip-forward"))
+	assert.Assert(t, sshserverportforward.HasReverseForward(port))
+
+	assert.Assert(t, request(teamA, "cancel-tcpip-forward"))
+	assert.Assert(t, !sshserverportforward.HasReverseForward(port))
+}
+
+func TestConfigValidation(t *testing.T) {
+	newErr := func(tenants ...Tenant) string {
+		_, err := New(tenants)
+		return errStr(err)
+	}
+
+	assert.EqualString(t, newErr(
+		Tenant{Name: "a", Users: []string{"a"}, Ports: "20000-20099"},
+		Tenant{Name: "b", Users: []string{"b"}, Ports: "19000-20000"},
+	), "tenant b: ports overlap with tenant a")
+	assert.EqualString(t, newErr(
+		Tenant{Name: "a", Users: []string{"a"}, Ports: "20000"},
+		Tenant{Name: "b", Users: []string{"a"}, Ports: "20001"},
+	), "tenant b: user a already belongs to tenant a")
+	assert.EqualString(t, newErr(
+		Tenant{Name: "a", Users: []string{"a"}, Ports: "20099-20000"},
+	), "tenant a: invalid ports: 20099-20000")
+	assert.EqualString(t, newErr(
+		Tenant{Name: "a", Users: []string{"a"}, Ports: "20000", HostnameSuffix: "a.example.com"},
+	), "tenant a: hostname_suffix must start with '.'")
+}
+
+func freePort(t *testing.T) uint32 {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func errStr(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return ""
+}
+
+type fakeConn struct {
+	ssh.Conn
+	user string
+}
+
+func (f *fakeConn) User() string { return f.user }
+
+type nopStream struct {
+	io.ReadWriter
+}
+
+func (n nopStream) Close() error { return nil }
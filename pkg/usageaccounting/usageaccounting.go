@@ -0,0 +1,502 @@
+// counts bytes & connections of forwarded connections per client and per forward, persists the
+// counts to a local file and enforces daily/monthly quotas (also on connections that are already
+// open). plugs into sshserverportforward as a stream interceptor.
+//
+// directions are from the client's (= device's) point of view: "in" is data the client sends to
+// us, "out" is data we send to the client.
+package usageaccounting
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/gokit/encoding/jsonfile"
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+	"golang.org/x/time/rate"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+
+	defaultRetentionDays = 400 // a year of monthly reports, and then some
+)
+
+type Quota struct {
+	Identity string `json:"identity"`  // "*" matches all clients (each still has their own quota)
+	Period   string `json:"period"`    // "day" | "month" (UTC)
+	MaxBytes int64  `json:"max_bytes"` // in + out
+	// "refuse" (new connections are refused, open ones are closed) | "throttle" (traffic is
+	// limited to throttle_bytes_per_second in both directions)
+	Action                 string `json:"action"`
+	ThrottleBytesPerSecond int    `json:"throttle_bytes_per_second"`
+}
+
+func (q Quota) validate() error {
+	if q.Period != "day" && q.Period != "month" {
+		return fmt.Errorf("quota for %s: unsupported period '%s'", q.Identity, q.Period)
+	}
+
+	switch q.Action {
+	case "refuse":
+		return nil
+	case "throttle":
+		if q.ThrottleBytesPerSecond <= 0 {
+			return fmt.Errorf("quota for %s: throttle_bytes_per_second required", q.Identity)
+		}
+		return nil
+	default:
+		return fmt.Errorf("quota for %s: unsupported action '%s'", q.Identity, q.Action)
+	}
+}
+
+func (q Quota) exceededErr() error {
+	return fmt.Errorf("%s quota of %d bytes exceeded", q.Period, q.MaxBytes)
+}
+
+// usage of one forward of one client for one day
+type Usage struct {
+	Identity    string `json:"identity"`
+	Kind        string `json:"kind"` // sshserverportforward.StreamInfo.Kind, e.g. "forwarded-tcpip"
+	Port        uint32 `json:"port"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int64  `json:"connections"`
+}
+
+// same port can be e.g. a TCP & an UDP forward, or a reverse forward & a "direct-tcpip" destination
+type usageKey struct {
+	identity string
+	kind     string
+	port     uint32
+}
+
+// a "throttle" quota's limiter is shared by the client's streams, so more connections don't mean
+// more bandwidth
+type throttleKey struct {
+	identity string
+	quota    *Quota
+}
+
+// persisted format
+type storeFile struct {
+	Days map[string][]Usage `json:"days"` // key is day ("2006-01-02")
+}
+
+type Accountant struct {
+	storePath string // empty = don't persist
+	quotas    []Quota
+	mu        sync.Mutex
+	days      map[string]map[usageKey]*Usage
+	throttles map[throttleKey]*rate.Limiter
+	now       func() time.Time
+	logl      *logex.Leveled
+
+	flushInterval time.Duration
+	retentionDays int // days kept before the current month (which monthly quotas need)
+}
+
+// storePath can be empty if you don't want usage persisted across restarts. usage older than
+// retentionDays (counted from the start of the current month) is dropped, 0 = default (400)
+func New(storePath string, retentionDays int, quotas []Quota, logger *log.Logger) (*Accountant, error) {
+	if retentionDays < 0 {
+		return nil, errors.New("usage retention days can't be negative")
+	}
+
+	for _, quota := range quotas {
+		if err := quota.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	a := &Accountant{
+		storePath: storePath,
+		quotas:    quotas,
+		days:      map[string]map[usageKey]*Usage{},
+		throttles: map[throttleKey]*rate.Limiter{},
+		now:       func() time.Time { return time.Now().UTC() },
+		logl:      logex.Levels(logger),
+
+		flushInterval: 30 * time.Second,
+		retentionDays: cmp.Or(retentionDays, defaultRetentionDays),
+	}
+
+	if storePath != "" {
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// persists usage periodically and on stop. a failed periodic write (e.g. disk full) is retried on
+// the next round, as counting goes on in memory
+func (a *Accountant) Run(ctx context.Context) error {
+	if a.storePath == "" {
+		<-ctx.Done()
+		return nil
+	}
+
+	flushInterval := time.NewTicker(a.flushInterval)
+	defer flushInterval.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return a.flush()
+		case <-flushInterval.C:
+			if err := a.flush(); err != nil {
+				a.logl.Error.Printf("persisting usage: %v", err)
+			}
+		}
+	}
+}
+
+// sshserverportforward.StreamInterceptor
+func (a *Accountant) Intercept(stream sshserverportforward.StreamInfo) (func(io.ReadWriteCloser) io.ReadWriteCloser, error) {
+	if quota := a.exceededQuota(stream.Identity, "refuse"); quota != nil {
+		return nil, quota.exceededErr()
+	}
+
+	key := usageKey{stream.Identity, stream.Kind, stream.Port}
+
+	a.add(key, func(usage *Usage) { usage.Connections++ })
+
+	return func(clientSide io.ReadWriteCloser) io.ReadWriteCloser {
+		return &countedStream{
+			ReadWriteCloser: clientSide,
+			accountant:      a,
+			key:             key,
+		}
+	}, nil
+}
+
+// usage for a day ("2006-01-02") or month ("2006-01"), summed per client & forward
+func (a *Accountant) Usage(period string) ([]Usage, error) {
+	days, err := a.daysOfPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sums := map[usageKey]*Usage{}
+	for _, day := range days {
+		for key, usage := range a.days[day] {
+			sum, found := sums[key]
+			if !found {
+				sum = &Usage{Identity: key.identity, Kind: key.kind, Port: key.port}
+				sums[key] = sum
+			}
+
+			sum.BytesIn += usage.BytesIn
+			sum.BytesOut += usage.BytesOut
+			sum.Connections += usage.Connections
+		}
+	}
+
+	report := []Usage{}
+	for _, sum := range sums {
+		report = append(report, *sum)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Identity != report[j].Identity {
+			return report[i].Identity < report[j].Identity
+		}
+		if report[i].Kind != report[j].Kind {
+			return report[i].Kind < report[j].Kind
+		}
+		return report[i].Port < report[j].Port
+	})
+
+	return report, nil
+}
+
+func WriteCsv(output io.Writer, usages []Usage) error {
+	csvWriter := csv.NewWriter(output)
+
+	if err := csvWriter.Write([]string{"identity", "kind", "port", "bytes_in", "bytes_out", "connections"}); err != nil {
+		return err
+	}
+
+	for _, usage := range usages {
+		if err := csvWriter.Write([]string{
+			usage.Identity,
+			usage.Kind,
+			strconv.Itoa(int(usage.Port)),
+			strconv.FormatInt(usage.BytesIn, 10),
+			strconv.FormatInt(usage.BytesOut, 10),
+			strconv.FormatInt(usage.Connections, 10),
+		}); err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+func (a *Accountant) add(key usageKey, update func(*Usage)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	day := a.now().Format(dayFormat)
+
+	usages, found := a.days[day]
+	if !found {
+		usages = map[usageKey]*Usage{}
+		a.days[day] = usages
+
+		a.pruneDays()
+	}
+
+	usage, found := usages[key]
+	if !found {
+		usage = &Usage{Identity: key.identity, Kind: key.kind, Port: key.port}
+		usages[key] = usage
+	}
+
+	update(usage)
+}
+
+// returns first quota with given action that the client has exceeded (or nil)
+func (a *Accountant) exceededQuota(identity string, action string) *Quota {
+	for i, quota := range a.quotas {
+		if quota.Action != action || (quota.Identity != "*" && quota.Identity != identity) {
+			continue
+		}
+
+		if a.bytesInCurrentPeriod(identity, quota.Period) >= quota.MaxBytes {
+			return &a.quotas[i]
+		}
+	}
+
+	return nil
+}
+
+// limiter of the client's exceeded "throttle" quota (nil if none), shared by the client's streams
+func (a *Accountant) throttleFor(identity string, quota *Quota) *rate.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if quota == nil { // e.g. a new period began. the streams drop their limiters too
+		for key := range a.throttles {
+			if key.identity == identity {
+				delete(a.throttles, key)
+			}
+		}
+
+		return nil
+	}
+
+	key := throttleKey{identity, quota}
+
+	throttle, found := a.throttles[key]
+	if !found {
+		throttle = rate.NewLimiter(rate.Limit(quota.ThrottleBytesPerSecond), quota.ThrottleBytesPerSecond)
+		a.throttles[key] = throttle
+	}
+
+	return throttle
+}
+
+func (a *Accountant) bytesInCurrentPeriod(identity string, period string) int64 {
+	now := a.now()
+
+	days := []string{now.Format(dayFormat)}
+	if period == "month" {
+		days = []string{}
+		for dayOfMonth := 1; dayOfMonth <= now.Day(); dayOfMonth++ {
+			days = append(days, time.Date(now.Year(), now.Month(), dayOfMonth, 0, 0, 0, 0, time.UTC).Format(dayFormat))
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bytes := int64(0)
+	for _, day := range days {
+		for key, usage := range a.days[day] {
+			if key.identity == identity {
+				bytes += usage.BytesIn + usage.BytesOut
+			}
+		}
+	}
+
+	return bytes
+}
+
+// called when a day begins, with mu held
+func (a *Accountant) pruneDays() {
+	now := a.now()
+
+	oldestKept := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -a.retentionDays).Format(dayFormat)
+
+	for day := range a.days {
+		if day < oldestKept { // day format sorts chronologically
+			delete(a.days, day)
+		}
+	}
+}
+
+func (a *Accountant) daysOfPeriod(period string) ([]string, error) {
+	if _, err := time.Parse(dayFormat, period); err == nil {
+		return []string{period}, nil
+	}
+
+	if _, err := time.Parse(monthFormat, period); err != nil {
+		return nil, errors.New("period must be day (2006-01-02) or month (2006-01)")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	days := []string{}
+	for day := range a.days {
+		if strings.HasPrefix(day, period+"-") {
+			days = append(days, day)
+		}
+	}
+
+	return days, nil
+}
+
+func (a *Accountant) load() error {
+	file := storeFile{}
+	if err := jsonfile.ReadDisallowUnknownFields(a.storePath, &file); err != nil {
+		if os.IsNotExist(err) { // first start
+			return nil
+		}
+
+		return err
+	}
+
+	for day, usages := range file.Days {
+		a.days[day] = map[usageKey]*Usage{}
+
+		for _, usage := range usages {
+			usage := usage
+			a.days[day][usageKey{usage.Identity, usage.Kind, usage.Port}] = &usage
+		}
+	}
+
+	return nil
+}
+
+func (a *Accountant) flush() error {
+	a.mu.Lock()
+	file := storeFile{Days: map[string][]Usage{}}
+	for day, usages := range a.days {
+		for _, usage := range usages {
+			file.Days[day] = append(file.Days[day], *usage)
+		}
+	}
+	a.mu.Unlock()
+
+	return jsonfile.Write(a.storePath, file)
+}
+
+type countedStream struct {
+	io.ReadWriteCloser
+	accountant *Accountant
+	key        usageKey
+
+	quotaMu        sync.Mutex
+	throttle       *rate.Limiter // non-nil when over a "throttle" quota. shared with client's other streams
+	refused        error         // non-nil once over a "refuse" quota
+	quotaCheckedAt time.Time
+}
+
+func (c *countedStream) Read(p []byte) (int, error) {
+	throttle, err := c.quotaState()
+	if err != nil {
+		return 0, err
+	}
+
+	if throttle != nil && len(p) > throttle.Burst() {
+		p = p[:throttle.Burst()]
+	}
+
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.accountant.add(c.key, func(usage *Usage) { usage.BytesIn += int64(n) })
+
+		if throttle != nil {
+			_ = throttle.WaitN(context.Background(), n)
+		}
+	}
+
+	return n, err
+}
+
+func (c *countedStream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		throttle, err := c.quotaState()
+		if err != nil {
+			return written, err
+		}
+
+		chunk := p
+		if throttle != nil {
+			if len(chunk) > throttle.Burst() {
+				chunk = chunk[:throttle.Burst()]
+			}
+
+			_ = throttle.WaitN(context.Background(), len(chunk))
+		}
+
+		n, err := c.ReadWriteCloser.Write(chunk)
+		written += n
+		c.accountant.add(c.key, func(usage *Usage) { usage.BytesOut += int64(n) })
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// open connections are held to quotas too: over a "refuse" quota the next Read()/Write() fails
+// (which makes the proxying close the connection). quota state is re-checked at most once a
+// second, so we don't sum usages on each Read()/Write()
+func (c *countedStream) quotaState() (*rate.Limiter, error) {
+	c.quotaMu.Lock()
+	defer c.quotaMu.Unlock()
+
+	now := c.accountant.now()
+
+	if c.refused != nil || now.Sub(c.quotaCheckedAt) < time.Second {
+		return c.throttle, c.refused
+	}
+
+	c.quotaCheckedAt = now
+
+	if quota := c.accountant.exceededQuota(c.key.identity, "refuse"); quota != nil {
+		c.refused = quota.exceededErr()
+		return nil, c.refused
+	}
+
+	c.throttle = c.accountant.throttleFor(c.key.identity, c.accountant.exceededQuota(c.key.identity, "throttle"))
+
+	return c.throttle, nil
+}
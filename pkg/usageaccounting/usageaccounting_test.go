@@ -0,0 +1,287 @@
+package usageaccounting
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/log/logex"
+	"github.com/function61/gokit/testing/assert"
+	"github.com/function61/holepunch-server/pkg/sshserverportforward"
+)
+
+func TestQuotaAndReports(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "usageaccounting")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	storePath := filepath.Join(tempDir, "usage.json")
+
+	accountant, err := New(storePath, 0, []Quota{
+		{Identity: "*", Period: "day", MaxBytes: 100, Action: "refuse"},
+	}, logex.Discard)
+	assert.Ok(t, err)
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	accountant.now = func() time.Time { return now }
+
+	camera := sshserverportforward.StreamInfo{Identity: "camera", Kind: "forwarded-tcpip", Port: 8080}
+	cameraUdp := sshserverportforward.StreamInfo{Identity: "camera", Kind: "forwarded-udp", Port: 8080}
+
+	wrap, err := accountant.Intercept(camera)
+	assert.Ok(t, err)
+
+	stream := wrap(&fakeStream{bytes.NewBuffer(make([]byte, 60)), &bytes.Buffer{}})
+	_, _ = ioutil.ReadAll(stream)
+	_, err = stream.Write(make([]byte, 30))
+	assert.Ok(t, err)
+
+	wrap, err = accountant.Intercept(cameraUdp)
+	assert.Ok(t, err)
+	_, err = wrap(&fakeStream{&bytes.Buffer{}, &bytes.Buffer{}}).Write(make([]byte, 10))
+	assert.Ok(t, err)
+
+	_, err = accountant.Intercept(camera)
+	assert.EqualString(t, err.Error(), "day quota of 100 bytes exceeded")
+
+	// next day quota is available again
+	now = now.Add(24 * time.Hour)
+
+	_, err = accountant.Intercept(camera)
+	assert.Ok(t, err)
+
+	assert.Ok(t, accountant.flush())
+
+	// simulate restart
+	accountant, err = New(storePath, 0, nil, logex.Discard)
+	assert.Ok(t, err)
+
+	monthUsage, err := accountant.Usage("2026-10")
+	assert.Ok(t, err)
+
+	csv := &bytes.Buffer{}
+	assert.Ok(t, WriteCsv(csv, monthUsage))
+	assert.EqualString(t, csv.String(), `identity,kind,port,bytes_in,bytes_out,connections
+camera,forwarded-tcpip,8080,60,30,2
+camera,forwarded-udp,8080,0,10,1
+`)
+
+	dayUsage, err := accountant.Usage("2026-10-19")
+	assert.Ok(t, err)
+	assert.Assert(t, len(dayUsage) == 1 && dayUsage[0].BytesIn == 0 && dayUsage[0].Connections == 1)
+
+	_, err = accountant.Usage("October")
+	assert.EqualString(t, err.Error(), "period must be day (2006-01-02) or month (2006-01)")
+}
+
+func TestQuotaEnforcedOnOpenConnection(t *testing.T) {
+	accountant, err := New("", 0, []Quota{
+		{Identity: "camera", Period: "day", MaxBytes: 100, Action: "refuse"},
+	}, logex.Discard)
+	assert.Ok(t, err)
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	accountant.now = func() time.Time { return now }
+
+	wrap, err := accountant.Intercept(sshserverportforward.StreamInfo{Identity: "camera", Kind: "forwarded-tcpip", Port: 8080})
+	assert.Ok(t, err)
+	stream := wrap(&fakeStream{bytes.NewBuffer(make([]byte, 60)), &bytes.Buffer{}})
+
+	_, err = stream.Write(make([]byte, 150))
+	assert.Ok(t, err)
+
+	// quota is re-checked at most once a second
+	_, err = stream.Read(make([]byte, 10))
+	assert.Ok(t, err)
+
+	now = now.Add(time.Second)
+
+	_, err = stream.Read(make([]byte, 10))
+	assert.EqualString(t, err.Error(), "day quota of 100 bytes exceeded")
+	_, err = stream.Write(make([]byte, 10))
+	assert.EqualString(t, err.Error(), "day quota of 100 bytes exceeded")
+
+	// doesn't heal within the connection
+	now = now.Add(24 * time.Hour)
+
+	_, err = stream.Read(make([]byte, 10))
+	assert.EqualString(t, err.Error(), "day quota of 100 bytes exceeded")
+}
+
+func TestThrottleSharedByConnections(t *testing.T) {
+	accountant, err := New("", 0, []Quota{
+		{Identity: "*", Period: "day", MaxBytes: 100, Action: "throttle", ThrottleBytesPerSecond: 1000},
+	}, logex.Discard)
+	assert.Ok(t, err)
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	accountant.now = func() time.Time { return now }
+
+	camera := sshserverportforward.StreamInfo{Identity: "hp/camera", Kind: "forwarded-tcpip", Port: 8080}
+
+	streams := []io.ReadWriteCloser{}
+	for i := 0; i < 2; i++ {
+		wrap, err := accountant.Intercept(camera)
+		assert.Ok(t, err)
+		streams = append(streams, wrap(&fakeStream{&bytes.Buffer{}, &bytes.Buffer{}}))
+	}
+
+	_, err = streams[0].Write(make([]byte, 150)) // not throttled yet
+	assert.Ok(t, err)
+
+	now = now.Add(time.Second)
+
+	// each write is the limiter's whole burst, so the second one has to wait for a second
+	started := time.Now()
+
+	wg := sync.WaitGroup{}
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream io.ReadWriteCloser) {
+			defer wg.Done()
+			_, err := stream.Write(make([]byte, 1000))
+			assert.Ok(t, err)
+		}(stream)
+	}
+	wg.Wait()
+
+	assert.Assert(t, time.Since(started) > 800*time.Millisecond)
+
+	// next day the client isn't throttled anymore
+	now = now.Add(24 * time.Hour)
+
+	started = time.Now()
+	for _, stream := range streams {
+		_, err := stream.Write(make([]byte, 1000))
+		assert.Ok(t, err)
+	}
+	assert.Assert(t, time.Since(started) < 500*time.Millisecond)
+}
+
+func TestOldUsageIsPruned(t *testing.T) {
+	accountant, err := New("", 31, nil, logex.Discard)
+	assert.Ok(t, err)
+
+	camera := sshserverportforward.StreamInfo{Identity: "hp/camera", Kind: "forwarded-tcpip", Port: 8080}
+
+	connectOn := func(day string) {
+		t.Helper()
+
+		now, err := time.Parse(dayFormat, day)
+		assert.Ok(t, err)
+		accountant.now = func() time.Time { return now }
+
+		_, err = accountant.Intercept(camera)
+		assert.Ok(t, err)
+	}
+
+	connections := func(period string) int64 {
+		t.Helper()
+
+		usage, err := accountant.Usage(period)
+		assert.Ok(t, err)
+
+		total := int64(0)
+		for _, forward := range usage {
+			total += forward.Connections
+		}
+		return total
+	}
+
+	connectOn("2026-08-30")
+	connectOn("2026-08-31")
+	connectOn("2026-09-01")
+
+	// 31 days before October are kept
+	connectOn("2026-10-18")
+
+	assert.Assert(t, connections("2026-08") == 1)
+	assert.Assert(t, connections("2026-08-31") == 1)
+	assert.Assert(t, connections("2026-09") == 1)
+	assert.Assert(t, connections("2026-10") == 1)
+
+	_, err = New("", -1, nil, logex.Discard)
+	assert.EqualString(t, err.Error(), "usage retention days can't be negative")
+}
+
+func TestFailedFlushIsRetried(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "usageaccounting")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// directory doesn't exist yet, so writes fail
+	storePath := filepath.Join(tempDir, "state", "usage.json")
+
+	logs := &lockedBuffer{}
+	accountant, err := New(storePath, 0, nil, log.New(logs, "", 0))
+	assert.Ok(t, err)
+	accountant.flushInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- accountant.Run(ctx) }()
+
+	waitFor(t, func() bool { return strings.Contains(logs.String(), "persisting usage: ") })
+
+	assert.Ok(t, os.Mkdir(filepath.Dir(storePath), 0700))
+
+	waitFor(t, func() bool {
+		_, err := os.Stat(storePath)
+		return err == nil
+	})
+
+	cancel()
+	assert.Ok(t, <-runErr)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("condition not met in time")
+}
+
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.String()
+}
+
+type fakeStream struct {
+	toRead  *bytes.Buffer
+	written *bytes.Buffer
+}
+
+func (f *fakeStream) Read(p []byte) (int, error)  { return f.toRead.Read(p) }
+func (f *fakeStream) Write(p []byte) (int, error) { return f.written.Write(p) }
+func (f *fakeStream) Close() error                { return nil }